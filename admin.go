@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// RecentDownloadsCount - how many last saved files are shown on status page
+const RecentDownloadsCount = 50
+
+// AccountState - state of account and folder shown on status page and in /api/status
+type AccountState struct {
+	Account         string           `json:"account"`
+	Folder          string           `json:"folder"`
+	Checkpoint      string           `json:"checkpoint"`
+	Paused          bool             `json:"paused"`
+	Syncing         bool             `json:"syncing"`
+	LastSync        time.Time        `json:"last_sync"`
+	LastError       string           `json:"last_error"`
+	LastErrorTime   time.Time        `json:"last_error_time"`
+	RecentDownloads []RecentDownload `json:"recent_downloads"`
+}
+
+// RecentDownload - saved file, new files are first
+type RecentDownload struct {
+	Time     time.Time `json:"time"`
+	From     string    `json:"from"`
+	Subject  string    `json:"subject"`
+	Filename string    `json:"filename"`
+	Location string    `json:"location"`
+}
+
+// admin actions, they are done by main loop because IMAP client can not be used from several goroutines
+const (
+	AdminActionSync      = "sync"
+	AdminActionReprocess = "reprocess"
+)
+
+// AdminAction - request from admin API to main loop
+type AdminAction struct {
+	Type    string
+	FromUID uint32
+	ToUID   uint32
+}
+
+// Status - state of account, updated by downloader and read by admin server
+var Status = &AccountStatus{}
+
+// AccountStatus - AccountState guarded by mutex
+type AccountStatus struct {
+	mu    sync.Mutex
+	state AccountState
+}
+
+var adminActions = make(chan AdminAction, 10)
+
+// Snapshot returns copy of state
+func (s *AccountStatus) Snapshot() AccountState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	State := s.state
+	State.RecentDownloads = append([]RecentDownload{}, s.state.RecentDownloads...)
+
+	return State
+}
+
+func (s *AccountStatus) Init(Account, Folder, Checkpoint string) {
+	s.mu.Lock()
+	s.state.Account = Account
+	s.state.Folder = Folder
+	s.state.Checkpoint = Checkpoint
+	s.mu.Unlock()
+}
+
+func (s *AccountStatus) SetCheckpoint(Checkpoint string) {
+	s.mu.Lock()
+	s.state.Checkpoint = Checkpoint
+	s.mu.Unlock()
+}
+
+func (s *AccountStatus) SetSyncing(Syncing bool) {
+	s.mu.Lock()
+	s.state.Syncing = Syncing
+	if Syncing == false {
+		s.state.LastSync = time.Now()
+	}
+	s.mu.Unlock()
+}
+
+func (s *AccountStatus) SetError(err error) {
+	s.mu.Lock()
+	s.state.LastError = err.Error()
+	s.state.LastErrorTime = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *AccountStatus) SetPaused(Paused bool) {
+	s.mu.Lock()
+	s.state.Paused = Paused
+	s.mu.Unlock()
+}
+
+func (s *AccountStatus) IsPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state.Paused
+}
+
+func (s *AccountStatus) AddDownload(Metadata FileMetadata, Location string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	Download := RecentDownload{Time: time.Now(), From: Metadata.From, Subject: Metadata.Subject, Filename: Metadata.OriginalFilename, Location: Location}
+	s.state.RecentDownloads = append([]RecentDownload{Download}, s.state.RecentDownloads...)
+	if len(s.state.RecentDownloads) > RecentDownloadsCount {
+		s.state.RecentDownloads = s.state.RecentDownloads[:RecentDownloadsCount]
+	}
+}
+
+// StartAdminServer serves status page and API on AdminAddress (for example 127.0.0.1:8080), does nothing if it is empty.
+// Server without AdminToken is started only on loopback address
+func StartAdminServer() error {
+	Status.Init(myEnv["EMAIL"], MailboxName, myEnv["LastEmailUID"])
+	if myEnv["AdminAddress"] == "" {
+		return nil
+	}
+	if myEnv["AdminToken"] == "" && isLoopbackAddress(myEnv["AdminAddress"]) == false {
+		return errors.New("AdminToken is required for AdminAddress " + myEnv["AdminAddress"] + ", only loopback address can be used without it")
+	}
+
+	Handler := AdminHandler(myEnv["AdminToken"])
+	if myEnv["MetricsAddress"] == myEnv["AdminAddress"] {
+		Mux := http.NewServeMux()
+		Mux.Handle("/metrics", promhttp.Handler())
+		Mux.Handle("/", Handler)
+		Handler = Mux
+	}
+
+	go func() {
+		err := http.ListenAndServe(myEnv["AdminAddress"], Handler)
+		if err != nil {
+			slog.Error("Can not start admin server", "address", myEnv["AdminAddress"], "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// isLoopbackAddress returns true for host:port with localhost or loopback IP, empty host means all interfaces
+func isLoopbackAddress(Address string) bool {
+	Host, _, err := net.SplitHostPort(Address)
+	if err != nil {
+		return false
+	}
+	if Host == "localhost" {
+		return true
+	}
+	IP := net.ParseIP(Host)
+
+	return IP != nil && IP.IsLoopback()
+}
+
+// adminCookie - cookie with token, it is set by login form of status page
+const adminCookie = "admin_token"
+
+// AdminHandler - status page and API, Token is checked if it is not empty:
+// header "Authorization: Bearer <token>" for API or cookie set by /login form for browser.
+// Forms of status page contain CSRF token, POST without Authorization header is accepted only with it
+func AdminHandler(Token string) http.Handler {
+	CSRFToken := newCSRFToken()
+
+	Mux := http.NewServeMux()
+	Mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		adminStatusPage(w, r, CSRFToken)
+	})
+	Mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []AccountState{Status.Snapshot()})
+	})
+	Mux.HandleFunc("/api/sync", adminPost(func(r *http.Request) error {
+		return queueAdminAction(AdminAction{Type: AdminActionSync})
+	}))
+	Mux.HandleFunc("/api/pause", adminPost(func(r *http.Request) error {
+		Status.SetPaused(true)
+		slog.Info("Account is paused from admin API", "account", myEnv["EMAIL"])
+		return nil
+	}))
+	Mux.HandleFunc("/api/resume", adminPost(func(r *http.Request) error {
+		Status.SetPaused(false)
+		slog.Info("Account is resumed from admin API", "account", myEnv["EMAIL"])
+		return queueAdminAction(AdminAction{Type: AdminActionSync})
+	}))
+	Mux.HandleFunc("/api/reprocess", adminPost(func(r *http.Request) error {
+		FromUID, err1 := strconv.ParseUint(r.FormValue("from"), 10, 32)
+		ToUID, err2 := strconv.ParseUint(r.FormValue("to"), 10, 32)
+		if err1 != nil || err2 != nil || FromUID == 0 || ToUID < FromUID {
+			return errBadRequest
+		}
+		return queueAdminAction(AdminAction{Type: AdminActionReprocess, FromUID: uint32(FromUID), ToUID: uint32(ToUID)})
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			adminLogin(w, r, Token)
+			return
+		}
+
+		HeaderAuth := Token != "" && tokenEqual(r.Header.Get("Authorization"), "Bearer "+Token)
+		if Token != "" && HeaderAuth == false {
+			Cookie, err := r.Cookie(adminCookie)
+			if err != nil || tokenEqual(Cookie.Value, Token) == false {
+				if r.Method == http.MethodGet && r.URL.Path == "/" {
+					http.Redirect(w, r, "/login", http.StatusSeeOther)
+					return
+				}
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+		}
+
+		//browser sends cookie with forms from other sites, so form must contain token from status page
+		if r.Method == http.MethodPost && HeaderAuth == false && tokenEqual(r.FormValue("csrf"), CSRFToken) == false {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "csrf token is wrong"})
+			return
+		}
+
+		Mux.ServeHTTP(w, r)
+	})
+}
+
+// tokenEqual compares tokens in constant time
+func tokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// adminLogin shows login form and sets cookie with token, token is never put in URL
+func adminLogin(w http.ResponseWriter, r *http.Request, Token string) {
+	if Token == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = adminLoginTemplate.Execute(w, nil)
+		return
+	}
+
+	if tokenEqual(r.PostFormValue("token"), Token) == false {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = adminLoginTemplate.Execute(w, "Wrong token")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: adminCookie, Value: Token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+var errBadRequest = errors.New("from and to must be UIDs, from <= to")
+
+func adminPost(Action func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST is required"})
+			return
+		}
+
+		err := Action(r)
+		if err == errBadRequest {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+
+		//form on status page is redirected back
+		if r.FormValue("redirect") != "" {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "accepted"})
+	}
+}
+
+func queueAdminAction(Action AdminAction) error {
+	select {
+	case adminActions <- Action:
+		return nil
+	default:
+		return errors.New("too many queued actions")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, Code int, Value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(Code)
+	_ = json.NewEncoder(w).Encode(Value)
+}
+
+var adminTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>DownloadEmailsAttachments</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:2px 6px;text-align:left}</style>
+</head><body>
+<h1>{{.State.Account}} / {{.State.Folder}}</h1>
+<p>Checkpoint (UID): {{.State.Checkpoint}}<br>
+State: {{if .State.Paused}}paused{{else if .State.Syncing}}syncing{{else}}waiting{{end}}<br>
+Last sync: {{if not .State.LastSync.IsZero}}{{.State.LastSync.Format "2006-01-02 15:04:05"}}{{end}}<br>
+Last error: {{if .State.LastError}}{{.State.LastErrorTime.Format "2006-01-02 15:04:05"}} {{.State.LastError}}{{end}}</p>
+<form method="post"><input type="hidden" name="redirect" value="1"><input type="hidden" name="csrf" value="{{.CSRFToken}}">
+<button formaction="/api/sync">Sync now</button>
+{{if .State.Paused}}<button formaction="/api/resume">Resume</button>{{else}}<button formaction="/api/pause">Pause</button>{{end}}
+UID from <input name="from" size="8"> to <input name="to" size="8"> <button formaction="/api/reprocess">Reprocess</button>
+</form>
+<h2>Recent downloads</h2>
+<table><tr><th>Time</th><th>From</th><th>Subject</th><th>File</th><th>Location</th></tr>
+{{range .State.RecentDownloads}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.From}}</td><td>{{.Subject}}</td><td>{{.Filename}}</td><td>{{.Location}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+var adminLoginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>DownloadEmailsAttachments</title></head><body>
+{{if .}}<p>{{.}}</p>{{end}}
+<form method="post" action="/login">AdminToken <input type="password" name="token"> <button>Login</button></form>
+</body></html>
+`))
+
+func adminStatusPage(w http.ResponseWriter, r *http.Request, CSRFToken string) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := adminTemplate.Execute(w, map[string]interface{}{"State": Status.Snapshot(), "CSRFToken": CSRFToken})
+	if err != nil {
+		slog.Warn("Can not show status page", "error", err)
+	}
+}
+
+// WaitNextSync waits PauseSeconds or sync request from admin API, reprocess requests are done while waiting.
+// Paused account waits until it is resumed, ctx stops waiting
+func WaitNextSync(ctx context.Context, PauseSeconds int) {
+	Timer := time.NewTimer(time.Second * time.Duration(PauseSeconds))
+	defer Timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-Timer.C:
+			if Status.IsPaused() == false {
+				return
+			}
+			Timer.Reset(time.Second * time.Duration(PauseSeconds))
+		case Action := <-adminActions:
+			switch Action.Type {
+			case AdminActionSync:
+				if Status.IsPaused() == false {
+					return
+				}
+			case AdminActionReprocess:
+				err := ReprocessMessages(ctx, Action.FromUID, Action.ToUID)
+				if err != nil {
+					slog.Error("Can not reprocess messages", "from_uid", Action.FromUID, "to_uid", Action.ToUID, "error", err)
+					Status.SetError(err)
+				}
+			}
+		}
+	}
+}
+
+// ReprocessMessages processes messages with UIDs from FromUID to ToUID again, checkpoint is not changed
+func ReprocessMessages(ctx context.Context, FromUID, ToUID uint32) error {
+	slog.Info("Reprocessing messages", "account", myEnv["EMAIL"], "folder", MailboxName, "from_uid", FromUID, "to_uid", ToUID)
+	if MailDownloader == nil {
+		return errors.New("downloader is not created")
+	}
+
+	_, err := MailDownloader.Reprocess(ctx, FromUID, ToUID)
+	return err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, Server *httptest.Server, Method, Path, Token string) *http.Response {
+	req, err := http.NewRequest(Method, Server.URL+Path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Token != "" {
+		req.Header.Set("Authorization", "Bearer "+Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// adminClient - client of browser, it keeps cookies and follows redirects
+func adminClient(t *testing.T) *http.Client {
+	Jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{Jar: Jar}
+}
+
+func TestAdminHandler(t *testing.T) {
+	Status = &AccountStatus{}
+	Status.Init("buh@example.com", MailboxName, "41")
+	Status.AddDownload(FileMetadata{From: "price@supplier.ru", Subject: "Price", OriginalFilename: "price.xlsx"}, "Files/price.xlsx")
+	for len(adminActions) > 0 {
+		<-adminActions
+	}
+
+	Server := httptest.NewServer(AdminHandler("secret"))
+	defer Server.Close()
+
+	if resp := adminRequest(t, Server, http.MethodGet, "/api/status", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Request without token. Expected: %d, Got: %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	resp := adminRequest(t, Server, http.MethodGet, "/api/status", "secret")
+	var States []AccountState
+	err := json.NewDecoder(resp.Body).Decode(&States)
+	resp.Body.Close()
+	if err != nil || len(States) != 1 || States[0].Checkpoint != "41" || len(States[0].RecentDownloads) != 1 {
+		t.Fatalf("Wrong status: %+v %v", States, err)
+	}
+
+	//token in URL is not accepted, browser is sent to login form
+	Client := adminClient(t)
+	resp, err = Client.Get(Server.URL + "/?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/login" {
+		t.Errorf("Token in URL is accepted: %s", resp.Request.URL)
+	}
+
+	resp, err = Client.PostForm(Server.URL+"/login", url.Values{"token": {"wrong"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Wrong token is accepted by login: %d", resp.StatusCode)
+	}
+
+	//login sets cookie and redirects to status page
+	resp, err = Client.PostForm(Server.URL+"/login", url.Values{"token": {"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(Page), "price.xlsx") == false {
+		t.Errorf("Status page does not show recent download")
+	}
+	if strings.Contains(string(Page), "secret") == true {
+		t.Errorf("Token is shown on status page")
+	}
+	CSRFToken := regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`).FindStringSubmatch(string(Page))
+	if CSRFToken == nil {
+		t.Fatalf("CSRF token is not found on status page")
+	}
+
+	//form with cookie needs csrf token
+	resp, err = Client.PostForm(Server.URL+"/api/pause", url.Values{"redirect": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || Status.IsPaused() == true {
+		t.Errorf("Form without csrf token is accepted: %d", resp.StatusCode)
+	}
+	resp, err = Client.PostForm(Server.URL+"/api/pause", url.Values{"redirect": {"1"}, "csrf": {CSRFToken[1]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.String() != Server.URL+"/" || Status.IsPaused() == false {
+		t.Errorf("Form is not accepted: %d %s", resp.StatusCode, resp.Request.URL)
+	}
+	Status.SetPaused(false)
+
+	if resp = adminRequest(t, Server, http.MethodPost, "/api/pause", "secret"); resp.StatusCode != http.StatusAccepted || Status.IsPaused() == false {
+		t.Errorf("Account is not paused: %d", resp.StatusCode)
+	}
+	if resp = adminRequest(t, Server, http.MethodPost, "/api/reprocess?from=10&to=5", "secret"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Wrong range. Expected: %d, Got: %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if resp = adminRequest(t, Server, http.MethodPost, "/api/reprocess?from=5&to=10", "secret"); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Reprocess is not accepted: %d", resp.StatusCode)
+	}
+	Action := <-adminActions
+	if Action.Type != AdminActionReprocess || Action.FromUID != 5 || Action.ToUID != 10 {
+		t.Errorf("Wrong action: %+v", Action)
+	}
+
+	//paused account does not sync until it is resumed
+	Done := make(chan bool)
+	go func() {
+		WaitNextSync(context.Background(), 3600)
+		Done <- true
+	}()
+	adminRequest(t, Server, http.MethodPost, "/api/sync", "secret")
+	select {
+	case <-Done:
+		t.Fatalf("Paused account is synced")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	adminRequest(t, Server, http.MethodPost, "/api/resume", "secret")
+	select {
+	case <-Done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Resumed account is not synced")
+	}
+}
+
+func TestAdminHandlerWithoutToken(t *testing.T) {
+	Status = &AccountStatus{}
+	for len(adminActions) > 0 {
+		<-adminActions
+	}
+
+	Server := httptest.NewServer(AdminHandler(""))
+	defer Server.Close()
+
+	if resp := adminRequest(t, Server, http.MethodGet, "/api/status", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Status is not shown: %d", resp.StatusCode)
+	}
+
+	//form from other site can not be posted
+	resp, err := http.PostForm(Server.URL+"/api/sync", url.Values{"redirect": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || len(adminActions) != 0 {
+		t.Errorf("POST without csrf token is accepted: %d", resp.StatusCode)
+	}
+}
+
+func TestStartAdminServer(t *testing.T) {
+	var testData = []struct {
+		Address string
+		Token   string
+		Error   bool
+	}{
+		{"", "", false},
+		{"127.0.0.1:0", "", false},
+		{"localhost:0", "", false},
+		{"[::1]:0", "", false},
+		{":0", "", true},
+		{"0.0.0.0:0", "", true},
+		{"192.168.1.10:0", "", true},
+		{":0", "secret", false},
+	}
+
+	for i, Test := range testData {
+		myEnv = map[string]string{"AdminAddress": Test.Address, "AdminToken": Test.Token}
+		err := StartAdminServer()
+		if (err != nil) != Test.Error {
+			t.Errorf("[Test Case %v] Wrong result for %q: %v", i+1, Test.Address, err)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alexmullins/zip"
+	"github.com/bodgit/sevenzip"
+	"github.com/nwaples/rardecode"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// ArchiveFile - one file extracted from archive attachment
+type ArchiveFile struct {
+	Filename string
+	Data     []byte
+}
+
+// ArchiveLimits - protection from zip bombs, counters are shared for all nested archives of one attachment
+type ArchiveLimits struct {
+	MaxDepth     int
+	MaxTotalSize int64
+	MaxEntries   int
+
+	TotalSize int64
+	Entries   int
+}
+
+var ErrArchiveTooBig = errors.New("archive uncompressed size limit exceeded")
+var ErrArchiveTooManyEntries = errors.New("archive entries count limit exceeded")
+
+// ArchiveExtensions - known archive extensions, longest first
+var ArchiveExtensions = []string{".tar.gz", ".tgz", ".tar", ".gz", ".zip", ".7z", ".rar"}
+
+// ArchiveExtension returns archive extension of filename or "" if file is not archive
+func ArchiveExtension(Filename string) string {
+	FilenameLower := strings.ToLower(Filename)
+	for _, ext := range ArchiveExtensions {
+		if strings.HasSuffix(FilenameLower, ext) {
+			return ext
+		}
+	}
+
+	return ""
+}
+
+// IsArchive returns true if filename has archive extension
+func IsArchive(Filename string) bool {
+	return ArchiveExtension(Filename) != ""
+}
+
+// NewArchiveLimits - fill limits from settings
+func NewArchiveLimits() *ArchiveLimits {
+	Limits := &ArchiveLimits{
+		MaxDepth:     3,
+		MaxTotalSize: 1024 * 1024 * 1024,
+		MaxEntries:   1000,
+	}
+
+	if s := myEnv["ArchiveMaxDepth"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err == nil {
+			Limits.MaxDepth = n
+		}
+	}
+
+	if s := myEnv["ArchiveMaxTotalSize"]; s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err == nil {
+			Limits.MaxTotalSize = n
+		}
+	}
+
+	if s := myEnv["ArchiveMaxEntries"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err == nil {
+			Limits.MaxEntries = n
+		}
+	}
+
+	return Limits
+}
+
+// ArchivePassword returns password for archives from this sender.
+// Setting format: ArchivePasswords=supplier@mail.ru:password1,@domain.ru:password2
+func ArchivePassword(EmailAddress string) string {
+	Password, _ := SenderSetting(myEnv["ArchivePasswords"], EmailAddress)
+	return Password
+}
+
+// SenderSetting returns value for sender from list "supplier@mail.ru:value1,@domain.ru:value2",
+// address is preferred to domain. false is returned if sender is not in list
+func SenderSetting(List, EmailAddress string) (string, bool) {
+	EmailAddress = strings.ToLower(EmailAddress)
+	Domain := ""
+	pos1 := strings.Index(EmailAddress, "@")
+	if pos1 >= 0 {
+		Domain = EmailAddress[pos1:]
+	}
+
+	Otvet := ""
+	Found := false
+	for _, Pair := range strings.Split(List, ",") {
+		pos1 := strings.Index(Pair, ":")
+		if pos1 <= 0 {
+			continue
+		}
+		Sender := strings.ToLower(strings.TrimSpace(Pair[:pos1]))
+		Value := Pair[pos1+1:]
+		if Sender == EmailAddress {
+			return Value, true
+		}
+		if Sender == Domain {
+			Otvet = Value
+			Found = true
+		}
+	}
+
+	return Otvet, Found
+}
+
+// ExpandArchive extracts all files from archive, nested archives are extracted too while Depth < Limits.MaxDepth.
+// Files which are not archives are returned as is.
+func ExpandArchive(Filename string, Data []byte, Password string, Depth int, Limits *ArchiveLimits) ([]ArchiveFile, error) {
+	var Otvet []ArchiveFile
+
+	ext := ArchiveExtension(Filename)
+	if ext == "" || Depth >= Limits.MaxDepth {
+		Otvet = append(Otvet, ArchiveFile{Filename: Filename, Data: Data})
+		return Otvet, nil
+	}
+
+	var Files []ArchiveFile
+	var err error
+	switch ext {
+	case ".zip":
+		Files, err = readZip(Data, Password, Limits)
+	case ".tar":
+		Files, err = readTar(bytes.NewReader(Data), Limits)
+	case ".tar.gz", ".tgz":
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(bytes.NewReader(Data))
+		if err == nil {
+			Files, err = readTar(gz, Limits)
+		}
+	case ".gz":
+		Files, err = readGzip(Filename, Data, Limits)
+	case ".7z":
+		Files, err = read7z(Data, Password, Limits)
+	case ".rar":
+		Files, err = readRar(Data, Password, Limits)
+	}
+	if err != nil {
+		return Otvet, err
+	}
+
+	for _, File1 := range Files {
+		if File1.Filename == "" {
+			continue
+		}
+
+		Files2, err := ExpandArchive(File1.Filename, File1.Data, Password, Depth+1, Limits)
+		Otvet = append(Otvet, Files2...)
+		if err != nil {
+			return Otvet, err
+		}
+	}
+
+	return Otvet, nil
+}
+
+// discardArchiveEntry reads one entry without keeping it in memory and checks limits
+func discardArchiveEntry(r io.Reader, Limits *ArchiveLimits) error {
+	Limits.Entries++
+	if Limits.MaxEntries > 0 && Limits.Entries > Limits.MaxEntries {
+		return ErrArchiveTooManyEntries
+	}
+
+	if Limits.MaxTotalSize <= 0 {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	Remaining := Limits.MaxTotalSize - Limits.TotalSize
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(r, Remaining+1))
+	Limits.TotalSize += n
+	if err != nil {
+		return err
+	}
+	if n > Remaining {
+		return ErrArchiveTooBig
+	}
+
+	return nil
+}
+
+// readArchiveEntry reads one entry and checks limits
+func readArchiveEntry(r io.Reader, Limits *ArchiveLimits) ([]byte, error) {
+	Limits.Entries++
+	if Limits.MaxEntries > 0 && Limits.Entries > Limits.MaxEntries {
+		return nil, ErrArchiveTooManyEntries
+	}
+
+	if Limits.MaxTotalSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	Remaining := Limits.MaxTotalSize - Limits.TotalSize
+	Data, err := ioutil.ReadAll(io.LimitReader(r, Remaining+1))
+	Limits.TotalSize += int64(len(Data))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(Data)) > Remaining {
+		return nil, ErrArchiveTooBig
+	}
+
+	return Data, nil
+}
+
+// archiveEntryName - file name without directories, so files can not be written outside OutputDirectory.
+// Returns "" for names without file name: "", ".", "..", "dir/"
+func archiveEntryName(Name string) string {
+	Name = strings.ReplaceAll(Name, "\\", "/")
+	Name = path.Base(Name)
+	if Name == "." || Name == ".." || Name == "/" {
+		return ""
+	}
+
+	return Name
+}
+
+func readZip(Data []byte, Password string, Limits *ArchiveLimits) ([]ArchiveFile, error) {
+	var Otvet []ArchiveFile
+
+	zr, err := zip.NewReader(bytes.NewReader(Data), int64(len(Data)))
+	if err != nil {
+		return Otvet, err
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		if f.IsEncrypted() {
+			f.SetPassword(Password)
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return Otvet, err
+		}
+		Data1, err := readArchiveEntry(rc, Limits)
+		rc.Close()
+		if err != nil {
+			return Otvet, err
+		}
+
+		// Windows archivers write names in cp866 without UTF-8 flag
+		Name := f.Name
+		if f.Flags&0x800 == 0 && utf8.ValidString(Name) == false {
+			Name1, err := charmap.CodePage866.NewDecoder().String(Name)
+			if err == nil {
+				Name = Name1
+			}
+		}
+
+		Otvet = append(Otvet, ArchiveFile{Filename: archiveEntryName(Name), Data: Data1})
+	}
+
+	return Otvet, nil
+}
+
+func readTar(r io.Reader, Limits *ArchiveLimits) ([]ArchiveFile, error) {
+	var Otvet []ArchiveFile
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return Otvet, err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		Data1, err := readArchiveEntry(tr, Limits)
+		if err != nil {
+			return Otvet, err
+		}
+
+		Otvet = append(Otvet, ArchiveFile{Filename: archiveEntryName(hdr.Name), Data: Data1})
+	}
+
+	return Otvet, nil
+}
+
+func readGzip(Filename string, Data []byte, Limits *ArchiveLimits) ([]ArchiveFile, error) {
+	var Otvet []ArchiveFile
+
+	gz, err := gzip.NewReader(bytes.NewReader(Data))
+	if err != nil {
+		return Otvet, err
+	}
+	defer gz.Close()
+
+	Data1, err := readArchiveEntry(gz, Limits)
+	if err != nil {
+		return Otvet, err
+	}
+
+	Name := gz.Name
+	if Name == "" {
+		Name = Filename[:len(Filename)-len(".gz")]
+	}
+
+	Otvet = append(Otvet, ArchiveFile{Filename: archiveEntryName(Name), Data: Data1})
+
+	return Otvet, nil
+}
+
+func read7z(Data []byte, Password string, Limits *ArchiveLimits) ([]ArchiveFile, error) {
+	var Otvet []ArchiveFile
+
+	zr, err := sevenzip.NewReaderWithPassword(bytes.NewReader(Data), int64(len(Data)), Password)
+	if err != nil {
+		return Otvet, err
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return Otvet, err
+		}
+		Data1, err := readArchiveEntry(rc, Limits)
+		rc.Close()
+		if err != nil {
+			return Otvet, err
+		}
+
+		Otvet = append(Otvet, ArchiveFile{Filename: archiveEntryName(f.Name), Data: Data1})
+	}
+
+	return Otvet, nil
+}
+
+func readRar(Data []byte, Password string, Limits *ArchiveLimits) ([]ArchiveFile, error) {
+	var Otvet []ArchiveFile
+
+	rr, err := rardecode.NewReader(bytes.NewReader(Data), Password)
+	if err != nil {
+		return Otvet, err
+	}
+
+	for {
+		hdr, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return Otvet, err
+		}
+
+		if hdr.IsDir {
+			continue
+		}
+
+		Data1, err := readArchiveEntry(rr, Limits)
+		if err != nil {
+			return Otvet, err
+		}
+
+		Otvet = append(Otvet, ArchiveFile{Filename: archiveEntryName(hdr.Name), Data: Data1})
+	}
+
+	return Otvet, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/alexmullins/zip"
+)
+
+// zipEntry - file of test archive, archive is encrypted if Password is set
+type zipEntry struct {
+	Name     string
+	Data     []byte
+	Password string
+}
+
+func makeArchive(t *testing.T, Entries ...zipEntry) []byte {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for _, Entry := range Entries {
+		var f io.Writer
+		var err error
+		if Entry.Password != "" {
+			f, err = w.Encrypt(Entry.Name, Entry.Password)
+		} else {
+			f, err = w.Create(Entry.Name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.Write(Entry.Data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func TestExpandArchive(t *testing.T) {
+	myEnv = map[string]string{}
+	Inner := makeArchive(t, zipEntry{Name: "price.xlsx", Data: []byte("inner")})
+	Inner2 := makeArchive(t, zipEntry{Name: "inner.zip", Data: Inner})
+	Secret := makeArchive(t, zipEntry{Name: "price.xlsx", Data: []byte("secret"), Password: "pass1"})
+
+	var testData = []struct {
+		Filename string
+		Data     []byte
+		Password string
+		Limits   ArchiveLimits
+		Files    []string
+		Err      error
+	}{
+		{"report.xlsx", []byte("not archive"), "", ArchiveLimits{MaxDepth: 3}, []string{"report.xlsx"}, nil},
+		{"prices.zip", makeArchive(t, zipEntry{Name: "a.xlsx", Data: []byte("a")}, zipEntry{Name: "b.csv", Data: []byte("b")}), "",
+			ArchiveLimits{MaxDepth: 3}, []string{"a.xlsx", "b.csv"}, nil},
+		//nested archives are expanded while depth < MaxDepth
+		{"outer.zip", Inner2, "", ArchiveLimits{MaxDepth: 3}, []string{"price.xlsx"}, nil},
+		{"outer.zip", Inner2, "", ArchiveLimits{MaxDepth: 1}, []string{"inner.zip"}, nil},
+		{"outer.zip", Inner2, "", ArchiveLimits{MaxDepth: 0}, []string{"outer.zip"}, nil},
+		//zip bomb
+		{"bomb.zip", makeArchive(t, zipEntry{Name: "a.xlsx", Data: make([]byte, 1000)}), "",
+			ArchiveLimits{MaxDepth: 3, MaxTotalSize: 999}, nil, ErrArchiveTooBig},
+		{"bomb.zip", makeArchive(t, zipEntry{Name: "a.xlsx", Data: make([]byte, 1000)}), "",
+			ArchiveLimits{MaxDepth: 3, MaxTotalSize: 1000}, []string{"a.xlsx"}, nil},
+		{"many.zip", makeArchive(t, zipEntry{Name: "a.xlsx"}, zipEntry{Name: "b.xlsx"}, zipEntry{Name: "c.xlsx"}), "",
+			ArchiveLimits{MaxDepth: 3, MaxEntries: 2}, nil, ErrArchiveTooManyEntries},
+		//limits are shared by nested archives
+		{"outer.zip", makeArchive(t, zipEntry{Name: "inner.zip", Data: Inner}), "",
+			ArchiveLimits{MaxDepth: 3, MaxEntries: 1}, nil, ErrArchiveTooManyEntries},
+		//password protected
+		{"secret.zip", Secret, "pass1", ArchiveLimits{MaxDepth: 3}, []string{"price.xlsx"}, nil},
+		//entry names are cleaned
+		{"names.zip", makeArchive(t, zipEntry{Name: "../../evil.xlsx"}, zipEntry{Name: "dir\\..\\win.xlsx"},
+			zipEntry{Name: "/etc/passwd.csv"}, zipEntry{Name: ".."}), "",
+			ArchiveLimits{MaxDepth: 3}, []string{"evil.xlsx", "win.xlsx", "passwd.csv"}, nil},
+	}
+
+	for i, Test := range testData {
+		Limits := Test.Limits
+		Files, err := ExpandArchive(Test.Filename, Test.Data, Test.Password, 0, &Limits)
+		if err != Test.Err {
+			t.Errorf("[Test Case %v] Wrong error. Expected: %v, Got: %v", i+1, Test.Err, err)
+		}
+
+		var Names []string
+		for _, File1 := range Files {
+			Names = append(Names, File1.Filename)
+		}
+		if len(Names) != len(Test.Files) {
+			t.Errorf("[Test Case %v] Wrong files. Expected: %v, Got: %v", i+1, Test.Files, Names)
+			continue
+		}
+		for j := range Names {
+			if Names[j] != Test.Files[j] {
+				t.Errorf("[Test Case %v] Wrong files. Expected: %v, Got: %v", i+1, Test.Files, Names)
+				break
+			}
+		}
+	}
+}
+
+func TestExpandArchiveWrongPassword(t *testing.T) {
+	Secret := makeArchive(t, zipEntry{Name: "price.xlsx", Data: []byte("secret"), Password: "pass1"})
+
+	for i, Password := range []string{"", "wrong"} {
+		Files, err := ExpandArchive("secret.zip", Secret, Password, 0, &ArchiveLimits{MaxDepth: 3})
+		if err == nil || len(Files) != 0 {
+			t.Errorf("[Test Case %v] Archive is expanded with wrong password: %v", i+1, Files)
+		}
+	}
+}
+
+func TestArchivePassword(t *testing.T) {
+	myEnv = map[string]string{"ArchivePasswords": "price@supplier.ru:pass1, @supplier.ru:pass2,@other.ru:p:3"}
+
+	var testData = []struct {
+		EmailAddress string
+		Password     string
+	}{
+		{"price@supplier.ru", "pass1"},
+		{"Price@Supplier.ru", "pass1"},
+		{"buh@supplier.ru", "pass2"},
+		{"buh@other.ru", "p:3"},
+		{"buh@unknown.ru", ""},
+		{"", ""},
+	}
+
+	for i, Test := range testData {
+		if Password := ArchivePassword(Test.EmailAddress); Password != Test.Password {
+			t.Errorf("[Test Case %v] Wrong password. Expected: %q, Got: %q", i+1, Test.Password, Password)
+		}
+	}
+}
+
+func TestNewArchiveLimits(t *testing.T) {
+	myEnv = map[string]string{}
+	Limits := NewArchiveLimits()
+	if Limits.MaxDepth != 3 || Limits.MaxTotalSize != 1024*1024*1024 || Limits.MaxEntries != 1000 {
+		t.Errorf("Wrong default limits: %+v", Limits)
+	}
+
+	myEnv = map[string]string{"ArchiveMaxDepth": "1", "ArchiveMaxTotalSize": "100", "ArchiveMaxEntries": "abc"}
+	Limits = NewArchiveLimits()
+	if Limits.MaxDepth != 1 || Limits.MaxTotalSize != 100 || Limits.MaxEntries != 1000 {
+		t.Errorf("Wrong limits: %+v", Limits)
+	}
+}
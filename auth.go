@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Resolver - DNS lookups for DKIM, SPF and DMARC checks, compatible with *net.Resolver
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// AuthResolver - resolver used for sender checks, tests replace it with static zone
+var AuthResolver Resolver = net.DefaultResolver
+
+// authentication results, the same as in Authentication-Results header
+const (
+	AuthPass      = "pass"
+	AuthFail      = "fail"
+	AuthNone      = "none"
+	AuthTempError = "temperror"
+	AuthPermError = "permerror"
+)
+
+// ErrAuthTemporary - DNS lookups of checks failed temporarily, message must be checked again later
+var ErrAuthTemporary = errors.New("temporary error of sender authentication")
+
+// SenderAuth - results of DKIM, SPF and DMARC checks of message
+type SenderAuth struct {
+	DKIM        string
+	DKIMDomains []string //domains of valid DKIM signatures
+	SPF         string
+	SPFDomain   string //domain of Return-Path
+	DMARC       string
+}
+
+func (a SenderAuth) String() string {
+	return "dkim=" + a.DKIM + " spf=" + a.SPF + " dmarc=" + a.DMARC
+}
+
+// CheckSenderAuth returns error if sender is in RequireAuthFrom list and checks from RequireAuth
+// (comma separated dkim, spf, dmarc, default dmarc) did not pass.
+// Error wraps ErrAuthTemporary if checks did not fail, but some of them got temperror.
+// If AuthTrustedAuthservID is set results are taken from Authentication-Results header of own mail server
+func CheckSenderAuth(RawBytes []byte, EmailAddress string) error {
+	if SenderInList(EmailAddress, myEnv["RequireAuthFrom"]) == false {
+		return nil
+	}
+
+	var Auth SenderAuth
+	var err error
+	if myEnv["AuthTrustedAuthservID"] != "" {
+		Auth, err = SenderAuthFromHeader(RawBytes, myEnv["AuthTrustedAuthservID"])
+	} else {
+		Auth, err = AuthenticateSender(RawBytes, EmailAddress)
+	}
+	if err != nil {
+		return err
+	}
+
+	Required := myEnv["RequireAuth"]
+	if Required == "" {
+		Required = "dmarc"
+	}
+	Temporary := false
+	for _, Check := range strings.Split(Required, ",") {
+		Result := ""
+		switch strings.ToLower(strings.TrimSpace(Check)) {
+		case "dkim":
+			Result = Auth.DKIM
+		case "spf":
+			Result = Auth.SPF
+		case "dmarc":
+			Result = Auth.DMARC
+		default:
+			return errors.New("unknown RequireAuth check: " + Check)
+		}
+		if Result == AuthTempError {
+			Temporary = true
+		} else if Result != AuthPass {
+			return errors.New("sender authentication failed: " + Auth.String())
+		}
+	}
+	if Temporary == true {
+		return fmt.Errorf("%w: %s", ErrAuthTemporary, Auth.String())
+	}
+
+	return nil
+}
+
+// SenderAuthFromHeader takes results from the first Authentication-Results header with AuthservID.
+// Mail server must remove such headers from incoming messages, otherwise sender can fake them
+func SenderAuthFromHeader(RawBytes []byte, AuthservID string) (SenderAuth, error) {
+	Auth := SenderAuth{DKIM: AuthNone, SPF: AuthNone, DMARC: AuthNone}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(RawBytes))
+	if err != nil {
+		return Auth, err
+	}
+
+	for _, Value := range msg.Header["Authentication-Results"] {
+		Identifier, Results, err := authres.Parse(Value)
+		if err != nil || strings.EqualFold(Identifier, AuthservID) == false {
+			continue
+		}
+
+		for _, Result := range Results {
+			switch r := Result.(type) {
+			case *authres.DKIMResult:
+				//message can have several signatures, one valid is enough
+				if r.Value == authres.ResultPass {
+					Auth.DKIM = AuthPass
+					Auth.DKIMDomains = append(Auth.DKIMDomains, r.Domain)
+				} else if Auth.DKIM != AuthPass {
+					Auth.DKIM = string(r.Value)
+				}
+			case *authres.SPFResult:
+				Auth.SPF = string(r.Value)
+				Auth.SPFDomain = domainOf(r.From)
+			case *authres.DMARCResult:
+				Auth.DMARC = string(r.Value)
+			}
+		}
+
+		return Auth, nil
+	}
+
+	return Auth, errors.New("Authentication-Results header of " + AuthservID + " is not found")
+}
+
+// AuthenticateSender verifies DKIM signatures, SPF of client IP from Received header and DMARC policy of From domain
+func AuthenticateSender(RawBytes []byte, FromAddress string) (SenderAuth, error) {
+	Auth := SenderAuth{DKIM: AuthNone, SPF: AuthNone, DMARC: AuthNone}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(RawBytes))
+	if err != nil {
+		return Auth, err
+	}
+
+	Auth.DKIM, Auth.DKIMDomains = checkDKIM(RawBytes)
+	Auth.SPF, Auth.SPFDomain = checkSPF(msg.Header, FromAddress)
+	Auth.DMARC = checkDMARC(Auth, domainOf(FromAddress))
+
+	return Auth, nil
+}
+
+func lookupTXT(Domain string) ([]string, error) {
+	return AuthResolver.LookupTXT(context.Background(), Domain)
+}
+
+func checkDKIM(RawBytes []byte) (string, []string) {
+	Verifications, err := dkim.VerifyWithOptions(bytes.NewReader(RawBytes), &dkim.VerifyOptions{LookupTXT: lookupTXT, MaxVerifications: 10})
+	if err != nil && len(Verifications) == 0 {
+		return AuthPermError, nil
+	}
+	if len(Verifications) == 0 {
+		return AuthNone, nil
+	}
+
+	Result := AuthFail
+	var Domains []string
+	for _, v := range Verifications {
+		if v.Err == nil {
+			Result = AuthPass
+			Domains = append(Domains, strings.ToLower(v.Domain))
+		} else if dkim.IsTempFail(v.Err) && Result == AuthFail {
+			Result = AuthTempError
+		}
+	}
+
+	return Result, Domains
+}
+
+// receivedIP finds client IP and HELO name in Received header: "from helo.example.com (host [1.2.3.4]) by ...".
+// Header of own server is taken: the first one or the first with "by AuthReceivedBy"
+var receivedIP = regexp.MustCompile(`\[(?:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+
+func checkSPF(Header mail.Header, FromAddress string) (string, string) {
+	Sender := strings.Trim(strings.TrimSpace(Header.Get("Return-Path")), "<>")
+	if Sender == "" {
+		Sender = FromAddress
+	}
+
+	for _, Received := range Header["Received"] {
+		By := myEnv["AuthReceivedBy"]
+		if By != "" && strings.Contains(strings.ToLower(Received), "by "+strings.ToLower(By)) == false {
+			continue
+		}
+
+		Match := receivedIP.FindStringSubmatch(Received)
+		if Match == nil {
+			return AuthNone, domainOf(Sender)
+		}
+		IP := net.ParseIP(Match[1])
+		if IP == nil {
+			return AuthNone, domainOf(Sender)
+		}
+
+		Helo := ""
+		if Fields := strings.Fields(Received); len(Fields) > 1 && strings.EqualFold(Fields[0], "from") {
+			Helo = Fields[1]
+		}
+
+		Result, _ := spf.CheckHostWithSender(IP, Helo, Sender, spf.WithResolver(AuthResolver))
+		return string(Result), domainOf(Sender)
+	}
+
+	return AuthNone, domainOf(Sender)
+}
+
+// checkDMARC looks for policy of From domain or its organizational domain and checks alignment of DKIM and SPF domains
+func checkDMARC(Auth SenderAuth, FromDomain string) string {
+	if FromDomain == "" {
+		return AuthPermError
+	}
+
+	OrgDomain := organizationalDomain(FromDomain)
+	Record, err := dmarc.LookupWithOptions(FromDomain, &dmarc.LookupOptions{LookupTXT: lookupTXT})
+	if err == dmarc.ErrNoPolicy && OrgDomain != FromDomain {
+		Record, err = dmarc.LookupWithOptions(OrgDomain, &dmarc.LookupOptions{LookupTXT: lookupTXT})
+	}
+	if err == dmarc.ErrNoPolicy {
+		return AuthNone
+	} else if dmarc.IsTempFail(err) {
+		return AuthTempError
+	} else if err != nil {
+		return AuthPermError
+	}
+
+	if Auth.DKIM == AuthPass {
+		for _, Domain := range Auth.DKIMDomains {
+			if isAligned(Domain, FromDomain, Record.DKIMAlignment) {
+				return AuthPass
+			}
+		}
+	}
+	if Auth.SPF == AuthPass && isAligned(Auth.SPFDomain, FromDomain, Record.SPFAlignment) {
+		return AuthPass
+	}
+	//DKIM or SPF could pass when DNS is available again
+	if Auth.DKIM == AuthTempError || Auth.SPF == AuthTempError {
+		return AuthTempError
+	}
+
+	return AuthFail
+}
+
+// isAligned - strict mode requires the same domain, relaxed (default) the same organizational domain
+func isAligned(Domain, FromDomain string, Mode dmarc.AlignmentMode) bool {
+	Domain = strings.ToLower(Domain)
+	if Domain == FromDomain {
+		return true
+	}
+	if Mode == dmarc.AlignmentStrict {
+		return false
+	}
+
+	return organizationalDomain(Domain) == organizationalDomain(FromDomain)
+}
+
+func organizationalDomain(Domain string) string {
+	OrgDomain, err := publicsuffix.EffectiveTLDPlusOne(Domain)
+	if err != nil {
+		return Domain
+	}
+
+	return OrgDomain
+}
+
+func domainOf(EmailAddress string) string {
+	pos1 := strings.LastIndex(EmailAddress, "@")
+	if pos1 < 0 {
+		return strings.ToLower(EmailAddress)
+	}
+
+	return strings.ToLower(EmailAddress[pos1+1:])
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"DownloadEmailsAttachments/downloader"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// staticResolver - in-memory DNS zone for tests
+type staticResolver struct {
+	TXT map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r staticResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if Records, ok := r.TXT[strings.TrimSuffix(name, ".")]; ok == true {
+		return Records, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r staticResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, notFound(name)
+}
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, notFound(host)
+}
+
+func (r staticResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, notFound(addr)
+}
+
+func TestAuthenticateSender(t *testing.T) {
+	Public, Private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AuthResolver = staticResolver{TXT: map[string][]string{
+		"mail._domainkey.supplier.ru": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(Public)},
+		"supplier.ru":                 {"v=spf1 ip4:192.0.2.10 -all"},
+		"_dmarc.supplier.ru":          {"v=DMARC1; p=reject"},
+	}}
+	defer func() { AuthResolver = net.DefaultResolver }()
+	myEnv = map[string]string{}
+
+	Message := "From: Supplier <price@supplier.ru>\r\n" +
+		"To: buh@example.com\r\n" +
+		"Subject: Price\r\n" +
+		"\r\n" +
+		"Price list attached\r\n"
+
+	var Signed bytes.Buffer
+	err = dkim.Sign(&Signed, strings.NewReader(Message), &dkim.SignOptions{Domain: "supplier.ru", Selector: "mail", Signer: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Received := "Received: from mx.supplier.ru (mx.supplier.ru [192.0.2.10]) by mx.example.com; Mon, 1 Mar 2021 10:00:00 +0300\r\n"
+	Spoofed := "Received: from evil.example (evil.example [203.0.113.5]) by mx.example.com; Mon, 1 Mar 2021 10:00:00 +0300\r\n"
+
+	var testData = []struct {
+		Name  string
+		Raw   string
+		DKIM  string
+		SPF   string
+		DMARC string
+	}{
+		{"signed", "Return-Path: <bounce@supplier.ru>\r\n" + Received + Signed.String(), AuthPass, AuthPass, AuthPass},
+		{"dkim only", "Return-Path: <bounce@mailer.example>\r\n" + Spoofed + Signed.String(), AuthPass, AuthNone, AuthPass},
+		{"spf only", "Return-Path: <bounce@supplier.ru>\r\n" + Received + Message, AuthNone, AuthPass, AuthPass},
+		{"changed", "Return-Path: <bounce@supplier.ru>\r\n" + Spoofed + strings.Replace(Signed.String(), "Price list", "Fake list", 1), AuthFail, AuthFail, AuthFail},
+		{"spoofed", "Return-Path: <x@evil.example>\r\n" + Spoofed + Message, AuthNone, AuthNone, AuthFail},
+	}
+
+	for _, Test := range testData {
+		Auth, err := AuthenticateSender([]byte(Test.Raw), "price@supplier.ru")
+		if err != nil {
+			t.Fatalf("[%s] %v", Test.Name, err)
+		}
+		if Auth.DKIM != Test.DKIM || Auth.SPF != Test.SPF || Auth.DMARC != Test.DMARC {
+			t.Errorf("[%s] Expected: dkim=%s spf=%s dmarc=%s, Got: %s", Test.Name, Test.DKIM, Test.SPF, Test.DMARC, Auth)
+		}
+	}
+
+	myEnv["RequireAuthFrom"] = "@supplier.ru"
+	if err = CheckSenderAuth([]byte("Return-Path: <bounce@supplier.ru>\r\n"+Received+Signed.String()), "price@supplier.ru"); err != nil {
+		t.Errorf("Signed message is rejected: %v", err)
+	}
+	if err = CheckSenderAuth([]byte(Spoofed+Message), "price@supplier.ru"); err == nil {
+		t.Errorf("Spoofed message is accepted")
+	}
+	if err = CheckSenderAuth([]byte(Spoofed+Message), "other@sender.ru"); err != nil {
+		t.Errorf("Message from sender without policy is rejected: %v", err)
+	}
+}
+
+func TestSenderAuthFromHeader(t *testing.T) {
+	Raw := "Authentication-Results: mx.example.com; dkim=pass header.d=supplier.ru; spf=fail smtp.mailfrom=x@evil.example; dmarc=pass header.from=supplier.ru\r\n" +
+		"Authentication-Results: fake.example; dkim=fail; spf=fail; dmarc=fail\r\n" +
+		"From: price@supplier.ru\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	Auth, err := SenderAuthFromHeader([]byte(Raw), "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Auth.DKIM != AuthPass || Auth.SPF != AuthFail || Auth.DMARC != AuthPass {
+		t.Errorf("Wrong results: %s", Auth)
+	}
+
+	myEnv = map[string]string{"RequireAuthFrom": "*", "RequireAuth": "dkim,dmarc", "AuthTrustedAuthservID": "mx.example.com"}
+	if err = CheckSenderAuth([]byte(Raw), "price@supplier.ru"); err != nil {
+		t.Errorf("Message is rejected: %v", err)
+	}
+
+	myEnv["AuthTrustedAuthservID"] = "other.example.com"
+	if err = CheckSenderAuth([]byte(Raw), "price@supplier.ru"); err == nil {
+		t.Errorf("Message without trusted header is accepted")
+	}
+}
+
+// timeoutResolver - DNS server which does not answer
+type timeoutResolver struct {
+	staticResolver
+}
+
+func (r timeoutResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true, IsTemporary: true}
+}
+
+func TestCheckSenderAuthTemporary(t *testing.T) {
+	AuthResolver = timeoutResolver{}
+	defer func() { AuthResolver = net.DefaultResolver }()
+
+	Raw := "Return-Path: <bounce@supplier.ru>\r\n" +
+		"Received: from mx.supplier.ru (mx.supplier.ru [192.0.2.10]) by mx.example.com; Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed; d=supplier.ru; s=mail; h=From; bh=YWJj; b=YWJj\r\n" +
+		"From: Supplier <price@supplier.ru>\r\n" +
+		"Subject: Price\r\n" +
+		"\r\n" +
+		"Price list attached\r\n"
+
+	var testData = []struct {
+		RequireAuth string
+		Temporary   bool
+	}{
+		{"", true},
+		{"dkim", true},
+		{"spf", true},
+		{"dkim,spf,dmarc", true},
+	}
+
+	for i, Test := range testData {
+		myEnv = map[string]string{"RequireAuthFrom": "@supplier.ru", "RequireAuth": Test.RequireAuth}
+		err := CheckSenderAuth([]byte(Raw), "price@supplier.ru")
+		if err == nil || errors.Is(err, ErrAuthTemporary) != Test.Temporary {
+			t.Errorf("[Test Case %v] Wrong error: %v", i+1, err)
+		}
+	}
+
+	//failed check is final even if other check got temperror
+	myEnv = map[string]string{"RequireAuthFrom": "@supplier.ru", "AuthTrustedAuthservID": "mx.example.com", "RequireAuth": "dkim,spf"}
+	Header := "Authentication-Results: mx.example.com; dkim=temperror header.d=supplier.ru; spf=fail smtp.mailfrom=x@evil.example\r\n"
+	err := CheckSenderAuth([]byte(Header+Raw), "price@supplier.ru")
+	if err == nil || errors.Is(err, ErrAuthTemporary) == true {
+		t.Errorf("Failed check is temporary: %v", err)
+	}
+}
+
+func TestProcessMessageAuthTemporary(t *testing.T) {
+	AuthResolver = timeoutResolver{}
+	defer func() { AuthResolver = net.DefaultResolver }()
+	myEnv = map[string]string{"EMAIL": "buh@example.com", "RequireAuthFrom": "@supplier.ru",
+		"DeadLetterFile": filepath.Join(t.TempDir(), "DeadLetters.json")}
+	err := LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Options, err := NewProcessOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Raw := "From: Supplier <price@supplier.ru>\r\n" +
+		"Subject: Price\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	err = ProcessMessage(&downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 1, UID: 111, Raw: []byte(Raw)}, Options)
+	var MsgError *MessageError
+	if errors.As(err, &MsgError) == false || MsgError.Stage != StageAuth {
+		t.Errorf("Temporary error is not returned: %v", err)
+	}
+	if List := DeadLetters.List(); len(List) != 1 || List[0].UID != 111 || List[0].Stage != StageAuth {
+		t.Errorf("Message is not in dead-letter list: %+v", List)
+	}
+}
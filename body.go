@@ -0,0 +1,130 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"DownloadEmailsAttachments/parsemail"
+)
+
+// SaveBodyFiles saves message body as .txt and/or .html, depends on SaveBody setting: txt,html
+// cid: images in html are inlined as data URIs if SaveBodyInlineImages=true, otherwise saved as files near .html.
+// Errors of all files are returned
+func SaveBodyFiles(EmailFrom, sMessageId string, email parsemail.Email, ModTime time.Time) error {
+	var Errors []error
+	Formats := strings.Split(myEnv["SaveBody"], ",")
+
+	Filename := SafeFilename(email.Subject)
+	if Filename == "" {
+		Filename = "message"
+	}
+	FilenameBase := EmailFrom + "_" + Filename + "_" + sMessageId
+
+	if contains(Formats, "txt") && email.TextBody != "" {
+		Errors = append(Errors, saveMessageFile(FilenameBase+".txt", []byte(email.TextBody), ModTime))
+	}
+
+	if contains(Formats, "html") && email.HTMLBody != "" {
+		HTMLBody, err := ResolveEmbeddedFiles(email.HTMLBody, email.EmbeddedFiles, FilenameBase, myEnv["SaveBodyInlineImages"] == "true", ModTime)
+		Errors = append(Errors, err)
+		Errors = append(Errors, saveMessageFile(FilenameBase+".html", []byte(HTMLBody), ModTime))
+	}
+
+	return errors.Join(Errors...)
+}
+
+// ResolveEmbeddedFiles replaces cid: links in html to data URIs or to files saved near html file.
+// Links to files which are not saved are not changed, errors of these files are returned
+func ResolveEmbeddedFiles(HTMLBody string, EmbeddedFiles []parsemail.EmbeddedFile, FilenameBase string, Inline bool, ModTime time.Time) (string, error) {
+	var Errors []error
+	for f, ef := range EmbeddedFiles {
+		if ef.CID == "" {
+			continue
+		}
+
+		massBytes, err := ioutil.ReadAll(ef.Data)
+		if err != nil {
+			slog.Warn("Can not read embedded file", "cid", ef.CID, "error", err)
+			continue
+		}
+
+		ContentType, Params, err := mime.ParseMediaType(ef.ContentType)
+		if err != nil {
+			ContentType = "application/octet-stream"
+		}
+
+		Link := ""
+		if Inline == true {
+			Link = "data:" + ContentType + ";base64," + b64.StdEncoding.EncodeToString(massBytes)
+		} else {
+			Filename := FilenameBase + "_" + embeddedFilename(f, ef.CID, ContentType, Params["name"])
+			Filename, err = SaveFileWithTime(Filename, massBytes, ModTime)
+			if err != nil && err != ErrDuplicateFile {
+				Errors = append(Errors, fmt.Errorf("can not save %s: %w", Filename, err))
+				continue
+			}
+			Link = fileLink(Filename)
+		}
+
+		HTMLBody = strings.ReplaceAll(HTMLBody, "cid:"+ef.CID, Link)
+	}
+
+	return HTMLBody, errors.Join(Errors...)
+}
+
+// embeddedFilename returns file name from content type name parameter or from content id
+func embeddedFilename(Number int, CID, ContentType, Name string) string {
+	Name = SafeFilename(Name)
+	if Name != "" {
+		return Name
+	}
+
+	Name = SafeFilename(CID)
+	if pos1 := strings.Index(Name, "@"); pos1 >= 0 {
+		Name = Name[:pos1]
+	}
+	if Name == "" {
+		Name = "image" + strconv.Itoa(Number+1)
+	}
+
+	if filepath.Ext(Name) == "" {
+		Name = Name + extensionByType(ContentType)
+	}
+
+	return Name
+}
+
+// extensionByType returns extension for content type, extension same as subtype is preferred:
+// image/jpeg -> .jpeg, not .jfif from system mime.types
+func extensionByType(ContentType string) string {
+	Extensions, _ := mime.ExtensionsByType(ContentType)
+	if len(Extensions) == 0 {
+		return ""
+	}
+
+	pos1 := strings.Index(ContentType, "/")
+	for _, Extension := range Extensions {
+		if pos1 >= 0 && Extension == "."+ContentType[pos1+1:] {
+			return Extension
+		}
+	}
+
+	return Extensions[0]
+}
+
+// fileLink returns relative URL of saved file, parentheses and quotes are escaped too,
+// so link can be used in css url() and in attributes
+func fileLink(Filename string) string {
+	Link := url.PathEscape(filepath.ToSlash(Filename))
+	Replacer := strings.NewReplacer("%2F", "/", "(", "%28", ")", "%29", "'", "%27")
+	return Replacer.Replace(Link)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"DownloadEmailsAttachments/parsemail"
+)
+
+func TestEmbeddedFilename(t *testing.T) {
+	var testData = []struct {
+		CID         string
+		ContentType string
+		Name        string
+		Result      string
+	}{
+		{"logo@mail", "image/png", "logo.png", "logo.png"},
+		{"logo@mail", "image/png", "", "logo.png"},
+		{"photo@mail", "image/jpeg", "", "photo.jpeg"},
+		{"image.gif@mail", "image/png", "", "image.gif"},
+		{"@mail", "image/gif", "", "image3.gif"},
+		{"data", "application/x-unknown", "", "data"},
+		{"a:b@mail", "image/png", "", "a_b.png"},
+	}
+
+	for i, Test := range testData {
+		if Result := embeddedFilename(2, Test.CID, Test.ContentType, Test.Name); Result != Test.Result {
+			t.Errorf("[Test Case %v] Wrong file name. Expected: %q, Got: %q", i+1, Test.Result, Result)
+		}
+	}
+}
+
+func TestFileLink(t *testing.T) {
+	var testData = []struct {
+		Filename string
+		Link     string
+	}{
+		{"logo.png", "logo.png"},
+		{"From(Supplier (price@supplier.ru))_Price_109_logo.png", "From%28Supplier%20%28price@supplier.ru%29%29_Price_109_logo.png"},
+		{"it's #1 50%.png", "it%27s%20%231%2050%25.png"},
+		{"Прайс.png", "%D0%9F%D1%80%D0%B0%D0%B9%D1%81.png"},
+	}
+
+	for i, Test := range testData {
+		if Link := fileLink(Test.Filename); Link != Test.Link {
+			t.Errorf("[Test Case %v] Wrong link. Expected: %q, Got: %q", i+1, Test.Link, Link)
+		}
+	}
+}
+
+func TestSaveBodyFiles(t *testing.T) {
+	Root := t.TempDir()
+	defer func(s OutputSink) { Sink = s }(Sink)
+	var err error
+	Sink, err = NewLocalSink(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	NewEmail := func() parsemail.Email {
+		return parsemail.Email{
+			Subject:  "Price",
+			TextBody: "Hello",
+			HTMLBody: `<p>Hello</p><img src="cid:logo@mail"><div style="background:url(cid:logo@mail)"></div>`,
+			EmbeddedFiles: []parsemail.EmbeddedFile{
+				{CID: "logo@mail", ContentType: "image/png; name=\"logo (1).png\"", Data: strings.NewReader("png")},
+			},
+		}
+	}
+	ModTime := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	FilenameBase := "From(Supplier (price@supplier.ru))_Price_109"
+
+	myEnv = map[string]string{"SaveBody": "txt,html"}
+	if err = SaveBodyFiles("From(Supplier (price@supplier.ru))", "109", NewEmail(), ModTime); err != nil {
+		t.Fatal(err)
+	}
+	Data, err := ioutil.ReadFile(filepath.Join(Root, FilenameBase+".txt"))
+	if err != nil || string(Data) != "Hello" {
+		t.Errorf("Wrong .txt: %q %v", Data, err)
+	}
+	Data, err = ioutil.ReadFile(filepath.Join(Root, FilenameBase+".html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Link := "From%28Supplier%20%28price@supplier.ru%29%29_Price_109_logo%20%281%29.png"
+	if strings.Count(string(Data), Link) != 2 || strings.Contains(string(Data), "cid:") {
+		t.Errorf("Wrong links in .html: %s", Data)
+	}
+	Data, err = ioutil.ReadFile(filepath.Join(Root, FilenameBase+"_logo (1).png"))
+	if err != nil || string(Data) != "png" {
+		t.Errorf("Wrong embedded file: %q %v", Data, err)
+	}
+
+	myEnv = map[string]string{"SaveBody": "html", "SaveBodyInlineImages": "true"}
+	if err = SaveBodyFiles("From(Supplier (price@supplier.ru))", "110", NewEmail(), ModTime); err != nil {
+		t.Fatal(err)
+	}
+	Data, err = ioutil.ReadFile(filepath.Join(Root, "From(Supplier (price@supplier.ru))_Price_110.html"))
+	if err != nil || strings.Count(string(Data), "data:image/png;base64,cG5n") != 2 {
+		t.Errorf("Images are not inlined: %s %v", Data, err)
+	}
+	if Files, _ := filepath.Glob(filepath.Join(Root, "*_110*")); len(Files) != 1 {
+		t.Errorf("Wrong files with inlined images: %v", Files)
+	}
+
+	//files saved before retry
+	myEnv = map[string]string{"SaveBody": "txt,html", "DuplicateFiles": DuplicateSkip}
+	if err = SaveBodyFiles("From(Supplier (price@supplier.ru))", "109", NewEmail(), ModTime); err != nil {
+		t.Errorf("Error for existing files: %v", err)
+	}
+	Data, _ = ioutil.ReadFile(filepath.Join(Root, FilenameBase+".html"))
+	if strings.Count(string(Data), Link) != 2 {
+		t.Errorf("Links to existing image are not resolved: %s", Data)
+	}
+}
+
+func TestSaveBodyFilesFailed(t *testing.T) {
+	defer func(s OutputSink) { Sink = s }(Sink)
+	Sink = failingSink{}
+	myEnv = map[string]string{"SaveBody": "txt,html"}
+	email := parsemail.Email{
+		Subject:  "Price",
+		TextBody: "Hello",
+		HTMLBody: `<img src="cid:logo@mail">`,
+		EmbeddedFiles: []parsemail.EmbeddedFile{
+			{CID: "logo@mail", ContentType: "image/png", Data: strings.NewReader("png")},
+		},
+	}
+
+	err := SaveBodyFiles("price@supplier.ru", "109", email, time.Time{})
+	if err == nil {
+		t.Fatal("Error of sink is not returned")
+	}
+	for _, Filename := range []string{"price@supplier.ru_Price_109.txt", "price@supplier.ru_Price_109.html", "price@supplier.ru_Price_109_logo.png"} {
+		if strings.Contains(err.Error(), Filename) == false {
+			t.Errorf("Error of %s is not returned: %v", Filename, err)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Catalog - database of processed messages and saved files, opened if CatalogFile is set
+var Catalog *sql.DB
+
+// message statuses
+const (
+	MessageStatusProcessed        = "processed"
+	MessageStatusSkipped          = "skipped"
+	MessageStatusParseError       = "parse_error"
+	MessageStatusHookFailed       = "hook_failed"
+	MessageStatusSignatureInvalid = "signature_invalid"
+	MessageStatusAuthFailed       = "auth_failed"
+	MessageStatusFailed           = "failed"
+)
+
+// file statuses
+const (
+	FileStatusSaved       = "saved"
+	FileStatusError       = "error"
+	FileStatusHookFailed  = "hook_failed"
+	FileStatusDuplicate   = "duplicate"
+	FileStatusQuarantined = "quarantined"
+	FileStatusInvalid     = "invalid"
+	FileStatusInfected    = "infected"
+)
+
+const catalogSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id           INTEGER PRIMARY KEY,
+	account      TEXT NOT NULL,
+	folder       TEXT NOT NULL,
+	uid          INTEGER NOT NULL,
+	seq_num      INTEGER NOT NULL,
+	message_id   TEXT NOT NULL,
+	sender       TEXT NOT NULL,
+	subject      TEXT NOT NULL,
+	date         TEXT NOT NULL,
+	status       TEXT NOT NULL,
+	error        TEXT NOT NULL,
+	processed_at TEXT NOT NULL,
+	UNIQUE (account, folder, uid)
+);
+CREATE TABLE IF NOT EXISTS files (
+	id                INTEGER PRIMARY KEY,
+	account           TEXT NOT NULL,
+	folder            TEXT NOT NULL,
+	uid               INTEGER NOT NULL,
+	message_id        TEXT NOT NULL,
+	sender            TEXT NOT NULL,
+	date              TEXT NOT NULL,
+	original_filename TEXT NOT NULL,
+	path              TEXT NOT NULL,
+	extension         TEXT NOT NULL,
+	size              INTEGER NOT NULL,
+	sha256            TEXT NOT NULL,
+	status            TEXT NOT NULL,
+	error             TEXT NOT NULL,
+	saved_at          TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_sender ON files (sender);
+CREATE INDEX IF NOT EXISTS files_date ON files (date);
+`
+
+// OpenCatalog opens catalog database from CatalogFile setting, catalog is off if setting is empty
+func OpenCatalog() error {
+	Filename := myEnv["CatalogFile"]
+	if Filename == "" {
+		return nil
+	}
+
+	db, err := sql.Open("sqlite", Filename)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(catalogSchema)
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	Catalog = db
+	return nil
+}
+
+// CatalogAddMessage saves message status, message processed again replaces old record
+func CatalogAddMessage(Metadata FileMetadata, SeqNum uint32, Status string, MessageError error) {
+	if Catalog == nil {
+		return
+	}
+
+	sError := ""
+	if MessageError != nil {
+		sError = MessageError.Error()
+	}
+
+	_, err := Catalog.Exec(`INSERT OR REPLACE INTO messages
+		(account, folder, uid, seq_num, message_id, sender, subject, date, status, error, processed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		Metadata.Account, Metadata.Folder, Metadata.UID, SeqNum, Metadata.MessageID, Metadata.From, Metadata.Subject,
+		formatCatalogTime(Metadata.Date), Status, sError, formatCatalogTime(time.Now()))
+	if err != nil {
+		MessageLogger(Metadata).Error("Can not write catalog", "error", err)
+	}
+}
+
+// CatalogAddFile saves information about saved file
+func CatalogAddFile(Metadata FileMetadata, Path string, Status string, FileError error) {
+	if Catalog == nil {
+		return
+	}
+
+	sError := ""
+	if FileError != nil {
+		sError = FileError.Error()
+	}
+
+	_, err := Catalog.Exec(`INSERT INTO files
+		(account, folder, uid, message_id, sender, date, original_filename, path, extension, size, sha256, status, error, saved_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		Metadata.Account, Metadata.Folder, Metadata.UID, Metadata.MessageID, Metadata.From, formatCatalogTime(Metadata.Date),
+		Metadata.OriginalFilename, Path, catalogExtension(Metadata, Path), Metadata.Size, Metadata.SHA256,
+		Status, sError, formatCatalogTime(Metadata.DownloadedAt))
+	if err != nil {
+		MessageLogger(Metadata).Error("Can not write catalog", "error", err)
+	}
+}
+
+// catalogExtension returns extension of attachment, Path is empty for rejected files and has other extension after conversion
+func catalogExtension(Metadata FileMetadata, Path string) string {
+	if Metadata.OriginalFilename != "" {
+		return strings.ToLower(filepath.Ext(Metadata.OriginalFilename))
+	}
+
+	return strings.ToLower(filepath.Ext(Path))
+}
+
+// CatalogSetMessageStatus changes status of message which is already in catalog
+func CatalogSetMessageStatus(Metadata FileMetadata, Status string, MessageError error) {
+	if Catalog == nil {
+		return
+	}
+
+	sError := ""
+	if MessageError != nil {
+		sError = MessageError.Error()
+	}
+
+	_, err := Catalog.Exec(`UPDATE messages SET status = ?, error = ?, processed_at = ? WHERE account = ? AND folder = ? AND uid = ?`,
+		Status, sError, formatCatalogTime(time.Now()), Metadata.Account, Metadata.Folder, Metadata.UID)
+	if err != nil {
+		MessageLogger(Metadata).Error("Can not write catalog", "error", err)
+	}
+}
+
+// CatalogSetFileStatus changes status of file saved to Path
+func CatalogSetFileStatus(Metadata FileMetadata, Path string, Status string, FileError error) {
+	if Catalog == nil {
+		return
+	}
+
+	sError := ""
+	if FileError != nil {
+		sError = FileError.Error()
+	}
+
+	_, err := Catalog.Exec(`UPDATE files SET status = ?, error = ? WHERE account = ? AND folder = ? AND uid = ? AND path = ?`,
+		Status, sError, Metadata.Account, Metadata.Folder, Metadata.UID, Path)
+	if err != nil {
+		MessageLogger(Metadata).Error("Can not write catalog", "error", err)
+	}
+}
+
+// formatCatalogTime - UTC time in sortable text format
+func formatCatalogTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+// CatalogFileRow - one row of catalog query result
+type CatalogFileRow struct {
+	Date             string `json:"date"`
+	Sender           string `json:"sender"`
+	MessageID        string `json:"message_id"`
+	UID              uint32 `json:"uid"`
+	OriginalFilename string `json:"original_filename"`
+	Path             string `json:"path"`
+	Size             int64  `json:"size"`
+	SHA256           string `json:"sha256"`
+	Status           string `json:"status"`
+	Error            string `json:"error"`
+	SavedAt          string `json:"saved_at"`
+}
+
+// RunCatalogCommand - command line: catalog query -sender supplier@mail.ru -from 2021-01-01 -ext .xlsx -status saved -format csv
+func RunCatalogCommand(Args []string) error {
+	if len(Args) == 0 || Args[0] != "query" {
+		return fmt.Errorf("usage: catalog query [-sender s] [-from yyyy-mm-dd] [-to yyyy-mm-dd] [-ext .xlsx] [-status saved] [-format table|csv|json]")
+	}
+
+	fs := flag.NewFlagSet("catalog query", flag.ContinueOnError)
+	Sender := fs.String("sender", "", "sender email address, part of address is allowed")
+	DateFrom := fs.String("from", "", "message date from, yyyy-mm-dd")
+	DateTo := fs.String("to", "", "message date to including, yyyy-mm-dd")
+	Extension := fs.String("ext", "", "file extension, for example .xlsx")
+	Status := fs.String("status", "", "file status: saved, error, hook_failed, duplicate, quarantined, invalid or infected")
+	Format := fs.String("format", "table", "output format: table, csv or json")
+	err := fs.Parse(Args[1:])
+	if err != nil {
+		return err
+	}
+
+	err = OpenCatalog()
+	if err != nil {
+		return err
+	}
+	if Catalog == nil {
+		return fmt.Errorf("CatalogFile is not set in %s", Filename_Settings)
+	}
+	defer Catalog.Close()
+
+	Rows, err := QueryCatalog(*Sender, *DateFrom, *DateTo, *Extension, *Status)
+	if err != nil {
+		return err
+	}
+
+	return WriteCatalogRows(os.Stdout, Rows, *Format)
+}
+
+// QueryCatalog returns saved files filtered by parameters, empty parameter is not used
+func QueryCatalog(Sender, DateFrom, DateTo, Extension, Status string) ([]CatalogFileRow, error) {
+	var Otvet []CatalogFileRow
+
+	Text := `SELECT date, sender, message_id, uid, original_filename, path, size, sha256, status, error, saved_at FROM files WHERE 1=1`
+	var Params []interface{}
+	if Sender != "" {
+		Text += " AND sender LIKE ?"
+		Params = append(Params, "%"+Sender+"%")
+	}
+	if DateFrom != "" {
+		t, err := time.Parse("2006-01-02", DateFrom)
+		if err != nil {
+			return Otvet, fmt.Errorf("wrong date: %s", DateFrom)
+		}
+		Text += " AND date >= ?"
+		Params = append(Params, t.Format("2006-01-02"))
+	}
+	if DateTo != "" {
+		//date is stored as text with time, so compare with next day
+		t, err := time.Parse("2006-01-02", DateTo)
+		if err != nil {
+			return Otvet, fmt.Errorf("wrong date: %s", DateTo)
+		}
+		Text += " AND date < ?"
+		Params = append(Params, t.AddDate(0, 0, 1).Format("2006-01-02"))
+	}
+	if Extension != "" {
+		if strings.HasPrefix(Extension, ".") == false {
+			Extension = "." + Extension
+		}
+		Text += " AND extension = ?"
+		Params = append(Params, strings.ToLower(Extension))
+	}
+	if Status != "" {
+		Text += " AND status = ?"
+		Params = append(Params, Status)
+	}
+	Text += " ORDER BY date, id"
+
+	rows, err := Catalog.Query(Text, Params...)
+	if err != nil {
+		return Otvet, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		Row := CatalogFileRow{}
+		err = rows.Scan(&Row.Date, &Row.Sender, &Row.MessageID, &Row.UID, &Row.OriginalFilename, &Row.Path, &Row.Size,
+			&Row.SHA256, &Row.Status, &Row.Error, &Row.SavedAt)
+		if err != nil {
+			return Otvet, err
+		}
+		Otvet = append(Otvet, Row)
+	}
+
+	return Otvet, rows.Err()
+}
+
+// WriteCatalogRows writes rows as table, csv or json
+func WriteCatalogRows(w io.Writer, Rows []CatalogFileRow, Format string) error {
+	switch Format {
+	case "json":
+		if Rows == nil {
+			Rows = []CatalogFileRow{}
+		}
+		Encoder := json.NewEncoder(w)
+		Encoder.SetIndent("", "  ")
+		return Encoder.Encode(Rows)
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"date", "sender", "message_id", "uid", "original_filename", "path", "size", "sha256", "status", "error", "saved_at"})
+		for _, Row := range Rows {
+			_ = cw.Write([]string{Row.Date, Row.Sender, Row.MessageID, strconv.FormatUint(uint64(Row.UID), 10), Row.OriginalFilename,
+				Row.Path, strconv.FormatInt(Row.Size, 10), Row.SHA256, Row.Status, Row.Error, Row.SavedAt})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DATE\tSENDER\tFILE\tSIZE\tSTATUS\tPATH")
+		for _, Row := range Rows {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", Row.Date, Row.Sender, Row.OriginalFilename, Row.Size, Row.Status, Row.Path)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown format: %s", Format)
+	}
+}
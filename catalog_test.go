@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+)
+
+// openTestCatalog opens catalog in temporary directory, it is closed after test
+func openTestCatalog(t *testing.T) {
+	myEnv = map[string]string{"CatalogFile": filepath.Join(t.TempDir(), "catalog.db")}
+	err := OpenCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Catalog.Close()
+		Catalog = nil
+	})
+}
+
+func TestQueryCatalog(t *testing.T) {
+	openTestCatalog(t)
+
+	Date := time.Date(2021, 3, 1, 22, 0, 0, 0, time.UTC)
+	Files := []FileMetadata{
+		{From: "price@supplier.ru", Date: Date, UID: 1, OriginalFilename: "price.xlsx", Size: 10},
+		{From: "buh@bank.ru", Date: Date.AddDate(0, 0, 1), UID: 2, OriginalFilename: "statement.PDF", Size: 20},
+		{From: "price@supplier.ru", Date: Date.AddDate(0, 1, 0), UID: 3, OriginalFilename: "price.xlsx", Size: 30},
+		{From: "price@supplier.ru", Date: Date.AddDate(0, 1, 0), UID: 4, OriginalFilename: "broken.xlsx", Size: 40},
+		{From: "price@supplier.ru", Date: Date.AddDate(0, 1, 0), UID: 5, OriginalFilename: "price.xls", Size: 50},
+	}
+	CatalogAddFile(Files[0], "Files/price.xlsx", FileStatusSaved, nil)
+	CatalogAddFile(Files[1], "Files/statement.PDF", FileStatusSaved, nil)
+	CatalogAddFile(Files[2], "Files/price.xlsx", FileStatusDuplicate, ErrDuplicateFile)
+	CatalogAddFile(Files[3], "", FileStatusInvalid, errors.New("zip: not a valid zip file"))
+	CatalogAddFile(Files[4], "Files/price.csv", FileStatusSaved, nil)
+
+	var testData = []struct {
+		Sender, DateFrom, DateTo, Extension, Status string
+		UIDs                                        []uint32
+	}{
+		{"", "", "", "", "", []uint32{1, 2, 3, 4, 5}},
+		{"supplier", "", "", "", "", []uint32{1, 3, 4, 5}},
+		{"", "2021-03-02", "", "", "", []uint32{2, 3, 4, 5}},
+		{"", "", "2021-03-01", "", "", []uint32{1}},
+		{"", "2021-03-01", "2021-03-02", "", "", []uint32{1, 2}},
+		{"", "", "", "pdf", "", []uint32{2}},
+		{"", "", "", ".xlsx", FileStatusDuplicate, []uint32{3}},
+		{"", "2022-01-01", "", "", "", nil},
+		{"", "", "", ".xlsx", FileStatusInvalid, []uint32{4}},
+		{"", "", "", "xls", "", []uint32{5}},
+	}
+
+	for i, Test := range testData {
+		Rows, err := QueryCatalog(Test.Sender, Test.DateFrom, Test.DateTo, Test.Extension, Test.Status)
+		if err != nil {
+			t.Errorf("[Test Case %v] Error: %v", i+1, err)
+			continue
+		}
+		var UIDs []uint32
+		for _, Row := range Rows {
+			UIDs = append(UIDs, Row.UID)
+		}
+		if fmt.Sprint(UIDs) != fmt.Sprint(Test.UIDs) {
+			t.Errorf("[Test Case %v] Wrong rows. Expected: %v, Got: %v", i+1, Test.UIDs, UIDs)
+		}
+	}
+
+	for _, Date := range []string{"01.03.2021", "2021-3-1", "2021-03-01' OR 1=1 --"} {
+		if _, err := QueryCatalog("", Date, "", "", ""); err == nil {
+			t.Errorf("Wrong -from date is accepted: %q", Date)
+		}
+		if _, err := QueryCatalog("", "", Date, "", ""); err == nil {
+			t.Errorf("Wrong -to date is accepted: %q", Date)
+		}
+	}
+}
+
+func TestWriteCatalogRows(t *testing.T) {
+	Rows := []CatalogFileRow{{Date: "2021-03-01T07:00:00Z", Sender: "price@supplier.ru", UID: 1, OriginalFilename: "price, march.xlsx",
+		Path: "Files/price.xlsx", Size: 10, Status: FileStatusSaved}}
+
+	var testData = []struct {
+		Format string
+		Rows   []CatalogFileRow
+		Result string
+	}{
+		{"json", nil, "[]\n"},
+		{"csv", Rows, "date,sender,message_id,uid,original_filename,path,size,sha256,status,error,saved_at\n" +
+			"2021-03-01T07:00:00Z,price@supplier.ru,,1,\"price, march.xlsx\",Files/price.xlsx,10,,saved,,\n"},
+		{"table", Rows, "DATE                  SENDER             FILE               SIZE  STATUS  PATH\n" +
+			"2021-03-01T07:00:00Z  price@supplier.ru  price, march.xlsx  10    saved   Files/price.xlsx\n"},
+	}
+
+	for i, Test := range testData {
+		var b bytes.Buffer
+		err := WriteCatalogRows(&b, Test.Rows, Test.Format)
+		if err != nil || b.String() != Test.Result {
+			t.Errorf("[Test Case %v] Wrong output. Expected: %q, Got: %q %v", i+1, Test.Result, b.String(), err)
+		}
+	}
+
+	if err := WriteCatalogRows(&bytes.Buffer{}, Rows, "xml"); err == nil {
+		t.Errorf("Unknown format is accepted")
+	}
+}
+
+func TestCatalogSkippedMessage(t *testing.T) {
+	openTestCatalog(t)
+	myEnv["EMAIL"] = "buh@example.com"
+	myEnv["DownloadFromDate"] = "2021-03-02 00:00:00"
+	myEnv["DeadLetterFile"] = filepath.Join(t.TempDir(), "DeadLetters.json")
+	err := LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Options, err := NewProcessOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Raw := "From: Supplier <price@supplier.ru>\r\n" +
+		"Subject: Price\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	err = ProcessMessage(&downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 1, UID: 109, Raw: []byte(Raw)}, Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ProcessMessage(&downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 2, UID: 110, Raw: []byte("broken")}, Options)
+
+	var testData = []struct {
+		UID    uint32
+		Status string
+	}{
+		{109, MessageStatusSkipped},
+		{110, MessageStatusParseError},
+	}
+
+	for i, Test := range testData {
+		var Status string
+		err = Catalog.QueryRow("SELECT status FROM messages WHERE uid = ?", Test.UID).Scan(&Status)
+		if err != nil || Status != Test.Status {
+			t.Errorf("[Test Case %v] Wrong message status. Expected: %s, Got: %s %v", i+1, Test.Status, Status, err)
+		}
+	}
+}
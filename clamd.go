@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClamdChunkSize - size of INSTREAM chunks, clamd StreamMaxLength limits only whole stream
+const ClamdChunkSize = 64 * 1024
+
+// ScanClamd sends file to clamd with INSTREAM command.
+// Address is tcp://host:3310, unix:///var/run/clamav/clamd.ctl or host:port.
+// Returns virus name if file is infected, empty string if file is clean
+func ScanClamd(Address string, Data []byte, Timeout time.Duration) (string, error) {
+	Network := "tcp"
+	if strings.HasPrefix(Address, "unix://") {
+		Network = "unix"
+		Address = strings.TrimPrefix(Address, "unix://")
+	}
+	Address = strings.TrimPrefix(Address, "tcp://")
+
+	Conn, err := net.DialTimeout(Network, Address, Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer Conn.Close()
+	_ = Conn.SetDeadline(time.Now().Add(Timeout))
+
+	//z prefix - command and reply are terminated with zero byte
+	_, err = Conn.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return "", err
+	}
+
+	Size := make([]byte, 4)
+	for len(Data) > 0 {
+		Chunk := Data
+		if len(Chunk) > ClamdChunkSize {
+			Chunk = Chunk[:ClamdChunkSize]
+		}
+		Data = Data[len(Chunk):]
+
+		binary.BigEndian.PutUint32(Size, uint32(len(Chunk)))
+		_, err = Conn.Write(Size)
+		if err == nil {
+			_, err = Conn.Write(Chunk)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	binary.BigEndian.PutUint32(Size, 0)
+	_, err = Conn.Write(Size)
+	if err != nil {
+		return "", err
+	}
+
+	Reply, err := bufio.NewReader(Conn).ReadString(0)
+	if err != nil && Reply == "" {
+		return "", err
+	}
+
+	return parseClamdReply(strings.TrimRight(Reply, "\x00\r\n"))
+}
+
+// parseClamdReply parses "stream: OK", "stream: Eicar-Signature FOUND", "INSTREAM size limit exceeded. ERROR"
+func parseClamdReply(Reply string) (string, error) {
+	Result := strings.TrimSpace(strings.TrimPrefix(Reply, "stream:"))
+
+	switch {
+	case Result == "OK":
+		return "", nil
+	case strings.HasSuffix(Result, " FOUND"):
+		return strings.TrimSuffix(Result, " FOUND"), nil
+	}
+
+	return "", errors.New("clamd error: " + Reply)
+}
+
+// CheckFileVirus scans file if ClamdAddress is set. Infected files are saved in quarantine.
+// If clamd is not available ClamdFailurePolicy is used: quarantine (default), save or skip.
+// Returns true if file should be saved as usual
+func CheckFileVirus(FilenameNew string, massBytes []byte, Metadata FileMetadata) bool {
+	if myEnv["ClamdAddress"] == "" {
+		return true
+	}
+
+	TimeoutSeconds := 60
+	if s := myEnv["ClamdTimeoutSeconds"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err == nil && n > 0 {
+			TimeoutSeconds = n
+		}
+	}
+
+	Virus, err := ScanClamd(myEnv["ClamdAddress"], massBytes, time.Second*time.Duration(TimeoutSeconds))
+	if err != nil {
+		MessageLogger(Metadata).Error("Can not scan file", "file", FilenameNew, "error", err)
+		switch myEnv["ClamdFailurePolicy"] {
+		case InvalidSave:
+			return true
+		case InvalidSkip:
+			CatalogAddFile(FillFileMetadata(Metadata, massBytes), "", FileStatusError, err)
+			MetricAttachmentsSkipped.WithLabelValues(SkipReasonSaveError).Inc()
+			ReportSkippedFile(Metadata.OriginalFilename, "scan error: "+err.Error())
+			return false
+		}
+
+		MetricAttachmentsSkipped.WithLabelValues(SkipReasonQuarantined).Inc()
+		QuarantineFile(FilenameNew, massBytes, Metadata, FileStatusQuarantined, "scan error: "+err.Error())
+		return false
+	}
+
+	if Virus == "" {
+		return true
+	}
+
+	Reason := "virus found: " + Virus
+	MessageLogger(Metadata).Warn("Virus found in file", "file", FilenameNew, "from", Metadata.From, "virus", Virus)
+	MetricAttachmentsSkipped.WithLabelValues(SkipReasonInfected).Inc()
+	Location := QuarantineFile(FilenameNew, massBytes, Metadata, FileStatusInfected, Reason)
+	PostWebhookEvent(WebhookEvent{Type: EventVirusFound, File: &FileHookData{Path: Location, FileMetadata: FillFileMetadata(Metadata, massBytes)}, Error: Reason})
+
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// startFakeClamd answers INSTREAM like clamd, files containing EICAR string are infected
+func startFakeClamd(t *testing.T, Network, Address string) net.Listener {
+	l, err := net.Listen(Network, Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			Conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(Conn net.Conn) {
+				defer Conn.Close()
+				r := bufio.NewReader(Conn)
+				Command, err := r.ReadString(0)
+				if err != nil || Command != "zINSTREAM\x00" {
+					_, _ = Conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var Data bytes.Buffer
+				Size := make([]byte, 4)
+				for {
+					if _, err = io.ReadFull(r, Size); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(Size)
+					if n == 0 {
+						break
+					}
+					if _, err = io.CopyN(&Data, r, int64(n)); err != nil {
+						return
+					}
+				}
+
+				if bytes.Contains(Data.Bytes(), []byte(eicar)) {
+					_, _ = Conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+				} else {
+					_, _ = Conn.Write([]byte("stream: OK\x00"))
+				}
+			}(Conn)
+		}
+	}()
+
+	return l
+}
+
+func TestScanClamd(t *testing.T) {
+	l := startFakeClamd(t, "tcp", "127.0.0.1:0")
+	defer l.Close()
+	Address := "tcp://" + l.Addr().String()
+
+	Clean := bytes.Repeat([]byte("report;"), ClamdChunkSize)
+	Virus, err := ScanClamd(Address, Clean, 5*time.Second)
+	if err != nil || Virus != "" {
+		t.Errorf("Clean file. Expected no virus, Got: %s %v", Virus, err)
+	}
+
+	Infected := append(append([]byte{}, Clean...), eicar...)
+	Virus, err = ScanClamd(Address, Infected, 5*time.Second)
+	if err != nil || Virus != "Eicar-Signature" {
+		t.Errorf("Infected file. Expected: Eicar-Signature, Got: %s %v", Virus, err)
+	}
+
+	Socket := filepath.Join(t.TempDir(), "clamd.sock")
+	lu := startFakeClamd(t, "unix", Socket)
+	defer lu.Close()
+	Virus, err = ScanClamd("unix://"+Socket, []byte(eicar), 5*time.Second)
+	if err != nil || Virus != "Eicar-Signature" {
+		t.Errorf("Unix socket. Expected: Eicar-Signature, Got: %s %v", Virus, err)
+	}
+}
+
+func TestCheckFileVirus(t *testing.T) {
+	l := startFakeClamd(t, "tcp", "127.0.0.1:0")
+	defer l.Close()
+
+	Directory := t.TempDir()
+	myEnv = map[string]string{"ClamdAddress": l.Addr().String(), "QuarantineDirectory": Directory}
+
+	if CheckFileVirus("clean.txt", []byte("clean"), FileMetadata{}) == false {
+		t.Errorf("Clean file is not released")
+	}
+	if CheckFileVirus("invoice.pdf", []byte(eicar), FileMetadata{}) == true {
+		t.Errorf("Infected file is released")
+	}
+	if _, err := os.Stat(filepath.Join(Directory, "invoice.pdf")); err != nil {
+		t.Errorf("Infected file is not in quarantine: %v", err)
+	}
+
+	//clamd is not available
+	myEnv["ClamdAddress"] = "tcp://127.0.0.1:1"
+	myEnv["ClamdFailurePolicy"] = InvalidSkip
+	if CheckFileVirus("clean.txt", []byte("clean"), FileMetadata{}) == true {
+		t.Errorf("Not scanned file is released")
+	}
+}
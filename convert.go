@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shakinm/xlsReader/xls"
+	"github.com/shakinm/xlsReader/xls/record"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// ConvertedFile - csv or json file made from excel sheet
+type ConvertedFile struct {
+	Filename string
+	Data     []byte
+}
+
+// ExcelSheet - values of one sheet, dates are already formatted as yyyy-mm-dd or yyyy-mm-dd hh:mm:ss
+type ExcelSheet struct {
+	Name string
+	Rows [][]string
+}
+
+// IsExcelFile returns true for files which can be converted
+func IsExcelFile(Filename string) bool {
+	ext := strings.ToLower(filepath.Ext(Filename))
+	return ext == ".xlsx" || ext == ".xlsm" || ext == ".xls"
+}
+
+// ConvertExcel converts selected sheets to csv or json depends on ConvertExcel setting.
+// One file is made for every sheet: report_Sheet1.csv
+func ConvertExcel(Filename string, Data []byte) ([]ConvertedFile, error) {
+	var Otvet []ConvertedFile
+
+	Format := myEnv["ConvertExcel"]
+	if Format != "csv" && Format != "json" {
+		return Otvet, fmt.Errorf("unknown ConvertExcel format: %s", Format)
+	}
+
+	Sheets, err := ReadExcel(Filename, Data)
+	if err != nil {
+		return Otvet, err
+	}
+
+	FilenameBase := strings.TrimSuffix(Filename, filepath.Ext(Filename))
+	for _, Sheet := range SelectSheets(Sheets, myEnv["ConvertExcelSheets"]) {
+		var Data1 []byte
+		if Format == "csv" {
+			Data1, err = SheetToCsv(Sheet)
+		} else {
+			Data1, err = SheetToJson(Sheet)
+		}
+		if err != nil {
+			return Otvet, err
+		}
+
+		Otvet = append(Otvet, ConvertedFile{Filename: FilenameBase + "_" + SafeFilename(Sheet.Name) + "." + Format, Data: Data1})
+	}
+
+	return Otvet, nil
+}
+
+// SelectSheets returns sheets from comma separated list of sheet names or numbers from 1, empty list - all sheets
+func SelectSheets(Sheets []ExcelSheet, List string) []ExcelSheet {
+	if strings.TrimSpace(List) == "" {
+		return Sheets
+	}
+
+	var Otvet []ExcelSheet
+	for i, Sheet := range Sheets {
+		for _, Item := range strings.Split(List, ",") {
+			Item = strings.TrimSpace(Item)
+			if Item == Sheet.Name || Item == strconv.Itoa(i+1) {
+				Otvet = append(Otvet, Sheet)
+				break
+			}
+		}
+	}
+
+	return Otvet
+}
+
+// SheetToCsv - delimiter from ConvertCsvDelimiter (default ","), encoding from ConvertCsvEncoding: utf-8 (default), utf-8-bom, windows-1251
+func SheetToCsv(Sheet ExcelSheet) ([]byte, error) {
+	var b bytes.Buffer
+	cw := csv.NewWriter(&b)
+	if Delimiter := []rune(myEnv["ConvertCsvDelimiter"]); len(Delimiter) == 1 {
+		cw.Comma = Delimiter[0]
+	}
+	err := cw.WriteAll(Sheet.Rows)
+	if err != nil {
+		return nil, err
+	}
+
+	switch myEnv["ConvertCsvEncoding"] {
+	case "utf-8-bom":
+		return append([]byte("\xEF\xBB\xBF"), b.Bytes()...), nil
+	case "windows-1251":
+		return charmap.Windows1251.NewEncoder().Bytes(b.Bytes())
+	}
+
+	return b.Bytes(), nil
+}
+
+// SheetToJson - array of objects, keys are taken from first row and keep order of columns.
+// Empty header is named columnN, repeated header gets suffix: Sum, Sum_2
+func SheetToJson(Sheet ExcelSheet) ([]byte, error) {
+	Otvet := make([]jsonObject, 0)
+	if len(Sheet.Rows) == 0 {
+		return json.Marshal(Otvet)
+	}
+
+	Header := jsonKeys(Sheet.Rows)
+	for _, Row := range Sheet.Rows[1:] {
+		var Object jsonObject
+		for i, Value := range Row {
+			Object = append(Object, jsonField{Key: Header[i], Value: Value})
+		}
+		Otvet = append(Otvet, Object)
+	}
+
+	return json.MarshalIndent(Otvet, "", "  ")
+}
+
+// jsonKeys returns unique keys for all columns of sheet
+func jsonKeys(Rows [][]string) []string {
+	Columns := 0
+	for _, Row := range Rows {
+		Columns = max(Columns, len(Row))
+	}
+
+	var Otvet []string
+	Used := make(map[string]bool)
+	for i := 0; i < Columns; i++ {
+		Key := ""
+		if i < len(Rows[0]) {
+			Key = Rows[0][i]
+		}
+		if Key == "" {
+			Key = "column" + strconv.Itoa(i+1)
+		}
+		Key1 := Key
+		for n := 2; Used[Key1]; n++ {
+			Key1 = Key + "_" + strconv.Itoa(n)
+		}
+		Used[Key1] = true
+		Otvet = append(Otvet, Key1)
+	}
+
+	return Otvet
+}
+
+// jsonObject - JSON object with fields in order of columns, map would sort them by name
+type jsonObject []jsonField
+
+type jsonField struct {
+	Key   string
+	Value string
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, Field := range o {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		Key, err := json.Marshal(Field.Key)
+		if err != nil {
+			return nil, err
+		}
+		Value, err := json.Marshal(Field.Value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(Key)
+		b.WriteString(":")
+		b.Write(Value)
+	}
+	b.WriteString("}")
+
+	return b.Bytes(), nil
+}
+
+// ReadExcel reads all sheets of xlsx or legacy xls file
+func ReadExcel(Filename string, Data []byte) (Sheets []ExcelSheet, err error) {
+	//xls reader panics on broken files
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("can not read excel file: %v", r)
+		}
+	}()
+
+	if strings.ToLower(filepath.Ext(Filename)) == ".xls" {
+		return readXls(Data)
+	}
+
+	return readXlsx(Data)
+}
+
+func readXlsx(Data []byte) ([]ExcelSheet, error) {
+	var Otvet []ExcelSheet
+
+	f, err := excelize.OpenReader(bytes.NewReader(Data))
+	if err != nil {
+		return Otvet, err
+	}
+	defer f.Close()
+
+	Date1904 := false
+	if Props, err := f.GetWorkbookProps(); err == nil && Props.Date1904 != nil {
+		Date1904 = *Props.Date1904
+	}
+
+	IsDateStyle := make(map[int]bool)
+	for _, SheetName := range f.GetSheetList() {
+		Rows, err := f.GetRows(SheetName, excelize.Options{RawCellValue: true})
+		if err != nil {
+			return Otvet, err
+		}
+
+		for r, Row := range Rows {
+			for c, Value := range Row {
+				Number, err := strconv.ParseFloat(Value, 64)
+				if err != nil {
+					continue
+				}
+
+				Cell, _ := excelize.CoordinatesToCellName(c+1, r+1)
+				StyleID, err := f.GetCellStyle(SheetName, Cell)
+				if err != nil {
+					continue
+				}
+
+				IsDate, ok := IsDateStyle[StyleID]
+				if ok == false {
+					Style, err := f.GetStyle(StyleID)
+					if err == nil {
+						CustomNumFmt := ""
+						if Style.CustomNumFmt != nil {
+							CustomNumFmt = *Style.CustomNumFmt
+						}
+						IsDate = IsDateFormat(Style.NumFmt, CustomNumFmt)
+					}
+					IsDateStyle[StyleID] = IsDate
+				}
+
+				if IsDate {
+					Row[c] = FormatExcelDate(Number, Date1904)
+				}
+			}
+		}
+
+		Otvet = append(Otvet, ExcelSheet{Name: SheetName, Rows: Rows})
+	}
+
+	return Otvet, nil
+}
+
+func readXls(Data []byte) ([]ExcelSheet, error) {
+	var Otvet []ExcelSheet
+
+	Workbook, err := xls.OpenReader(bytes.NewReader(Data))
+	if err != nil {
+		return Otvet, err
+	}
+
+	for _, Sheet := range Workbook.GetSheets() {
+		var Rows [][]string
+		for _, Row := range Sheet.GetRows() {
+			var Values []string
+			for _, Cell := range Row.GetCols() {
+				Value := Cell.GetString()
+				switch Cell.(type) {
+				case *record.Number, *record.Rk:
+					XF := Workbook.GetXFbyIndex(Cell.GetXFIndex())
+					FormatIndex := XF.GetFormatIndex()
+					CustomNumFmt := ""
+					if FormatIndex >= 164 {
+						Format := Workbook.GetFormatByIndex(FormatIndex)
+						CustomNumFmt = Format.String()
+					}
+					if IsDateFormat(FormatIndex, CustomNumFmt) {
+						Value = FormatExcelDate(Cell.GetFloat64(), false)
+					} else {
+						Value = strconv.FormatFloat(Cell.GetFloat64(), 'f', -1, 64)
+					}
+				}
+				Values = append(Values, Value)
+			}
+			Rows = append(Rows, Values)
+		}
+
+		Otvet = append(Otvet, ExcelSheet{Name: Sheet.GetName(), Rows: Rows})
+	}
+
+	return Otvet, nil
+}
+
+// IsDateFormat returns true for built-in date formats and custom formats with date or time parts
+func IsDateFormat(NumFmt int, CustomNumFmt string) bool {
+	if (NumFmt >= 14 && NumFmt <= 22) || (NumFmt >= 45 && NumFmt <= 47) {
+		return true
+	}
+	if CustomNumFmt == "" {
+		return false
+	}
+
+	//skip quoted text, escaped symbols and [Red], [$-419] sections
+	Format := strings.ToLower(CustomNumFmt)
+	InQuotes := false
+	InBrackets := false
+	for i := 0; i < len(Format); i++ {
+		c := Format[i]
+		switch {
+		case c == '"':
+			InQuotes = !InQuotes
+		case InQuotes:
+		case c == '\\':
+			i++
+		case c == '[':
+			InBrackets = true
+		case c == ']':
+			InBrackets = false
+		case InBrackets:
+		case c == 'y' || c == 'm' || c == 'd' || c == 'h' || c == 's':
+			return true
+		}
+	}
+
+	return false
+}
+
+// FormatExcelDate converts excel serial date to yyyy-mm-dd or yyyy-mm-dd hh:mm:ss
+func FormatExcelDate(Number float64, Date1904 bool) string {
+	Epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if Date1904 {
+		Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	Days := math.Floor(Number)
+	Seconds := math.Round((Number - Days) * 86400)
+	t := Epoch.AddDate(0, 0, int(Days)).Add(time.Duration(Seconds) * time.Second)
+
+	//time is rounded to seconds and can become midnight of the next day
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+		return t.Format("2006-01-02")
+	}
+
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// SaveFileConverted checks file content and viruses and saves file and csv/json files made from it if ConvertExcel is set.
+// Original is not saved if ConvertExcelKeepOriginal=false, but it is saved if conversion failed.
+// Returns locations of saved files and errors of files which are not saved or whose hook failed, duplicates are not errors
+func SaveFileConverted(FilenameNew string, massBytes []byte, Metadata FileMetadata) ([]string, error) {
+	var Locations []string
+	var Errors []error
+
+	if CheckFileContent(FilenameNew, massBytes, Metadata) == false {
+		return Locations, nil
+	}
+	if CheckFileVirus(FilenameNew, massBytes, Metadata) == false {
+		return Locations, nil
+	}
+
+	KeepOriginal := true
+	if myEnv["ConvertExcel"] != "" && IsExcelFile(FilenameNew) == true {
+		Files, err := ConvertExcel(FilenameNew, massBytes)
+		if err != nil {
+			MessageLogger(Metadata).Warn("Can not convert excel file", "file", FilenameNew, "error", err)
+		} else {
+			KeepOriginal = myEnv["ConvertExcelKeepOriginal"] != "false"
+			for _, File1 := range Files {
+				Metadata1 := Metadata
+				Metadata1.ContentType = mime.TypeByExtension(filepath.Ext(File1.Filename))
+				Location, err := SaveAttachmentFile(File1.Filename, File1.Data, Metadata1)
+				Locations, Errors = appendSaved(Locations, Errors, File1.Filename, Location, err)
+			}
+		}
+	}
+
+	if KeepOriginal == true {
+		Location, err := SaveAttachmentFile(FilenameNew, massBytes, Metadata)
+		Locations, Errors = appendSaved(Locations, Errors, FilenameNew, Location, err)
+	}
+
+	return Locations, errors.Join(Errors...)
+}
+
+// appendSaved adds result of SaveAttachmentFile, file with failed hook is saved and its location is added too
+func appendSaved(Locations []string, Errors []error, Filename, Location string, err error) ([]string, []error) {
+	var HookErr *HookError
+	if err == nil || errors.As(err, &HookErr) {
+		Locations = append(Locations, Location)
+	}
+	if err != nil && err != ErrDuplicateFile {
+		Errors = append(Errors, fmt.Errorf("can not save %s: %w", Filename, err))
+	}
+
+	return Locations, Errors
+}
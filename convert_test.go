@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestIsDateFormat(t *testing.T) {
+	var testData = []struct {
+		NumFmt       int
+		CustomNumFmt string
+		Result       bool
+	}{
+		{0, "", false},
+		{2, "", false},
+		{14, "", true},
+		{22, "", true},
+		{45, "", true},
+		{49, "", false},
+		{164, "dd.mm.yyyy", true},
+		{164, "hh:mm", true},
+		{164, "#,##0.00", false},
+		{164, "0.00\" руб.\"", false},
+		{164, "[Red]0.00", false},
+		{164, "[$-419]d mmmm yyyy", true},
+		{164, "0\\d", false},
+		{164, "\"day\" 0", false},
+	}
+
+	for i, Test := range testData {
+		if Result := IsDateFormat(Test.NumFmt, Test.CustomNumFmt); Result != Test.Result {
+			t.Errorf("[Test Case %v] Wrong result for %d %q. Expected: %v, Got: %v", i+1, Test.NumFmt, Test.CustomNumFmt, Test.Result, Result)
+		}
+	}
+}
+
+func TestFormatExcelDate(t *testing.T) {
+	var testData = []struct {
+		Number   float64
+		Date1904 bool
+		Result   string
+	}{
+		{44256, false, "2021-03-01"},
+		{44256.5, false, "2021-03-01 12:00:00"},
+		{44256.99998, false, "2021-03-01 23:59:58"},
+		{44256.999999, false, "2021-03-02"},
+		{1, false, "1899-12-31"},
+		{61, false, "1900-03-01"},
+		{0, true, "1904-01-01"},
+		{42794.25, true, "2021-03-01 06:00:00"},
+	}
+
+	for i, Test := range testData {
+		if Result := FormatExcelDate(Test.Number, Test.Date1904); Result != Test.Result {
+			t.Errorf("[Test Case %v] Wrong date for %v. Expected: %s, Got: %s", i+1, Test.Number, Test.Result, Result)
+		}
+	}
+}
+
+func TestSelectSheets(t *testing.T) {
+	Sheets := []ExcelSheet{{Name: "Prices"}, {Name: "Stock"}, {Name: "2"}}
+
+	var testData = []struct {
+		List   string
+		Result []string
+	}{
+		{"", []string{"Prices", "Stock", "2"}},
+		{" ", []string{"Prices", "Stock", "2"}},
+		{"Stock", []string{"Stock"}},
+		{"1, Stock", []string{"Prices", "Stock"}},
+		{"Stock,1", []string{"Prices", "Stock"}},
+		{"2", []string{"Stock", "2"}},
+		{"Missing,9", nil},
+	}
+
+	for i, Test := range testData {
+		var Names []string
+		for _, Sheet := range SelectSheets(Sheets, Test.List) {
+			Names = append(Names, Sheet.Name)
+		}
+		if strings.Join(Names, ",") != strings.Join(Test.Result, ",") {
+			t.Errorf("[Test Case %v] Wrong sheets for %q. Expected: %v, Got: %v", i+1, Test.List, Test.Result, Names)
+		}
+	}
+}
+
+func TestSheetToJson(t *testing.T) {
+	var testData = []struct {
+		Rows   [][]string
+		Result string
+	}{
+		{nil, `[]`},
+		{[][]string{{"Name", "Price"}}, `[]`},
+		{[][]string{{"Name", "Price"}, {"Tea", "100"}},
+			`[{"Name":"Tea","Price":"100"}]`},
+		//order of columns is kept
+		{[][]string{{"Zeta", "Alpha"}, {"1", "2"}},
+			`[{"Zeta":"1","Alpha":"2"}]`},
+		//repeated and empty headers, row longer than header
+		{[][]string{{"Sum", "", "Sum", "Sum_2"}, {"1", "2", "3", "4", "5"}},
+			`[{"Sum":"1","column2":"2","Sum_2":"3","Sum_2_2":"4","column5":"5"}]`},
+		//short row
+		{[][]string{{"Name", "Price"}, {"Tea"}},
+			`[{"Name":"Tea"}]`},
+	}
+
+	for i, Test := range testData {
+		Data, err := SheetToJson(ExcelSheet{Name: "Sheet1", Rows: Test.Rows})
+		if err != nil {
+			t.Errorf("[Test Case %v] Error: %v", i+1, err)
+			continue
+		}
+		Compact := strings.NewReplacer("\n", "", " ", "").Replace(string(Data))
+		if Compact != Test.Result {
+			t.Errorf("[Test Case %v] Wrong json. Expected: %s, Got: %s", i+1, Test.Result, Compact)
+		}
+	}
+}
+
+func TestReadExcel(t *testing.T) {
+	f := excelize.NewFile()
+	_ = f.SetSheetRow("Sheet1", "A1", &[]interface{}{"Date", "Price", "Price"})
+	_ = f.SetSheetRow("Sheet1", "A2", &[]interface{}{44256, 12.5, 13})
+	Style, err := f.NewStyle(&excelize.Style{NumFmt: 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.SetCellStyle("Sheet1", "A2", "A2", Style)
+	var b bytes.Buffer
+	if err = f.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	Sheets, err := ReadExcel("prices.xlsx", b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(Sheets) != 1 || len(Sheets[0].Rows) != 2 {
+		t.Fatalf("Wrong sheets: %v", Sheets)
+	}
+	if strings.Join(Sheets[0].Rows[1], ";") != "2021-03-01;12.5;13" {
+		t.Errorf("Wrong values: %v", Sheets[0].Rows[1])
+	}
+
+	_, err = ReadExcel("prices.xls", []byte("broken"))
+	if err == nil {
+		t.Errorf("Broken xls is read")
+	}
+}
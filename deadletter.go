@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+)
+
+// stages of message processing, failed stage is saved in dead-letter list
+const (
+	StageFetch      = "fetch"
+	StageRead       = "read"
+	StageParse      = "parse"
+	StageAuth       = "auth"
+	StageAttachment = "attachment"
+	StageHook       = "hook"
+)
+
+// MessageError - error of message processing with stage where it happened.
+// Hooks - hooks of saved files which must be run again
+type MessageError struct {
+	Stage string
+	Err   error
+	Hooks []FailedHook
+}
+
+func (e *MessageError) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// FailedMessage - message which was not processed, it is retried while Attempts < RetryMaxAttempts.
+// Message with stage hook is not fetched again, only its Hooks are run
+type FailedMessage struct {
+	Account     string       `json:"account"`
+	Folder      string       `json:"folder"`
+	UID         uint32       `json:"uid"`
+	SeqNum      uint32       `json:"seq_num"`
+	MessageID   string       `json:"message_id"`
+	From        string       `json:"from"`
+	Subject     string       `json:"subject"`
+	Stage       string       `json:"stage"`
+	Error       string       `json:"error"`
+	Attempts    int          `json:"attempts"`
+	FirstFailed time.Time    `json:"first_failed"`
+	LastFailed  time.Time    `json:"last_failed"`
+	NextRetry   time.Time    `json:"next_retry"`
+	Hooks       []FailedHook `json:"hooks,omitempty"`
+}
+
+// Metadata returns message fields for logs and catalog
+func (m FailedMessage) Metadata() FileMetadata {
+	return FileMetadata{Account: m.Account, Folder: m.Folder, UID: m.UID, MessageID: m.MessageID, From: m.From, Subject: m.Subject}
+}
+
+// DeadLetters - failed messages, saved in DeadLetterFile (default DeadLetters.json)
+var DeadLetters = &DeadLetterList{}
+
+// DeadLetterList - failed messages guarded by mutex, list without Filename is not saved
+type DeadLetterList struct {
+	mu       sync.Mutex
+	Filename string
+	Messages []FailedMessage
+}
+
+// LoadDeadLetters reads dead-letter list from DeadLetterFile
+func LoadDeadLetters() error {
+	Filename := myEnv["DeadLetterFile"]
+	if Filename == "" {
+		Filename = "DeadLetters.json"
+	}
+
+	DeadLetters = &DeadLetterList{Filename: Filename}
+	Data, err := os.ReadFile(Filename)
+	if os.IsNotExist(err) {
+		MetricDeadLetters.Set(0)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(Data, &DeadLetters.Messages)
+	MetricDeadLetters.Set(float64(len(DeadLetters.Messages)))
+
+	return err
+}
+
+// RetryMaxAttempts - retry budget of message, setting RetryMaxAttempts (default 5)
+func RetryMaxAttempts() int {
+	return settingInt("RetryMaxAttempts", 5)
+}
+
+// RetryDelay - pause after failed attempt, RetryBackoffMinutes (default 10) doubled for every next attempt, max 1 day
+func RetryDelay(Attempts int) time.Duration {
+	Delay := time.Minute * time.Duration(settingInt("RetryBackoffMinutes", 10))
+	for i := 1; i < Attempts && Delay < 24*time.Hour; i++ {
+		Delay = Delay * 2
+	}
+	if Delay > 24*time.Hour {
+		Delay = 24 * time.Hour
+	}
+
+	return Delay
+}
+
+func (l *DeadLetterList) find(Account, Folder string, UID uint32) int {
+	for i, Message := range l.Messages {
+		if Message.Account == Account && Message.Folder == Folder && Message.UID == UID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Add saves failed attempt of message with hooks to run again and returns its record
+func (l *DeadLetterList) Add(Metadata FileMetadata, SeqNum uint32, Stage string, MessageError error, Hooks []FailedHook) FailedMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	Now := time.Now()
+	i := l.find(Metadata.Account, Metadata.Folder, Metadata.UID)
+	if i < 0 {
+		l.Messages = append(l.Messages, FailedMessage{Account: Metadata.Account, Folder: Metadata.Folder, UID: Metadata.UID, FirstFailed: Now})
+		i = len(l.Messages) - 1
+	}
+
+	Message := &l.Messages[i]
+	Message.SeqNum = SeqNum
+	if Metadata.MessageID != "" {
+		Message.MessageID = Metadata.MessageID
+		Message.From = Metadata.From
+		Message.Subject = Metadata.Subject
+	}
+	Message.Stage = Stage
+	Message.Error = MessageError.Error()
+	Message.Hooks = Hooks
+	Message.Attempts++
+	Message.LastFailed = Now
+	Message.NextRetry = Now.Add(RetryDelay(Message.Attempts))
+	Otvet := *Message
+
+	l.save()
+
+	return Otvet
+}
+
+// AddHooks adds hooks to message in list, false is returned if message is not in list
+func (l *DeadLetterList) AddHooks(Account, Folder string, UID uint32, Hooks []FailedHook) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := l.find(Account, Folder, UID)
+	if i < 0 {
+		return false
+	}
+
+	l.Messages[i].Hooks = append(l.Messages[i].Hooks, Hooks...)
+	l.save()
+
+	return true
+}
+
+// Remove deletes message from list after successful processing
+func (l *DeadLetterList) Remove(Account, Folder string, UID uint32) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := l.find(Account, Folder, UID)
+	if i < 0 {
+		return false
+	}
+
+	l.Messages = append(l.Messages[:i], l.Messages[i+1:]...)
+	l.save()
+
+	return true
+}
+
+// Due returns messages of account and folder which must be retried now.
+// All - retry all messages, also not due and with exhausted retry budget
+func (l *DeadLetterList) Due(Account, Folder string, Now time.Time, All bool) []FailedMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	MaxAttempts := RetryMaxAttempts()
+	var Otvet []FailedMessage
+	for _, Message := range l.Messages {
+		if Message.Account != Account || Message.Folder != Folder {
+			continue
+		}
+		if All == false && (Message.Attempts >= MaxAttempts || Message.NextRetry.After(Now)) {
+			continue
+		}
+		Otvet = append(Otvet, Message)
+	}
+
+	return Otvet
+}
+
+// List returns copy of all messages
+func (l *DeadLetterList) List() []FailedMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]FailedMessage{}, l.Messages...)
+}
+
+// save writes list to temporary file and renames it, so the list is not damaged if program is stopped
+func (l *DeadLetterList) save() {
+	MetricDeadLetters.Set(float64(len(l.Messages)))
+	if l.Filename == "" {
+		return
+	}
+
+	Data, err := json.MarshalIndent(l.Messages, "", "  ")
+	if err != nil {
+		Status.SetError(err)
+		return
+	}
+
+	Temp, err := os.CreateTemp(filepath.Dir(l.Filename), filepath.Base(l.Filename)+".*.tmp")
+	if err == nil {
+		_, err = Temp.Write(Data)
+		err2 := Temp.Close()
+		if err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = os.Rename(Temp.Name(), l.Filename)
+		}
+		if err != nil {
+			os.Remove(Temp.Name())
+		}
+	}
+	if err != nil {
+		Status.SetError(err)
+		slog.Error("Can not save dead-letter list", "file", l.Filename, "error", err)
+	}
+}
+
+// RetryFailedMessages fetches messages of mail source from dead-letter list by UID and processes them again, checkpoint is not changed.
+// All - retry all messages, also not due and with exhausted retry budget
+func RetryFailedMessages(ctx context.Context, All bool) error {
+	if MailDownloader == nil {
+		return errors.New("downloader is not created")
+	}
+
+	//messages are saved with account and folder of source, for directory it is not EMAIL and INBOX
+	Key, err := MailDownloader.Open(ctx)
+	if err != nil {
+		return err
+	}
+
+	return retryFailedMessages(ctx, Key, All)
+}
+
+func retryFailedMessages(ctx context.Context, Key downloader.CheckpointKey, All bool) error {
+	Failed := DeadLetters.Due(Key.Account, Key.Folder, time.Now(), All)
+	if len(Failed) == 0 {
+		return nil
+	}
+
+	slog.Info("Retrying failed messages", "account", Key.Account, "folder", Key.Folder, "count", len(Failed))
+	for _, Message := range Failed {
+		Hooks, HookErr := RunFailedHooks(Message.Hooks)
+
+		//files are saved, only hooks are run again
+		if Message.Stage == StageHook {
+			if len(Hooks) > 0 {
+				DeadLetters.Add(Message.Metadata(), Message.SeqNum, StageHook, HookErr, Hooks)
+			} else {
+				DeadLetters.Remove(Message.Account, Message.Folder, Message.UID)
+				CatalogSetMessageStatus(Message.Metadata(), MessageStatusProcessed, nil)
+			}
+			continue
+		}
+
+		n, err := MailDownloader.Reprocess(ctx, Message.UID, Message.UID)
+		if err != nil {
+			return err
+		}
+
+		//deleted messages are not returned by server
+		if n == 0 {
+			DeadLetters.Add(Message.Metadata(), Message.SeqNum, StageFetch, errors.New("message is not found on server"), Hooks)
+			continue
+		}
+
+		//message is processed, but old hooks failed again
+		if len(Hooks) > 0 && DeadLetters.AddHooks(Message.Account, Message.Folder, Message.UID, Hooks) == false {
+			DeadLetters.Add(Message.Metadata(), Message.SeqNum, StageHook, HookErr, Hooks)
+		}
+	}
+
+	return nil
+}
+
+// RunRetryFailedCommand - command line: retry-failed [-all] [-list]
+func RunRetryFailedCommand(Args []string) error {
+	fs := flag.NewFlagSet("retry-failed", flag.ContinueOnError)
+	All := fs.Bool("all", false, "retry also messages with exhausted retry budget")
+	List := fs.Bool("list", false, "only show failed messages")
+	err := fs.Parse(Args)
+	if err != nil {
+		return err
+	}
+
+	if *List == true {
+		return WriteFailedMessages(os.Stdout, DeadLetters.List())
+	}
+
+	Source, err := NewMailSource(false)
+	if err != nil {
+		return err
+	}
+	Checkpoints, err := NewCheckpointStore(Source)
+	if err != nil {
+		return err
+	}
+	defer Checkpoints.Close()
+	MailDownloader, err = NewDownloader(Source, Checkpoints)
+	if err != nil {
+		return err
+	}
+	defer MailDownloader.Close()
+
+	err = RetryFailedMessages(context.Background(), *All)
+	if err != nil {
+		return err
+	}
+
+	return WriteFailedMessages(os.Stdout, DeadLetters.List())
+}
+
+// WriteFailedMessages writes dead-letter list as table
+func WriteFailedMessages(w io.Writer, Messages []FailedMessage) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "UID\tFROM\tSUBJECT\tSTAGE\tATTEMPTS\tNEXT RETRY\tERROR")
+	for _, Message := range Messages {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%s\t%s\n", Message.UID, Message.From, Message.Subject, Message.Stage,
+			Message.Attempts, Message.NextRetry.Format("2006-01-02 15:04:05"), Message.Error)
+	}
+
+	return tw.Flush()
+}
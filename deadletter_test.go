@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+)
+
+func TestDeadLetterList(t *testing.T) {
+	myEnv = map[string]string{"EMAIL": "buh@example.com", "DeadLetterFile": filepath.Join(t.TempDir(), "DeadLetters.json"), "RetryMaxAttempts": "2"}
+	err := LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Metadata := FileMetadata{Account: "buh@example.com", Folder: MailboxName, UID: 101, MessageID: "1@supplier.ru"}
+	Failed := DeadLetters.Add(Metadata, 1, StageParse, errors.New("broken mime"), nil)
+	if Failed.Attempts != 1 || Failed.NextRetry.Sub(Failed.LastFailed) != 10*time.Minute {
+		t.Errorf("Wrong first attempt: %+v", Failed)
+	}
+	if len(DeadLetters.Due(Metadata.Account, Metadata.Folder, time.Now(), false)) != 0 {
+		t.Errorf("Message is due before retry time")
+	}
+	if len(DeadLetters.Due(Metadata.Account, Metadata.Folder, Failed.NextRetry, false)) != 1 {
+		t.Errorf("Message is not due after retry time")
+	}
+
+	Failed = DeadLetters.Add(Metadata, 1, StageParse, errors.New("broken mime"), nil)
+	if Failed.Attempts != 2 || Failed.NextRetry.Sub(Failed.LastFailed) != 20*time.Minute {
+		t.Errorf("Wrong second attempt: %+v", Failed)
+	}
+	if len(DeadLetters.Due(Metadata.Account, Metadata.Folder, Failed.NextRetry, false)) != 0 {
+		t.Errorf("Message is due after retry budget is exhausted")
+	}
+	if len(DeadLetters.Due(Metadata.Account, Metadata.Folder, time.Now(), true)) != 1 {
+		t.Errorf("Message is not returned for retry-failed -all")
+	}
+
+	//list is read from file after restart
+	err = LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	List := DeadLetters.List()
+	if len(List) != 1 || List[0].UID != 101 || List[0].Error != "broken mime" || List[0].Attempts != 2 {
+		t.Fatalf("Wrong list after reload: %+v", List)
+	}
+
+	if DeadLetters.Remove(Metadata.Account, Metadata.Folder, 101) == false || len(DeadLetters.List()) != 0 {
+		t.Errorf("Message is not removed")
+	}
+}
+
+func TestProcessMessageWithoutBody(t *testing.T) {
+	myEnv = map[string]string{"EMAIL": "buh@example.com", "DeadLetterFile": filepath.Join(t.TempDir(), "DeadLetters.json")}
+	err := LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Options, err := NewProcessOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Options.Reprocess = true
+	ProcessMessage(&downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 7, UID: 107}, Options)
+
+	List := DeadLetters.List()
+	if len(List) != 1 || List[0].UID != 107 || List[0].Stage != StageFetch {
+		t.Fatalf("Message is not in dead-letter list: %+v", List)
+	}
+}
+
+// failingSink - sink which can not save files
+type failingSink struct{}
+
+func (failingSink) Exists(Name string) (bool, error) { return false, nil }
+func (failingSink) Put(Name string, Data []byte, ModTime time.Time) error {
+	return errors.New("disk is full")
+}
+func (failingSink) Location(Name string) string { return Name }
+
+func TestProcessMessageSaveFailed(t *testing.T) {
+	defer func(s OutputSink) { Sink = s }(Sink)
+	Sink = failingSink{}
+	myEnv = map[string]string{"EMAIL": "buh@example.com", "FileExtensions": ".xlsx", "DeadLetterFile": filepath.Join(t.TempDir(), "DeadLetters.json")}
+	err := LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Raw := "From: Supplier <price@supplier.ru>\r\n" +
+		"Subject: Price\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream; name=\"price.xlsx\"\r\n" +
+		"Content-Disposition: attachment; filename=\"price.xlsx\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aXRlbTtwcmljZQ==\r\n" +
+		"--b1--\r\n"
+	err = HandleMessage(context.Background(), &downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 1, UID: 108, Raw: []byte(Raw)})
+
+	var MsgError *MessageError
+	if errors.As(err, &MsgError) == false || MsgError.Stage != StageAttachment {
+		t.Errorf("Save error is not returned: %v", err)
+	}
+	List := DeadLetters.List()
+	if len(List) != 1 || List[0].UID != 108 || List[0].Stage != StageAttachment {
+		t.Fatalf("Message is not in dead-letter list: %+v", List)
+	}
+}
+
+func TestRetryFailedMessagesDirSource(t *testing.T) {
+	Root := t.TempDir()
+	MailDirectory := filepath.Join(Root, "Mail")
+	if err := os.Mkdir(MailDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	Raw := "From: Supplier <price@supplier.ru>\r\n" +
+		"Subject: Price\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream; name=\"price.xlsx\"\r\n" +
+		"Content-Disposition: attachment; filename=\"price.xlsx\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aXRlbTtwcmljZQ==\r\n" +
+		"--b1--\r\n"
+	if err := os.WriteFile(filepath.Join(MailDirectory, "1.eml"), []byte(Raw), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	//EMAIL is empty, so messages have account "files" and folder MailDirectory
+	myEnv = map[string]string{"MailSource": "dir", "MailDirectory": MailDirectory, "FileExtensions": ".xlsx",
+		"DeadLetterFile": filepath.Join(Root, "DeadLetters.json")}
+	err := LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(s OutputSink) { Sink = s }(Sink)
+	Sink = failingSink{}
+	Source, err := NewMailSource(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(d *downloader.Downloader) { MailDownloader = d }(MailDownloader)
+	MailDownloader, err = NewDownloader(Source, downloader.NewMemoryCheckpointStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = MailDownloader.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	List := DeadLetters.List()
+	if len(List) != 1 || List[0].Account != "files" || List[0].Folder != MailDirectory {
+		t.Fatalf("Message is not in dead-letter list: %+v", List)
+	}
+
+	Sink, err = NewLocalSink(filepath.Join(Root, "Files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = RetryFailedMessages(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if List = DeadLetters.List(); len(List) != 0 {
+		t.Errorf("Message is not retried: %+v", List)
+	}
+	if Files, _ := filepath.Glob(filepath.Join(Root, "Files", "*price.xlsx")); len(Files) != 1 {
+		t.Errorf("File is not saved on retry: %v", Files)
+	}
+}
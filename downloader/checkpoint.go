@@ -0,0 +1,118 @@
+package downloader
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CheckpointKey - folder of account. UIDValidity of IMAP folder is changed when old UIDs are not valid anymore,
+// so checkpoint of old UIDValidity is not used
+type CheckpointKey struct {
+	Account     string
+	Folder      string
+	UIDValidity uint32
+}
+
+func (k CheckpointKey) String() string {
+	return k.Account + "/" + k.Folder + "/" + strconv.FormatUint(uint64(k.UIDValidity), 10)
+}
+
+// CheckpointStore keeps UID of the last processed message of folder
+type CheckpointStore interface {
+	// Load returns UID of the last processed message, 0 if folder was not processed
+	Load(ctx context.Context, Key CheckpointKey) (uint32, error)
+	Save(ctx context.Context, Key CheckpointKey, UID uint32) error
+}
+
+// MemoryCheckpointStore - checkpoints are kept in memory only, for tests and dry-run
+type MemoryCheckpointStore struct {
+	mu  sync.Mutex
+	UID map[CheckpointKey]uint32
+}
+
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{UID: map[CheckpointKey]uint32{}}
+}
+
+func (s *MemoryCheckpointStore) Load(ctx context.Context, Key CheckpointKey) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.UID[Key], nil
+}
+
+func (s *MemoryCheckpointStore) Save(ctx context.Context, Key CheckpointKey, UID uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.UID[Key] = UID
+	return nil
+}
+
+// CheckpointFlusher - store which keeps saved checkpoints in memory and writes them later,
+// Downloader calls Flush after every sync and in Close
+type CheckpointFlusher interface {
+	Flush(ctx context.Context) error
+}
+
+// BatchCheckpointStore writes checkpoints to Store after Size saves or when Interval is passed since the last write.
+// After crash the last not written messages are processed again
+type BatchCheckpointStore struct {
+	Store    CheckpointStore
+	Size     int
+	Interval time.Duration
+
+	mu        sync.Mutex
+	pending   map[CheckpointKey]uint32
+	count     int
+	lastFlush time.Time
+}
+
+func NewBatchCheckpointStore(Store CheckpointStore, Size int, Interval time.Duration) *BatchCheckpointStore {
+	return &BatchCheckpointStore{Store: Store, Size: Size, Interval: Interval, pending: map[CheckpointKey]uint32{}, lastFlush: time.Now()}
+}
+
+func (s *BatchCheckpointStore) Load(ctx context.Context, Key CheckpointKey) (uint32, error) {
+	s.mu.Lock()
+	UID, ok := s.pending[Key]
+	s.mu.Unlock()
+	if ok == true {
+		return UID, nil
+	}
+
+	return s.Store.Load(ctx, Key)
+}
+
+func (s *BatchCheckpointStore) Save(ctx context.Context, Key CheckpointKey, UID uint32) error {
+	s.mu.Lock()
+	s.pending[Key] = UID
+	s.count++
+	NeedFlush := s.count >= s.Size || time.Since(s.lastFlush) >= s.Interval
+	s.mu.Unlock()
+
+	if NeedFlush == false {
+		return nil
+	}
+
+	return s.Flush(ctx)
+}
+
+// Flush writes pending checkpoints, not written ones stay pending
+func (s *BatchCheckpointStore) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for Key, UID := range s.pending {
+		err := s.Store.Save(ctx, Key, UID)
+		if err != nil {
+			return err
+		}
+		delete(s.pending, Key)
+	}
+	s.count = 0
+	s.lastFlush = time.Now()
+
+	return nil
+}
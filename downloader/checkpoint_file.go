@@ -0,0 +1,129 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileCheckpointStore - checkpoints of all folders are kept in local JSON file.
+// File is written atomically: temporary file, fsync, rename, so crash never leaves it truncated
+type FileCheckpointStore struct {
+	Filename string
+
+	mu  sync.Mutex
+	uid map[CheckpointKey]uint32
+}
+
+// checkpointRecord - record of checkpoint file
+type checkpointRecord struct {
+	Account     string    `json:"account"`
+	Folder      string    `json:"folder"`
+	UIDValidity uint32    `json:"uidvalidity"`
+	UID         uint32    `json:"uid"`
+	Updated     time.Time `json:"updated"`
+}
+
+// NewFileCheckpointStore reads checkpoint file, file is created by the first Save
+func NewFileCheckpointStore(Filename string) (*FileCheckpointStore, error) {
+	s := &FileCheckpointStore{Filename: Filename, uid: map[CheckpointKey]uint32{}}
+
+	Data, err := os.ReadFile(Filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var Records []checkpointRecord
+	err = json.Unmarshal(Data, &Records)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range Records {
+		s.uid[CheckpointKey{Account: r.Account, Folder: r.Folder, UIDValidity: r.UIDValidity}] = r.UID
+	}
+
+	return s, nil
+}
+
+func (s *FileCheckpointStore) Load(ctx context.Context, Key CheckpointKey) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.uid[Key], nil
+}
+
+// Save writes all checkpoints to file, checkpoint is not changed in memory if file can not be written
+func (s *FileCheckpointStore) Save(ctx context.Context, Key CheckpointKey, UID uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	Old, ok := s.uid[Key]
+	s.uid[Key] = UID
+	err := s.write()
+	if err != nil {
+		if ok == true {
+			s.uid[Key] = Old
+		} else {
+			delete(s.uid, Key)
+		}
+	}
+
+	return err
+}
+
+func (s *FileCheckpointStore) write() error {
+	Now := time.Now()
+	Records := []checkpointRecord{}
+	for Key, UID := range s.uid {
+		Records = append(Records, checkpointRecord{Account: Key.Account, Folder: Key.Folder, UIDValidity: Key.UIDValidity, UID: UID, Updated: Now})
+	}
+
+	Data, err := json.MarshalIndent(Records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.Filename, Data)
+}
+
+// writeFileAtomic writes temporary file in the same directory, syncs it to disk and renames it
+func writeFileAtomic(Filename string, Data []byte) error {
+	Directory := filepath.Dir(Filename)
+	f, err := os.CreateTemp(Directory, "."+filepath.Base(Filename)+".tmp_*")
+	if err != nil {
+		return err
+	}
+	TempName := f.Name()
+
+	_, err = f.Write(Data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(TempName, 0644)
+	}
+	if err == nil {
+		err = os.Rename(TempName, Filename)
+	}
+	if err != nil {
+		_ = os.Remove(TempName)
+		return err
+	}
+
+	//rename is saved to disk with directory, it is not supported on Windows
+	if d, err := os.Open(Directory); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
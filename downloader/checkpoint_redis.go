@@ -0,0 +1,51 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisPrefix - prefix of Redis keys of checkpoints
+const DefaultRedisPrefix = "emails:checkpoint:"
+
+// RedisCheckpointStore - checkpoint of folder is kept in Redis key Prefix+"account/folder/uidvalidity"
+type RedisCheckpointStore struct {
+	Client *redis.Client
+	Prefix string
+}
+
+// NewRedisCheckpointStore connects to Redis server, Address - host:port
+func NewRedisCheckpointStore(ctx context.Context, Address, Password string, DB int) (*RedisCheckpointStore, error) {
+	Client := redis.NewClient(&redis.Options{Addr: Address, Password: Password, DB: DB})
+	err := Client.Ping(ctx).Err()
+	if err != nil {
+		Client.Close()
+		return nil, err
+	}
+
+	return &RedisCheckpointStore{Client: Client, Prefix: DefaultRedisPrefix}, nil
+}
+
+func (s *RedisCheckpointStore) Load(ctx context.Context, Key CheckpointKey) (uint32, error) {
+	Value, err := s.Client.Get(ctx, s.Prefix+Key.String()).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	UID, err := strconv.ParseUint(Value, 10, 32)
+	return uint32(UID), err
+}
+
+func (s *RedisCheckpointStore) Save(ctx context.Context, Key CheckpointKey, UID uint32) error {
+	return s.Client.Set(ctx, s.Prefix+Key.String(), strconv.FormatUint(uint64(UID), 10), 0).Err()
+}
+
+func (s *RedisCheckpointStore) Close() error {
+	return s.Client.Close()
+}
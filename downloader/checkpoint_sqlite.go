@@ -0,0 +1,65 @@
+package downloader
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteCheckpointSchema = `
+CREATE TABLE IF NOT EXISTS checkpoints (
+	account TEXT NOT NULL,
+	folder TEXT NOT NULL,
+	uidvalidity INTEGER NOT NULL,
+	uid INTEGER NOT NULL,
+	updated_at TEXT NOT NULL,
+	PRIMARY KEY (account, folder, uidvalidity)
+);
+`
+
+// SQLiteCheckpointStore - checkpoints are kept in table checkpoints of SQLite database,
+// the same database file can be used by several programs
+type SQLiteCheckpointStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteCheckpointStore opens database file and creates table
+func NewSQLiteCheckpointStore(Filename string) (*SQLiteCheckpointStore, error) {
+	db, err := sql.Open("sqlite", Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(sqliteCheckpointSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteCheckpointStore{db: db}, nil
+}
+
+func (s *SQLiteCheckpointStore) Load(ctx context.Context, Key CheckpointKey) (uint32, error) {
+	var UID uint32
+	err := s.db.QueryRowContext(ctx, `SELECT uid FROM checkpoints WHERE account = ? AND folder = ? AND uidvalidity = ?`,
+		Key.Account, Key.Folder, Key.UIDValidity).Scan(&UID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+
+	return UID, err
+}
+
+func (s *SQLiteCheckpointStore) Save(ctx context.Context, Key CheckpointKey, UID uint32) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO checkpoints (account, folder, uidvalidity, uid, updated_at)
+		VALUES (?, ?, ?, ?, ?)`, Key.Account, Key.Folder, Key.UIDValidity, UID, time.Now().UTC().Format(time.RFC3339))
+
+	return err
+}
+
+func (s *SQLiteCheckpointStore) Close() error {
+	return s.db.Close()
+}
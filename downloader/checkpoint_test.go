@@ -0,0 +1,115 @@
+package downloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testCheckpointStore checks that checkpoints of different UIDValidity are separate
+func testCheckpointStore(t *testing.T, Store CheckpointStore) {
+	ctx := context.Background()
+	Key := CheckpointKey{Account: "buh@example.com", Folder: "INBOX", UIDValidity: 5}
+	Key2 := CheckpointKey{Account: "buh@example.com", Folder: "INBOX", UIDValidity: 6}
+
+	if UID, err := Store.Load(ctx, Key); err != nil || UID != 0 {
+		t.Errorf("Expected 0 for new folder, Got: %d %v", UID, err)
+	}
+
+	for _, UID := range []uint32{10, 42} {
+		err := Store.Save(ctx, Key, UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if UID, err := Store.Load(ctx, Key); err != nil || UID != 42 {
+		t.Errorf("Expected 42, Got: %d %v", UID, err)
+	}
+	if UID, err := Store.Load(ctx, Key2); err != nil || UID != 0 {
+		t.Errorf("Checkpoint of other UIDValidity is used: %d %v", UID, err)
+	}
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	Filename := filepath.Join(t.TempDir(), "Checkpoints.json")
+	Store, err := NewFileCheckpointStore(Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCheckpointStore(t, Store)
+
+	//checkpoints are read after restart, temporary files are not left
+	Store, err = NewFileCheckpointStore(Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Key := CheckpointKey{Account: "buh@example.com", Folder: "INBOX", UIDValidity: 5}
+	if UID, _ := Store.Load(context.Background(), Key); UID != 42 {
+		t.Errorf("Expected 42 after restart, Got: %d", UID)
+	}
+	Files, _ := os.ReadDir(filepath.Dir(Filename))
+	if len(Files) != 1 {
+		t.Errorf("Temporary files are left: %v", Files)
+	}
+
+	//file can not be written, old checkpoint is kept
+	Store.Filename = filepath.Join(t.TempDir(), "missing", "Checkpoints.json")
+	if err = Store.Save(context.Background(), Key, 50); err == nil {
+		t.Errorf("Error is not returned")
+	}
+	if UID, _ := Store.Load(context.Background(), Key); UID != 42 {
+		t.Errorf("Checkpoint is changed by failed save: %d", UID)
+	}
+}
+
+func TestSQLiteCheckpointStore(t *testing.T) {
+	Store, err := NewSQLiteCheckpointStore(filepath.Join(t.TempDir(), "Checkpoints.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Store.Close()
+
+	testCheckpointStore(t, Store)
+}
+
+func TestRedisCheckpointStore(t *testing.T) {
+	Server := miniredis.RunT(t)
+	Store, err := NewRedisCheckpointStore(context.Background(), Server.Addr(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Store.Close()
+
+	testCheckpointStore(t, Store)
+	if Value, _ := Server.Get(DefaultRedisPrefix + "buh@example.com/INBOX/5"); Value != "42" {
+		t.Errorf("Wrong Redis value: %q", Value)
+	}
+}
+
+func TestBatchCheckpointStore(t *testing.T) {
+	ctx := context.Background()
+	Memory := NewMemoryCheckpointStore()
+	Store := NewBatchCheckpointStore(Memory, 3, time.Hour)
+	testCheckpointStore(t, Store)
+
+	Key := CheckpointKey{Account: "buh@example.com", Folder: "INBOX", UIDValidity: 5}
+	if UID, _ := Memory.Load(ctx, Key); UID != 0 {
+		t.Errorf("Checkpoint is written before batch is full: %d", UID)
+	}
+
+	_ = Store.Save(ctx, Key, 43)
+	if UID, _ := Memory.Load(ctx, Key); UID != 43 {
+		t.Errorf("Checkpoint is not written after 3 saves: %d", UID)
+	}
+
+	_ = Store.Save(ctx, Key, 44)
+	err := Store.Flush(ctx)
+	if UID, _ := Memory.Load(ctx, Key); err != nil || UID != 44 {
+		t.Errorf("Checkpoint is not written by Flush: %d %v", UID, err)
+	}
+}
@@ -0,0 +1,85 @@
+package downloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DirSource - directory with message files (.eml, Maildir "cur" or "new" directory).
+// Files are sorted by name and UID is number of file in this order, so names of new files
+// must be after names of old ones, for example they start with time like in Maildir
+type DirSource struct {
+	Directory string
+	Account   string //account in checkpoint key, default "files"
+}
+
+func (s *DirSource) key() CheckpointKey {
+	Account := s.Account
+	if Account == "" {
+		Account = "files"
+	}
+
+	return CheckpointKey{Account: Account, Folder: s.Directory, UIDValidity: 1}
+}
+
+func (s *DirSource) Open(ctx context.Context) (CheckpointKey, error) {
+	_, err := os.Stat(s.Directory)
+
+	return s.key(), err
+}
+
+func (s *DirSource) Fetch(ctx context.Context, From, To uint32, Limit int, fn func(m *Message) error) error {
+	Entries, err := os.ReadDir(s.Directory)
+	if err != nil {
+		return err
+	}
+
+	var Names []string
+	for _, Entry := range Entries {
+		if Entry.IsDir() || strings.HasPrefix(Entry.Name(), ".") {
+			continue
+		}
+		Names = append(Names, Entry.Name())
+	}
+	sort.Strings(Names)
+
+	Key := s.key()
+	Count := 0
+	for i, Name := range Names {
+		UID := uint32(i + 1)
+		if UID < From || (To != 0 && UID > To) {
+			continue
+		}
+		if Limit > 0 && Count >= Limit {
+			break
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		Path := filepath.Join(s.Directory, Name)
+		Info, err := os.Stat(Path)
+		if err != nil {
+			return err
+		}
+		Raw, err := os.ReadFile(Path)
+		if err != nil {
+			return err
+		}
+
+		Count++
+		err = fn(&Message{Account: Key.Account, Folder: Key.Folder, UID: UID, SeqNum: UID, InternalDate: Info.ModTime(), Raw: Raw})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *DirSource) Close() error {
+	return nil
+}
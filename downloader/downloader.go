@@ -0,0 +1,339 @@
+// Package downloader downloads attachments of email messages from mail source to output sink.
+//
+// Downloader fetches new messages after checkpoint in batches, passes every message to handler
+// and saves checkpoint after it. Errors of messages do not stop downloading, they are sent as events.
+// Default handler saves attachments accepted by filter to sink, programs with own processing set Handler.
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"DownloadEmailsAttachments/parsemail"
+)
+
+const (
+	DefaultBatchSize    = 100
+	DefaultPollInterval = time.Minute
+)
+
+// event types
+const (
+	EventConnected        = "connected"
+	EventConnectFailed    = "connect_failed"
+	EventBatchFetched     = "batch_fetched"
+	EventMessageProcessed = "message_processed"
+	EventMessageFailed    = "message_failed"
+	EventCheckpointFailed = "checkpoint_failed"
+	EventFileSaved        = "file_saved"
+	EventFileSkipped      = "file_skipped"
+)
+
+// Event - what happened while downloading, sent to Config.OnEvent
+type Event struct {
+	Type     string
+	Time     time.Time
+	Key      CheckpointKey
+	UID      uint32
+	File     string        //location of saved file or name of skipped one
+	Reason   string        //reason of skipped file
+	Count    int           //messages in batch
+	Duration time.Duration //time of fetching batch from source, without time of handler
+	Err      error
+}
+
+// MessageHandler processes fetched message. Returned error is sent in EventMessageFailed
+// and the next messages are processed
+type MessageHandler interface {
+	HandleMessage(ctx context.Context, m *Message) error
+}
+
+// HandlerFunc - function as MessageHandler
+type HandlerFunc func(ctx context.Context, m *Message) error
+
+func (f HandlerFunc) HandleMessage(ctx context.Context, m *Message) error {
+	return f(ctx, m)
+}
+
+// Config - settings of Downloader, Source and Checkpoints are required, Sink is required without Handler
+type Config struct {
+	Source      MailSource
+	Checkpoints CheckpointStore
+	Sink        OutputSink
+	// Filter - attachments saved by default handler, nil - all attachments
+	Filter AttachmentFilter
+	// Handler - own processing of messages instead of saving attachments to Sink
+	Handler MessageHandler
+	// OnEvent is called synchronously for every event
+	OnEvent func(Event)
+	// BatchSize - messages fetched at once, default 100
+	BatchSize int
+	// PollInterval - pause between syncs in Run, default 1 minute
+	PollInterval time.Duration
+	// DownloadFromDate - older messages are skipped by default handler
+	DownloadFromDate time.Time
+	// Keys - keys for signed and encrypted messages parsed by default handler, nil - no keys
+	Keys *parsemail.CryptoKeys
+	// Logger - default slog.Default()
+	Logger *slog.Logger
+}
+
+// Downloader - downloads attachments from one mail source, it must not be used from several goroutines
+type Downloader struct {
+	config  Config
+	opened  bool
+	lastUID map[CheckpointKey]uint32
+}
+
+// New checks config and sets default values
+func New(config Config) (*Downloader, error) {
+	if config.Source == nil {
+		return nil, errors.New("downloader: Source is required")
+	}
+	if config.Checkpoints == nil {
+		return nil, errors.New("downloader: Checkpoints is required")
+	}
+	if config.Handler == nil && config.Sink == nil {
+		return nil, errors.New("downloader: Sink or Handler is required")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = DefaultPollInterval
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	return &Downloader{config: config, lastUID: map[CheckpointKey]uint32{}}, nil
+}
+
+func (d *Downloader) emit(e Event) {
+	if d.config.OnEvent == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	d.config.OnEvent(e)
+}
+
+func (d *Downloader) open(ctx context.Context) (CheckpointKey, error) {
+	Key, err := d.config.Source.Open(ctx)
+	if err != nil {
+		d.opened = false
+		d.config.Logger.Error("Can not connect to mail source", "error", err)
+		d.emit(Event{Type: EventConnectFailed, Err: err})
+		return Key, err
+	}
+
+	if d.opened == false {
+		d.opened = true
+		d.config.Logger.Info("Connected to mail source", "account", Key.Account, "folder", Key.Folder, "uidvalidity", Key.UIDValidity)
+		d.emit(Event{Type: EventConnected, Key: Key})
+	}
+
+	return Key, nil
+}
+
+// Open connects to mail source and returns checkpoint key of folder,
+// fetched messages have Account and Folder of this key
+func (d *Downloader) Open(ctx context.Context) (CheckpointKey, error) {
+	return d.open(ctx)
+}
+
+// Close writes pending checkpoints and disconnects from mail source
+func (d *Downloader) Close() error {
+	d.flush(context.Background())
+	d.opened = false
+	return d.config.Source.Close()
+}
+
+// flush writes checkpoints kept by CheckpointFlusher, they are written also if ctx is cancelled
+func (d *Downloader) flush(ctx context.Context) {
+	Flusher, ok := d.config.Checkpoints.(CheckpointFlusher)
+	if ok == false {
+		return
+	}
+
+	err := Flusher.Flush(context.WithoutCancel(ctx))
+	if err != nil {
+		d.config.Logger.Error("Can not save checkpoint", "error", err)
+		d.emit(Event{Type: EventCheckpointFailed, Err: err})
+	}
+}
+
+// checkpoint returns UID of the last processed message, it is kept in memory if store can not save it
+func (d *Downloader) checkpoint(ctx context.Context, Key CheckpointKey) (uint32, error) {
+	if UID, ok := d.lastUID[Key]; ok == true {
+		return UID, nil
+	}
+
+	UID, err := d.config.Checkpoints.Load(ctx, Key)
+	if err != nil {
+		return 0, err
+	}
+	d.lastUID[Key] = UID
+
+	return UID, nil
+}
+
+func (d *Downloader) handle(ctx context.Context, Key CheckpointKey, m *Message) {
+	var err error
+	if d.config.Handler != nil {
+		err = d.config.Handler.HandleMessage(ctx, m)
+	} else {
+		err = d.SaveAttachments(ctx, m)
+	}
+
+	if err != nil {
+		d.config.Logger.Error("Message is not processed", "account", Key.Account, "folder", Key.Folder, "uid", m.UID, "error", err)
+		d.emit(Event{Type: EventMessageFailed, Key: Key, UID: m.UID, Err: err})
+		return
+	}
+
+	d.emit(Event{Type: EventMessageProcessed, Key: Key, UID: m.UID})
+}
+
+// RunOnce processes all messages after checkpoint and returns number of processed messages.
+// Checkpoint is saved after every message, CheckpointFlusher is flushed at the end. Connection is closed after error and opened again by the next call
+func (d *Downloader) RunOnce(ctx context.Context) (int, error) {
+	Key, err := d.open(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer d.flush(ctx)
+
+	Count := 0
+	for {
+		LastUID, err := d.checkpoint(ctx, Key)
+		if err != nil {
+			return Count, err
+		}
+
+		//Fetch calls handler for every message, so time of handler and checkpoint is subtracted
+		Start := time.Now()
+		var HandleTime time.Duration
+		n := 0
+		err = d.config.Source.Fetch(ctx, LastUID+1, 0, d.config.BatchSize, func(m *Message) error {
+			n++
+			HandleStart := time.Now()
+			defer func() { HandleTime += time.Since(HandleStart) }()
+			d.handle(ctx, Key, m)
+
+			d.lastUID[Key] = m.UID
+			err := d.config.Checkpoints.Save(ctx, Key, m.UID)
+			if err != nil {
+				d.config.Logger.Error("Can not save checkpoint", "account", Key.Account, "folder", Key.Folder, "uid", m.UID, "error", err)
+				d.emit(Event{Type: EventCheckpointFailed, Key: Key, UID: m.UID, Err: err})
+			}
+			return nil
+		})
+		Count += n
+		if err != nil {
+			if ctx.Err() == nil {
+				d.Close()
+			}
+			return Count, err
+		}
+		d.emit(Event{Type: EventBatchFetched, Key: Key, Count: n, Duration: time.Since(Start) - HandleTime})
+
+		if n < d.config.BatchSize {
+			return Count, nil
+		}
+	}
+}
+
+// Run syncs every PollInterval until ctx is cancelled, errors are logged and sent as events
+func (d *Downloader) Run(ctx context.Context) error {
+	defer d.Close()
+
+	for {
+		_, err := d.RunOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			d.config.Logger.Error("Sync failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.config.PollInterval):
+		}
+	}
+}
+
+// Reprocess processes messages with UIDs from From to To again, checkpoint is not changed.
+// Returns number of processed messages, deleted messages are not returned by server
+func (d *Downloader) Reprocess(ctx context.Context, From, To uint32) (int, error) {
+	Key, err := d.open(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = d.config.Source.Fetch(ctx, From, To, 0, func(m *Message) error {
+		n++
+		m.Reprocessed = true
+		d.handle(ctx, Key, m)
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		d.Close()
+	}
+
+	return n, err
+}
+
+// SaveAttachments - default handler, saves attachments accepted by Filter to Sink as "From(Name (address))_filename"
+func (d *Downloader) SaveAttachments(ctx context.Context, m *Message) error {
+	if m.Raw == nil {
+		return errors.New("server did not return message body")
+	}
+
+	email, err := parsemail.ParseWithKeys(bytes.NewReader(m.Raw), d.config.Keys)
+	if err != nil {
+		return fmt.Errorf("can not parse message: %w", err)
+	}
+
+	Date := email.Date
+	if Date.IsZero() {
+		Date = m.InternalDate
+	}
+	if Date.Before(d.config.DownloadFromDate) {
+		return nil
+	}
+
+	Key := CheckpointKey{Account: m.Account, Folder: m.Folder}
+	EmailFrom, EmailAddress := MessageSender(email)
+	for _, a := range CollectAttachments(email, EmailFrom, EmailAddress) {
+		if d.config.Filter != nil {
+			if ok, Reason := d.config.Filter.Accept(m, a); ok == false {
+				d.emit(Event{Type: EventFileSkipped, Key: Key, UID: m.UID, File: a.Attachment.Filename, Reason: Reason})
+				continue
+			}
+		}
+
+		Data, err := io.ReadAll(a.Attachment.Data)
+		if err != nil {
+			return fmt.Errorf("can not read attachment %s: %w", a.Attachment.Filename, err)
+		}
+
+		Name, err := CleanName(a.EmailFrom + "_" + a.Attachment.Filename)
+		if err != nil {
+			return err
+		}
+		err = d.config.Sink.Put(Name, Data, time.Time{})
+		if err != nil {
+			return fmt.Errorf("can not save %s: %w", d.config.Sink.Location(Name), err)
+		}
+		d.emit(Event{Type: EventFileSaved, Key: Key, UID: m.UID, File: d.config.Sink.Location(Name)})
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+package downloader
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"DownloadEmailsAttachments/parsemail"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+func testMessage(Filename, Data string) string {
+	return "From: Supplier <price@supplier.ru>\r\n" +
+		"To: buh@example.com\r\n" +
+		"Subject: Price\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Price list attached\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream; name=\"" + Filename + "\"\r\n" +
+		"Content-Disposition: attachment; filename=\"" + Filename + "\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		Data + "\r\n" +
+		"--b1--\r\n"
+}
+
+func TestDownloader(t *testing.T) {
+	Messages := t.TempDir()
+	Files := t.TempDir()
+	_ = os.WriteFile(filepath.Join(Messages, "001.eml"), []byte(testMessage("price.csv", "aXRlbTtwcmljZQ==")), 0644)
+	_ = os.WriteFile(filepath.Join(Messages, "002.eml"), []byte("Content-Type: multipart/mixed\r\n\r\nbroken"), 0644)
+	_ = os.WriteFile(filepath.Join(Messages, "003.eml"), []byte(testMessage("logo.png", "iVBORw0KGgo=")), 0644)
+
+	Sink, err := NewLocalSink(Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var Events []Event
+	Checkpoints := NewMemoryCheckpointStore()
+	d, err := New(Config{
+		Source:      &DirSource{Directory: Messages},
+		Checkpoints: Checkpoints,
+		Sink:        Sink,
+		Filter:      NewExtensionFilter(".csv, .xlsx"),
+		OnEvent:     func(e Event) { Events = append(Events, e) },
+		BatchSize:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Count, err := d.RunOnce(context.Background())
+	if err != nil || Count != 3 {
+		t.Fatalf("Expected 3 messages, Got: %d %v", Count, err)
+	}
+
+	Types := map[string]int{}
+	for _, e := range Events {
+		Types[e.Type]++
+	}
+	if Types[EventMessageProcessed] != 2 || Types[EventMessageFailed] != 1 || Types[EventFileSaved] != 1 || Types[EventFileSkipped] != 1 || Types[EventBatchFetched] != 2 {
+		t.Errorf("Wrong events: %v", Types)
+	}
+
+	Data, err := os.ReadFile(filepath.Join(Files, "From(Supplier (price@supplier.ru))_price.csv"))
+	if err != nil || string(Data) != "item;price" {
+		t.Errorf("File is not saved: %q %v", Data, err)
+	}
+
+	Key := CheckpointKey{Account: "files", Folder: Messages, UIDValidity: 1}
+	if UID, _ := Checkpoints.Load(context.Background(), Key); UID != 3 {
+		t.Errorf("Wrong checkpoint. Expected: 3, Got: %d", UID)
+	}
+
+	//only new messages are processed
+	_ = os.WriteFile(filepath.Join(Messages, "004.eml"), []byte(testMessage("price2.csv", "aXRlbTtwcmljZQ==")), 0644)
+	Count, err = d.RunOnce(context.Background())
+	if err != nil || Count != 1 {
+		t.Errorf("Expected 1 new message, Got: %d %v", Count, err)
+	}
+
+	Count, err = d.Reprocess(context.Background(), 1, 1)
+	if err != nil || Count != 1 {
+		t.Errorf("Expected 1 reprocessed message, Got: %d %v", Count, err)
+	}
+	if UID, _ := Checkpoints.Load(context.Background(), Key); UID != 4 {
+		t.Errorf("Checkpoint is changed by Reprocess: %d", UID)
+	}
+}
+
+func TestNewRequiresSource(t *testing.T) {
+	_, err := New(Config{Checkpoints: NewMemoryCheckpointStore(), Sink: &LocalSink{}})
+	if err == nil {
+		t.Errorf("Config without Source is accepted")
+	}
+	_, err = New(Config{Source: &DirSource{}, Checkpoints: NewMemoryCheckpointStore()})
+	if err == nil {
+		t.Errorf("Config without Sink and Handler is accepted")
+	}
+}
+
+// startIMAPServer starts memory IMAP server with TLS, user "username" with password "password"
+// has INBOX with one message UID 6
+func startIMAPServer(t *testing.T) (*memory.Backend, string) {
+	Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	Cert, err := x509.CreateCertificate(rand.Reader, Template, Template, &Key.PublicKey, Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{Cert}, PrivateKey: Key}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Backend := memory.New()
+	s := server.New(Backend)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return Backend, l.Addr().String()
+}
+
+func TestIMAPSource(t *testing.T) {
+	Backend, Address := startIMAPServer(t)
+	User, _ := Backend.Login(nil, "username", "password")
+	Mailbox, _ := User.GetMailbox("INBOX")
+	for _, Name := range []string{"price1.csv", "price2.csv"} {
+		_ = Mailbox.CreateMessage(nil, time.Now(), strings.NewReader(testMessage(Name, "aXRlbTtwcmljZQ==")))
+	}
+
+	Source := &IMAPSource{Address: Address, Username: "username", Password: "password", TLSConfig: &tls.Config{InsecureSkipVerify: true}, ReadOnly: true}
+	defer Source.Close()
+
+	ctx := context.Background()
+	Key, err := Source.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Key.Account != "username" || Key.Folder != "INBOX" || Key.UIDValidity == 0 {
+		t.Errorf("Wrong key: %+v", Key)
+	}
+
+	var UIDs []uint32
+	err = Source.Fetch(ctx, 7, 0, 1, func(m *Message) error {
+		UIDs = append(UIDs, m.UID)
+		if strings.Contains(string(m.Raw), "price1.csv") == false {
+			t.Errorf("Wrong message body: %s", m.Raw)
+		}
+		return nil
+	})
+	if err != nil || len(UIDs) != 1 || UIDs[0] != 7 {
+		t.Errorf("Expected UID 7, Got: %v %v", UIDs, err)
+	}
+
+	//"10:*" returns the last message, it must be skipped
+	UIDs = nil
+	err = Source.Fetch(ctx, 10, 0, 0, func(m *Message) error {
+		UIDs = append(UIDs, m.UID)
+		return nil
+	})
+	if err != nil || len(UIDs) != 0 {
+		t.Errorf("Expected no messages, Got: %v %v", UIDs, err)
+	}
+
+	UID, err := Source.UID(ctx, 2)
+	if err != nil || UID != 7 {
+		t.Errorf("Expected UID 7 of message 2, Got: %d %v", UID, err)
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	var testData = []struct {
+		Name     string
+		Expected string
+		OK       bool
+	}{
+		{"From(Supplier)_price.xlsx", "From(Supplier)_price.xlsx", true},
+		{"../../../evil.xlsx", ".._.._.._evil.xlsx", true},
+		{"..\\evil.xlsx", ".._evil.xlsx", true},
+		{"/etc/passwd", "_etc_passwd", true},
+		{"..", "..", false},
+		{".", ".", false},
+		{"", "", false},
+	}
+
+	for i, td := range testData {
+		Name, err := CleanName(td.Name)
+		if Name != td.Expected || (err == nil) != td.OK {
+			t.Errorf("[Test Case %v] Expected: %q %v, Got: %q %v", i, td.Expected, td.OK, Name, err)
+		}
+	}
+}
+
+func TestCollectAttachments(t *testing.T) {
+	email := parsemail.Email{
+		Attachments: []parsemail.Attachment{{Filename: "Fwd.eml"}, {Filename: "price.xlsx"}},
+		AttachedEmails: []parsemail.Email{{
+			From:        []*mail.Address{{Name: "Bank", Address: "statements@bank.ru"}},
+			Attachments: []parsemail.Attachment{{Filename: "statement.pdf"}},
+			AttachedEmails: []parsemail.Email{{
+				From:        []*mail.Address{{Address: "ceo@bank.ru"}},
+				Attachments: []parsemail.Attachment{{Filename: "order.pdf"}},
+			}},
+		}},
+	}
+
+	var testData = []struct {
+		Filename      string
+		EmailFrom     string
+		ForwardedFrom string
+	}{
+		{"Fwd.eml", "From(Manager (manager@company.ru))", ""},
+		{"price.xlsx", "From(Manager (manager@company.ru))", ""},
+		{"statement.pdf", "From(Manager (manager@company.ru))_Fwd(Bank (statements@bank.ru))", "statements@bank.ru"},
+		{"order.pdf", "From(Manager (manager@company.ru))_Fwd(Bank (statements@bank.ru))_Fwd( (ceo@bank.ru))", "ceo@bank.ru"},
+	}
+
+	Attachments := CollectAttachments(email, "From(Manager (manager@company.ru))", "manager@company.ru")
+	if len(Attachments) != len(testData) {
+		t.Fatalf("Wrong attachments count. Expected: %v, Got: %v", len(testData), len(Attachments))
+	}
+	for i, Test := range testData {
+		a := Attachments[i]
+		//files of forwarded messages belong to authenticated sender of outer message
+		if a.Attachment.Filename != Test.Filename || a.EmailFrom != Test.EmailFrom || a.EmailAddress != "manager@company.ru" ||
+			a.ForwardedFrom != Test.ForwardedFrom {
+			t.Errorf("[Test Case %v] Wrong attachment: %+v", i+1, a)
+		}
+	}
+}
+
+func TestBatchDuration(t *testing.T) {
+	Directory := t.TempDir()
+	for _, Name := range []string{"1.eml", "2.eml"} {
+		err := os.WriteFile(filepath.Join(Directory, Name), []byte(testMessage("price.xlsx", "cHJpY2U=")), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var Durations []time.Duration
+	d, err := New(Config{
+		Source:      &DirSource{Directory: Directory},
+		Checkpoints: NewMemoryCheckpointStore(),
+		Handler: HandlerFunc(func(ctx context.Context, m *Message) error {
+			time.Sleep(200 * time.Millisecond)
+			return nil
+		}),
+		OnEvent: func(e Event) {
+			if e.Type == EventBatchFetched {
+				Durations = append(Durations, e.Duration)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//time of handler is not fetch time
+	if _, err = d.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(Durations) != 1 || Durations[0] >= 200*time.Millisecond {
+		t.Errorf("Wrong fetch duration: %v", Durations)
+	}
+}
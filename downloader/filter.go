@@ -0,0 +1,129 @@
+package downloader
+
+import (
+	b64 "encoding/base64"
+	"path/filepath"
+	"strings"
+
+	"DownloadEmailsAttachments/parsemail"
+)
+
+// Attachment - attachment with its sender. EmailFrom is used as prefix of file name: From(Name (address)).
+// Attachments of forwarded messages belong to sender of outer message, sender of inner message is not authenticated,
+// so it is only added to file name and kept in ForwardedFrom, it is not used for rules
+type Attachment struct {
+	Attachment    parsemail.Attachment
+	EmailFrom     string
+	EmailAddress  string
+	ForwardedFrom string
+}
+
+// AttachmentFilter decides which attachments are saved, reason is returned for skipped ones
+type AttachmentFilter interface {
+	Accept(m *Message, a Attachment) (bool, string)
+}
+
+// SkipReasonExtension - reason of attachments skipped by ExtensionFilter
+const SkipReasonExtension = "extension"
+
+// ExtensionFilter accepts files with these extensions, for example .xls, .xlsx
+type ExtensionFilter []string
+
+// NewExtensionFilter makes filter from comma separated list
+func NewExtensionFilter(List string) ExtensionFilter {
+	var Otvet ExtensionFilter
+	for _, ext := range strings.Split(List, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext != "" {
+			Otvet = append(Otvet, ext)
+		}
+	}
+
+	return Otvet
+}
+
+// Match returns true if extension of Filename is in list
+func (f ExtensionFilter) Match(Filename string) bool {
+	ext := strings.ToLower(filepath.Ext(Filename))
+	for _, v := range f {
+		if v == ext {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f ExtensionFilter) Accept(m *Message, a Attachment) (bool, string) {
+	if f.Match(a.Attachment.Filename) == false {
+		return false, SkipReasonExtension
+	}
+
+	return true, ""
+}
+
+// MessageSender returns prefix of file names From(Name (address)) and address of the first sender
+func MessageSender(email parsemail.Email) (string, string) {
+	PersonalName := ""
+	EmailAddress := ""
+	if len(email.From) > 0 {
+		PersonalName = email.From[0].Name
+		EmailAddress = email.From[0].Address
+	}
+
+	PersonalName = StringFromBase64(PersonalName)
+	PersonalName2 := parsemail.FindFilenameFromAttachment(PersonalName)
+	if PersonalName2 != "" {
+		PersonalName = PersonalName2
+	}
+	PersonalName = strings.TrimSpace(PersonalName)
+
+	return "From(" + PersonalName + " (" + EmailAddress + "))", EmailAddress
+}
+
+// CollectAttachments returns attachments of email and of all forwarded messages inside it,
+// file names of forwarded attachments record inner sender: From(Name (address))_Fwd(Name (address))_file.xlsx
+func CollectAttachments(email parsemail.Email, EmailFrom, EmailAddress string) []Attachment {
+	return collectAttachments(email, EmailFrom, EmailAddress, "")
+}
+
+func collectAttachments(email parsemail.Email, EmailFrom, EmailAddress, ForwardedFrom string) []Attachment {
+	var Otvet []Attachment
+
+	for _, file1 := range email.Attachments {
+		Otvet = append(Otvet, Attachment{Attachment: file1, EmailFrom: EmailFrom, EmailAddress: EmailAddress, ForwardedFrom: ForwardedFrom})
+	}
+
+	for _, email1 := range email.AttachedEmails {
+		InnerName := ""
+		InnerAddress := ""
+		if len(email1.From) > 0 {
+			InnerName = strings.TrimSpace(email1.From[0].Name)
+			InnerAddress = email1.From[0].Address
+		}
+		InnerFrom := EmailFrom + "_Fwd(" + InnerName + " (" + InnerAddress + "))"
+
+		Otvet = append(Otvet, collectAttachments(email1, InnerFrom, EmailAddress, InnerAddress)...)
+	}
+
+	return Otvet
+}
+
+func StringFromBase64(s string) string {
+	Otvet := s
+
+	if len(s) > 10 && s[0:10] == "=?utf-8?B?" {
+		sDec, err := b64.StdEncoding.DecodeString(s[10:])
+		if err != nil {
+			Otvet = string(sDec)
+		}
+	} else if len(s) > 17 && s[0:17] == "=?windows-1251?B?" {
+		s2, err := b64.StdEncoding.DecodeString(s[17:])
+		s2 = parsemail.DecodeWindows1251(s2)
+		if err != nil {
+			Otvet = string(s2)
+		}
+	}
+
+	return Otvet
+}
@@ -0,0 +1,182 @@
+package downloader
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"sort"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// IMAPSource - folder of IMAP server, connection uses TLS
+type IMAPSource struct {
+	Address   string //host:port
+	Username  string
+	Password  string
+	Folder    string //default INBOX
+	TLSConfig *tls.Config
+	// ReadOnly - folder is selected read-only and messages are not marked as seen
+	ReadOnly bool
+
+	client *client.Client
+	key    CheckpointKey
+}
+
+func (s *IMAPSource) folder() string {
+	if s.Folder == "" {
+		return "INBOX"
+	}
+
+	return s.Folder
+}
+
+func (s *IMAPSource) Open(ctx context.Context) (CheckpointKey, error) {
+	if s.client != nil {
+		if err := s.client.Noop(); err == nil {
+			return s.key, nil
+		}
+		s.Close()
+	}
+
+	c, err := client.DialTLS(s.Address, s.TLSConfig)
+	if err != nil {
+		return s.key, err
+	}
+
+	err = c.Login(s.Username, s.Password)
+	if err != nil {
+		c.Logout()
+		return s.key, err
+	}
+
+	Mailbox, err := c.Select(s.folder(), s.ReadOnly)
+	if err != nil {
+		c.Logout()
+		return s.key, err
+	}
+
+	s.client = c
+	s.key = CheckpointKey{Account: s.Username, Folder: s.folder(), UIDValidity: Mailbox.UidValidity}
+
+	return s.key, nil
+}
+
+// searchUIDs returns sorted UIDs from From to To, "From:*" returns the last message even if its UID is less than From
+func (s *IMAPSource) searchUIDs(From, To uint32) ([]uint32, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(From, To)
+	Criteria := imap.NewSearchCriteria()
+	Criteria.Uid = seqset
+
+	Found, err := s.client.UidSearch(Criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	var UIDs []uint32
+	for _, UID := range Found {
+		if UID >= From && (To == 0 || UID <= To) {
+			UIDs = append(UIDs, UID)
+		}
+	}
+	sort.Slice(UIDs, func(i, j int) bool { return UIDs[i] < UIDs[j] })
+
+	return UIDs, nil
+}
+
+func (s *IMAPSource) Fetch(ctx context.Context, From, To uint32, Limit int, fn func(m *Message) error) error {
+	if s.client == nil {
+		return errors.New("imap: source is not opened")
+	}
+	if From == 0 {
+		From = 1
+	}
+
+	UIDs, err := s.searchUIDs(From, To)
+	if err != nil {
+		return err
+	}
+	if Limit > 0 && len(UIDs) > Limit {
+		UIDs = UIDs[:Limit]
+	}
+	if len(UIDs) == 0 {
+		return nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(UIDs...)
+	section := &imap.BodySectionName{Peek: s.ReadOnly}
+	MessageChan := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.client.UidFetch(seqset, []imap.FetchItem{section.FetchItem(), imap.FetchUid, imap.FetchInternalDate}, MessageChan)
+	}()
+
+	//channel is read to the end even after error, otherwise fetch is blocked
+	var fnErr error
+	for RawMessage := range MessageChan {
+		if fnErr != nil {
+			continue
+		}
+		if fnErr = ctx.Err(); fnErr != nil {
+			continue
+		}
+
+		m := &Message{Account: s.key.Account, Folder: s.key.Folder, UID: RawMessage.Uid, SeqNum: RawMessage.SeqNum, InternalDate: RawMessage.InternalDate}
+		if r := RawMessage.GetBody(section); r != nil {
+			m.Raw, _ = io.ReadAll(r)
+		}
+		fnErr = fn(m)
+	}
+
+	err = <-done
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return err
+}
+
+// UID returns UID of message with number SeqNum, or of the last message if there are less messages
+func (s *IMAPSource) UID(ctx context.Context, SeqNum uint32) (uint32, error) {
+	if s.client == nil {
+		return 0, errors.New("imap: source is not opened")
+	}
+
+	Mailbox := s.client.Mailbox()
+	if Mailbox == nil || Mailbox.Messages == 0 {
+		return 0, nil
+	}
+	if SeqNum > Mailbox.Messages {
+		SeqNum = Mailbox.Messages
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(SeqNum)
+	MessageChan := make(chan *imap.Message, 1)
+	err := s.client.Fetch(seqset, []imap.FetchItem{imap.FetchUid}, MessageChan)
+	if err != nil {
+		return 0, err
+	}
+
+	UID := uint32(0)
+	for RawMessage := range MessageChan {
+		UID = RawMessage.Uid
+	}
+
+	return UID, nil
+}
+
+func (s *IMAPSource) Close() error {
+	if s.client == nil {
+		return nil
+	}
+
+	err := s.client.Logout()
+	s.client = nil
+
+	return err
+}
@@ -0,0 +1,100 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// OutputSink - storage where files are saved: local directory, S3, SFTP or WebDAV.
+// Names are relative to sink root, without directories
+type OutputSink interface {
+	// Exists returns true if file with this name is already saved
+	Exists(Name string) (bool, error)
+	// Put saves file atomically, readers never see partially written file.
+	// ModTime is set if storage supports it and time is not zero
+	Put(Name string, Data []byte, ModTime time.Time) error
+	// Location returns full path or URL of file for logs, catalog and hooks
+	Location(Name string) string
+}
+
+// ErrUnsafeName - file with this name can not be saved in sink root
+var ErrUnsafeName = errors.New("unsafe file name")
+
+// CleanName replaces path separators in name of file, so file is saved in sink root and never outside it.
+// Names of attachments come from messages and must be cleaned before they are passed to sink
+func CleanName(Name string) (string, error) {
+	Name = strings.NewReplacer("/", "_", "\\", "_", "\x00", "").Replace(Name)
+	Name = strings.TrimSpace(Name)
+	if Name == "" || Name == "." || Name == ".." {
+		return Name, fmt.Errorf("%w: %q", ErrUnsafeName, Name)
+	}
+
+	return Name, nil
+}
+
+// LocalSink - files are saved in local directory
+type LocalSink struct {
+	Directory string
+}
+
+// NewLocalSink creates sink for directory, "Files" directory is used if it is empty
+func NewLocalSink(Directory string) (*LocalSink, error) {
+	if Directory == "" {
+		Directory = "Files"
+	}
+
+	err := os.MkdirAll(Directory, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalSink{Directory: Directory}, nil
+}
+
+func (s *LocalSink) Location(Name string) string {
+	return filepath.Join(s.Directory, Name)
+}
+
+func (s *LocalSink) Exists(Name string) (bool, error) {
+	_, err := os.Stat(s.Location(Name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Put writes temporary file, syncs it to disk and renames it
+func (s *LocalSink) Put(Name string, Data []byte, ModTime time.Time) error {
+	f, err := os.CreateTemp(s.Directory, ".tmp_*")
+	if err != nil {
+		return err
+	}
+	TempName := f.Name()
+
+	_, err = f.Write(Data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(TempName, 0644)
+	}
+	if err == nil && ModTime.IsZero() == false {
+		err = os.Chtimes(TempName, ModTime, ModTime)
+	}
+	if err == nil {
+		err = os.Rename(TempName, s.Location(Name))
+	}
+	if err != nil {
+		_ = os.Remove(TempName)
+	}
+
+	return err
+}
@@ -0,0 +1,31 @@
+package downloader
+
+import (
+	"context"
+	"time"
+)
+
+// Message - message fetched from mail source
+type Message struct {
+	Account      string
+	Folder       string
+	UID          uint32
+	SeqNum       uint32 //number of message in folder, 0 if source has no numbers
+	InternalDate time.Time
+	Raw          []byte //nil if source did not return message body
+	// Reprocessed - message is fetched again by Reprocess, checkpoint is not changed
+	Reprocessed bool
+}
+
+// MailSource - folder of IMAP server, POP3 mailbox or directory with .eml files.
+// Messages are identified by UID, new messages have bigger UIDs than old ones
+type MailSource interface {
+	// Open connects to server and selects folder, returns checkpoint key of folder.
+	// It is called before every sync, opened source should only check its connection
+	Open(ctx context.Context) (CheckpointKey, error)
+	// Fetch calls fn for messages with UID from From to To (0 - no limit) in UID order,
+	// not more than Limit messages (0 - no limit). Error of fn stops fetching and is returned
+	Fetch(ctx context.Context, From, To uint32, Limit int, fn func(m *Message) error) error
+	// Close disconnects from server, source can be opened again
+	Close() error
+}
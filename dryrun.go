@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+)
+
+// DryRun - messages are fetched and filtered as usual, but nothing is written: files, checkpoint, catalog,
+// dead-letter list; hooks and webhooks are not run, messages are not marked as seen.
+// Report of messages and files is written to DryRunOutput
+var DryRun bool
+
+var DryRunOutput io.Writer = os.Stdout
+
+// DryRunSink - output sink which only reports files, Exists and Location are taken from real sink
+// so target paths and duplicates are the same as in normal run
+type DryRunSink struct {
+	Sink OutputSink
+}
+
+func (s *DryRunSink) Exists(Name string) (bool, error) {
+	return s.Sink.Exists(Name)
+}
+
+func (s *DryRunSink) Put(Name string, Data []byte, ModTime time.Time) error {
+	fmt.Fprintf(DryRunOutput, "  save  %s (%d bytes)\n", s.Sink.Location(Name), len(Data))
+	return nil
+}
+
+func (s *DryRunSink) Location(Name string) string {
+	return s.Sink.Location(Name)
+}
+
+// ReportMessage writes message and what is done with it: process, skip or fail with reason
+func ReportMessage(Metadata FileMetadata, Action, Reason string) {
+	if DryRun == false {
+		return
+	}
+
+	if Reason != "" {
+		Action = Action + ": " + Reason
+	}
+	fmt.Fprintf(DryRunOutput, "message uid=%d date=%s from=%s subject=%q: %s\n", Metadata.UID,
+		Metadata.Date.Format("2006-01-02 15:04:05"), Metadata.From, Metadata.Subject, Action)
+}
+
+// ReportSkippedFile writes attachment which is not saved and reason
+func ReportSkippedFile(Filename, Reason string) {
+	if DryRun == false {
+		return
+	}
+
+	fmt.Fprintf(DryRunOutput, "  skip  %s: %s\n", Filename, Reason)
+}
+
+// dryRunCheckpoints - checkpoint is read from store or starts at UID From, it is not saved
+type dryRunCheckpoints struct {
+	Store downloader.CheckpointStore
+	From  uint32
+}
+
+func (s *dryRunCheckpoints) Load(ctx context.Context, Key downloader.CheckpointKey) (uint32, error) {
+	if s.From > 0 {
+		return s.From - 1, nil
+	}
+
+	return s.Store.Load(ctx, Key)
+}
+
+func (s *dryRunCheckpoints) Save(ctx context.Context, Key downloader.CheckpointKey, UID uint32) error {
+	return nil
+}
+
+// RunDryRunCommand - command line: dry-run [-from UID], messages from UID (default checkpoint+1) to the last one are checked
+func RunDryRunCommand(Args []string) error {
+	fs := flag.NewFlagSet("dry-run", flag.ContinueOnError)
+	From := fs.Uint("from", 0, "UID of the first message, default checkpoint+1")
+	err := fs.Parse(Args)
+	if err != nil {
+		return err
+	}
+
+	DryRun = true
+	Sink = &DryRunSink{Sink: Sink}
+
+	//folder is selected read-only, messages are not marked as seen
+	Source, err := NewMailSource(true)
+	if err != nil {
+		return err
+	}
+	Store, err := NewCheckpointStore(Source)
+	if err != nil {
+		return err
+	}
+	defer Store.Close()
+	Checkpoints := &dryRunCheckpoints{Store: Store, From: uint32(*From)}
+
+	MailDownloader, err = NewDownloader(Source, Checkpoints)
+	if err != nil {
+		return err
+	}
+	defer MailDownloader.Close()
+
+	_, err = MailDownloader.RunOnce(context.Background())
+	return err
+}
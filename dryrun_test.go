@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"DownloadEmailsAttachments/downloader"
+)
+
+func TestDryRun(t *testing.T) {
+	Directory := filepath.Join(t.TempDir(), "Files")
+	myEnv = map[string]string{"EMAIL": "buh@example.com", "FileExtensions": ".csv", "HookMessageCommand": "exit 1"}
+
+	DryRun = true
+	defer func() { DryRun = false }()
+	var Report bytes.Buffer
+	DryRunOutput = &Report
+	defer func() { DryRunOutput = os.Stdout }()
+
+	LocalSink, err := NewLocalSink(Directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Sink = &DryRunSink{Sink: LocalSink}
+
+	Raw := "From: Supplier <price@supplier.ru>\r\n" +
+		"To: buh@example.com\r\n" +
+		"Subject: Price\r\n" +
+		"Message-ID: <1@supplier.ru>\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Price list attached\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/csv; name=\"price.csv\"\r\n" +
+		"Content-Disposition: attachment; filename=\"price.csv\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aXRlbTtwcmljZQ==\r\n" +
+		"--b1\r\n" +
+		"Content-Type: image/png; name=\"logo.png\"\r\n" +
+		"Content-Disposition: attachment; filename=\"logo.png\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0KGgo=\r\n" +
+		"--b1--\r\n"
+
+	Options, err := NewProcessOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ProcessMessage(&downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 1, UID: 101, Raw: []byte(Raw)}, Options)
+
+	Expected := []string{
+		`message uid=101 date=2021-03-01 10:00:00 from=price@supplier.ru subject="Price": process`,
+		"  save  " + filepath.Join(Directory, "From(Supplier (price@supplier.ru))_price.csv") + " (10 bytes)",
+		"  skip  logo.png: extension",
+	}
+	for _, Line := range Expected {
+		if strings.Contains(Report.String(), Line+"\n") == false {
+			t.Errorf("Line is not in report: %s\n%s", Line, Report.String())
+		}
+	}
+
+	if _, err = os.Stat(Directory); os.IsNotExist(err) == false {
+		t.Errorf("Output directory is created in dry-run")
+	}
+	if myEnv["LastEmailUID"] != "" {
+		t.Errorf("LastEmailUID is changed in dry-run: %s", myEnv["LastEmailUID"])
+	}
+}
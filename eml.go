@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SaveEml setting values
+const (
+	SaveEmlOff             = ""
+	SaveEmlWithAttachments = "with_attachments" //save .eml of messages with matching attachments, alongside attachments
+	SaveEmlInstead         = "instead"          //save .eml of messages with matching attachments, attachments are not saved
+	SaveEmlAll             = "all"              //save .eml of every message
+)
+
+// SaveEmlFile saves raw RFC 5322 message as From(Name (address))_Subject_UID.eml, gzip compressed if SaveEmlCompress=true.
+// Existing file is handled by DuplicateFiles setting as attachments, error is returned if file is not saved
+func SaveEmlFile(EmailFrom, Subject, sMessageId string, RawBytes []byte, ModTime time.Time) error {
+	Filename := SafeFilename(Subject)
+	if Filename == "" {
+		Filename = "message"
+	}
+	FilenameNew := EmailFrom + "_" + Filename + "_" + sMessageId + ".eml"
+
+	if myEnv["SaveEmlCompress"] != "true" {
+		return saveMessageFile(FilenameNew, RawBytes, ModTime)
+	}
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Name = Filename + ".eml"
+	_, _ = gz.Write(RawBytes)
+	_ = gz.Close()
+
+	return saveMessageFile(FilenameNew+".gz", b.Bytes(), ModTime)
+}
+
+// saveMessageFile saves .eml or body file, file already saved before retry is not an error
+func saveMessageFile(Name string, massBytes []byte, ModTime time.Time) error {
+	_, err := SaveFileWithTime(Name, massBytes, ModTime)
+	if err != nil && err != ErrDuplicateFile {
+		return fmt.Errorf("can not save %s: %w", Name, err)
+	}
+
+	return nil
+}
+
+// SafeFilename replaces symbols which can not be used in windows file names
+func SafeFilename(s string) string {
+	Replacer := strings.NewReplacer("\\", "_", "/", "_", ":", "_", "*", "_", "?", "_", "\"", "", "<", "_", ">", "_", "|", "_", "\t", " ", "\r", "", "\n", "")
+	s = Replacer.Replace(s)
+	s = strings.TrimSpace(s)
+
+	Runes := []rune(s)
+	if len(Runes) > 100 {
+		s = string(Runes[:100])
+	}
+
+	return s
+}
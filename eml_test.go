@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+)
+
+func TestSaveEmlFile(t *testing.T) {
+	Root := t.TempDir()
+	defer func(s OutputSink) { Sink = s }(Sink)
+	var err error
+	Sink, err = NewLocalSink(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Raw := []byte("From: price@supplier.ru\r\nSubject: Price\r\n\r\nHello\r\n")
+	ModTime := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	myEnv = map[string]string{}
+	if err = SaveEmlFile("From(Supplier (price@supplier.ru))", "Price: March", "109", Raw, ModTime); err != nil {
+		t.Fatal(err)
+	}
+	Filename := filepath.Join(Root, "From(Supplier (price@supplier.ru))_Price_ March_109.eml")
+	Data, err := ioutil.ReadFile(Filename)
+	if err != nil || bytes.Equal(Data, Raw) == false {
+		t.Errorf("Wrong eml file: %q %v", Data, err)
+	}
+	if Info, err := os.Stat(Filename); err != nil || Info.ModTime().Equal(ModTime) == false {
+		t.Errorf("Wrong modification time: %v", err)
+	}
+
+	myEnv = map[string]string{"SaveEmlCompress": "true"}
+	if err = SaveEmlFile("price@supplier.ru", "", "110", Raw, ModTime); err != nil {
+		t.Fatal(err)
+	}
+	Data, err = ioutil.ReadFile(filepath.Join(Root, "price@supplier.ru_message_110.eml.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Data, err = ioutil.ReadAll(gz)
+	if err != nil || bytes.Equal(Data, Raw) == false || gz.Name != "message.eml" {
+		t.Errorf("Wrong eml.gz file: %q %q %v", gz.Name, Data, err)
+	}
+
+	//file saved before retry
+	myEnv = map[string]string{"DuplicateFiles": DuplicateSkip}
+	if err = SaveEmlFile("price@supplier.ru", "", "110", Raw, ModTime); err != nil {
+		t.Errorf("Error for existing file: %v", err)
+	}
+
+	Sink = failingSink{}
+	if err = SaveEmlFile("price@supplier.ru", "", "111", Raw, ModTime); err == nil {
+		t.Errorf("Error of sink is not returned")
+	}
+}
+
+func TestSaveEmlFor(t *testing.T) {
+	Options := ProcessOptions{SaveEml: SaveEmlWithAttachments, SaveEmlRules: "price@supplier.ru:instead, @supplier.ru:all,@bank.ru:"}
+
+	var testData = []struct {
+		EmailAddress string
+		SaveEml      string
+	}{
+		{"price@supplier.ru", SaveEmlInstead},
+		{"Price@Supplier.ru", SaveEmlInstead},
+		{"buh@supplier.ru", SaveEmlAll},
+		{"buh@bank.ru", SaveEmlOff},
+		{"buh@unknown.ru", SaveEmlWithAttachments},
+		{"", SaveEmlWithAttachments},
+	}
+
+	for i, Test := range testData {
+		if SaveEml := Options.SaveEmlFor(Test.EmailAddress); SaveEml != Test.SaveEml {
+			t.Errorf("[Test Case %v] Wrong SaveEml. Expected: %q, Got: %q", i+1, Test.SaveEml, SaveEml)
+		}
+	}
+}
+
+func TestProcessMessageSaveEmlRule(t *testing.T) {
+	Root := t.TempDir()
+	myEnv = map[string]string{"EMAIL": "buh@example.com", "FileExtensions": ".xlsx", "SaveEmlRules": "@supplier.ru:instead",
+		"DeadLetterFile": filepath.Join(Root, "DeadLetters.json")}
+	err := LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(s OutputSink) { Sink = s }(Sink)
+	Sink, err = NewLocalSink(filepath.Join(Root, "Files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Raw := "From: Supplier <price@supplier.ru>\r\n" +
+		"Subject: Price\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream; name=\"price.xlsx\"\r\n" +
+		"Content-Disposition: attachment; filename=\"price.xlsx\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aXRlbTtwcmljZQ==\r\n" +
+		"--b1--\r\n"
+	Options, err := NewProcessOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Message := &downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 1, UID: 109, Raw: []byte(Raw)}
+	if err = ProcessMessage(Message, Options); err != nil {
+		t.Fatal(err)
+	}
+
+	//only .eml is saved, named by UID
+	Files, _ := filepath.Glob(filepath.Join(Root, "Files", "*"))
+	if len(Files) != 1 || filepath.Base(Files[0]) != "From(Supplier (price@supplier.ru))_Price_109.eml" {
+		t.Errorf("Wrong saved files: %v", Files)
+	}
+}
+
+func TestProcessMessageSaveEmlFailed(t *testing.T) {
+	defer func(s OutputSink) { Sink = s }(Sink)
+	Sink = failingSink{}
+	myEnv = map[string]string{"EMAIL": "buh@example.com", "FileExtensions": ".xlsx", "SaveEml": SaveEmlInstead,
+		"DeadLetterFile": filepath.Join(t.TempDir(), "DeadLetters.json")}
+	err := LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Options, err := NewProcessOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//attachments are not saved with SaveEml=instead, so message is retried when .eml is not saved
+	Raw := "From: Supplier <price@supplier.ru>\r\n" +
+		"Subject: Price\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream; name=\"price.xlsx\"\r\n" +
+		"Content-Disposition: attachment; filename=\"price.xlsx\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aXRlbTtwcmljZQ==\r\n" +
+		"--b1--\r\n"
+	err = ProcessMessage(&downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 1, UID: 112, Raw: []byte(Raw)}, Options)
+	var MsgError *MessageError
+	if errors.As(err, &MsgError) == false || MsgError.Stage != StageAttachment {
+		t.Errorf("Save error is not returned: %v", err)
+	}
+	if List := DeadLetters.List(); len(List) != 1 || List[0].UID != 112 {
+		t.Errorf("Message is not in dead-letter list: %+v", List)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// HookFailurePolicy setting values, what to do when hook command returns non-zero exit code
+const (
+	HookPolicyIgnore = "ignore" //only write to log (default)
+	HookPolicyRetry  = "retry"  //run again HookRetries times, then save in dead-letter list and run again later
+	HookPolicyFail   = "fail"   //mark file or message as hook_failed in catalog, hook is not run again
+)
+
+// hook types of FailedHook
+const (
+	HookTypeFile    = "file"
+	HookTypeMessage = "message"
+)
+
+// FailedHook - hook failed with HookFailurePolicy retry, it is saved in dead-letter list and run again later
+// without processing of message, so files are not saved again
+type FailedHook struct {
+	Type     string       `json:"type"`
+	Path     string       `json:"path,omitempty"`  //location of saved file for HookFileCommand
+	Files    []string     `json:"files,omitempty"` //locations of saved files for HookMessageCommand
+	Metadata FileMetadata `json:"metadata"`
+}
+
+// HookError - hook failed and HookFailurePolicy is retry or fail.
+// Hook is set only with retry policy
+type HookError struct {
+	Command string
+	Err     error
+	Hook    *FailedHook
+}
+
+func (e *HookError) Error() string {
+	return "hook " + e.Command + " failed: " + e.Err.Error()
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// FileHookData - JSON on stdin of HookFileCommand
+type FileHookData struct {
+	Path string `json:"path"`
+	FileMetadata
+}
+
+// MessageHookData - JSON on stdin of HookMessageCommand
+type MessageHookData struct {
+	FileMetadata
+	Files []string `json:"files"`
+}
+
+// RunFileHook runs HookFileCommand after attachment is saved.
+// Returns *HookError only if hook failed and HookFailurePolicy is not ignore
+func RunFileHook(Path string, Metadata FileMetadata) error {
+	Command := myEnv["HookFileCommand"]
+	if Command == "" {
+		return nil
+	}
+
+	Env := hookEnv(Metadata)
+	Env = append(Env, "DEA_FILE_PATH="+Path)
+
+	Hook := FailedHook{Type: HookTypeFile, Path: Path, Metadata: Metadata}
+	return runHookWithPolicy(Command, Env, FileHookData{Path: Path, FileMetadata: Metadata}, Hook)
+}
+
+// RunMessageHook runs HookMessageCommand after message is processed.
+// Returns *HookError only if hook failed and HookFailurePolicy is not ignore
+func RunMessageHook(Metadata FileMetadata, Files []string) error {
+	Command := myEnv["HookMessageCommand"]
+	if Command == "" {
+		return nil
+	}
+
+	Env := hookEnv(Metadata)
+	Env = append(Env, "DEA_FILES_COUNT="+strconv.Itoa(len(Files)))
+	if Files == nil {
+		Files = []string{}
+	}
+
+	Hook := FailedHook{Type: HookTypeMessage, Files: Files, Metadata: Metadata}
+	return runHookWithPolicy(Command, Env, MessageHookData{FileMetadata: Metadata, Files: Files}, Hook)
+}
+
+// RunFailedHooks runs hooks from dead-letter list again, file status in catalog is changed to saved.
+// Hooks which failed again are returned with their errors
+func RunFailedHooks(Hooks []FailedHook) ([]FailedHook, error) {
+	var Failed []FailedHook
+	var Errors []error
+	for _, Hook := range Hooks {
+		var err error
+		if Hook.Type == HookTypeMessage {
+			err = RunMessageHook(Hook.Metadata, Hook.Files)
+		} else {
+			err = RunFileHook(Hook.Path, Hook.Metadata)
+		}
+		if err != nil {
+			Failed = append(Failed, Hook)
+			Errors = append(Errors, err)
+			continue
+		}
+
+		if Hook.Type == HookTypeFile {
+			CatalogSetFileStatus(Hook.Metadata, Hook.Path, FileStatusSaved, nil)
+		}
+	}
+
+	return Failed, errors.Join(Errors...)
+}
+
+// failedHooks returns hooks which must be run again from errors of hooks
+func failedHooks(err error) []FailedHook {
+	if err == nil {
+		return nil
+	}
+	if Joined, ok := err.(interface{ Unwrap() []error }); ok == true {
+		var Otvet []FailedHook
+		for _, err1 := range Joined.Unwrap() {
+			Otvet = append(Otvet, failedHooks(err1)...)
+		}
+		return Otvet
+	}
+
+	var HookErr *HookError
+	if errors.As(err, &HookErr) && HookErr.Hook != nil {
+		return []FailedHook{*HookErr.Hook}
+	}
+
+	return nil
+}
+
+func hookEnv(Metadata FileMetadata) []string {
+	Env := os.Environ()
+	Env = append(Env,
+		"DEA_FROM="+Metadata.From,
+		"DEA_SUBJECT="+Metadata.Subject,
+		"DEA_DATE="+Metadata.Date.Format(time.RFC3339),
+		"DEA_MESSAGE_ID="+Metadata.MessageID,
+		"DEA_UID="+strconv.FormatUint(uint64(Metadata.UID), 10),
+		"DEA_FOLDER="+Metadata.Folder,
+		"DEA_ACCOUNT="+Metadata.Account,
+		"DEA_ORIGINAL_FILENAME="+Metadata.OriginalFilename,
+		"DEA_CONTENT_TYPE="+Metadata.ContentType,
+		"DEA_SIZE="+strconv.Itoa(Metadata.Size),
+		"DEA_SHA256="+Metadata.SHA256,
+	)
+
+	return Env
+}
+
+func runHookWithPolicy(Command string, Env []string, Data interface{}, Hook FailedHook) error {
+	if DryRun == true {
+		return nil
+	}
+
+	Stdin, err := json.Marshal(Data)
+	if err != nil {
+		return err
+	}
+
+	Policy := myEnv["HookFailurePolicy"]
+
+	Retries := 0
+	if Policy == HookPolicyRetry {
+		Retries = 3
+		if s := myEnv["HookRetries"]; s != "" {
+			n, err := strconv.Atoi(s)
+			if err == nil {
+				Retries = n
+			}
+		}
+	}
+
+	for i := 0; ; i++ {
+		err = RunHook(Command, Env, Stdin)
+		if err == nil {
+			return nil
+		}
+
+		slog.Error("Hook failed", "command", Command, "error", err)
+		if i >= Retries {
+			break
+		}
+		time.Sleep(time.Second * time.Duration(i+1))
+	}
+
+	if Policy == HookPolicyRetry {
+		return &HookError{Command: Command, Err: err, Hook: &Hook}
+	} else if Policy == HookPolicyFail {
+		return &HookError{Command: Command, Err: err}
+	}
+
+	return nil
+}
+
+// RunHook runs command through shell with JSON on stdin and HookTimeoutSeconds timeout, output is written to log
+func RunHook(Command string, Env []string, Stdin []byte) error {
+	TimeoutSeconds := 60
+	if s := myEnv["HookTimeoutSeconds"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err == nil {
+			TimeoutSeconds = n
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(TimeoutSeconds))
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", Command)
+	}
+	cmd.Env = Env
+	cmd.WaitDelay = time.Second //do not wait for child processes which keep output open after timeout
+	cmd.Stdin = bytes.NewReader(Stdin)
+
+	Output, err := cmd.CombinedOutput()
+	if len(Output) > 0 {
+		slog.Debug("Hook output", "command", Command, "output", string(bytes.TrimSpace(Output)))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("timeout " + strconv.Itoa(TimeoutSeconds) + " seconds")
+	}
+
+	return err
+}
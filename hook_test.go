@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"DownloadEmailsAttachments/downloader"
+)
+
+// hookStub writes shell script which saves stdin and DEA_UID to files in Directory
+// and exits with code from file exitcode, so test can change result between runs
+func hookStub(t *testing.T, Directory string, ExitCode string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell stub needs sh")
+	}
+
+	Script := filepath.Join(Directory, "hook.sh")
+	Data := "#!/bin/sh\n" +
+		"cat > \"" + Directory + "/stdin.json\"\n" +
+		"echo \"$DEA_UID\" >> \"" + Directory + "/runs.txt\"\n" +
+		"exit $(cat \"" + Directory + "/exitcode\")\n"
+	err := ioutil.WriteFile(Script, []byte(Data), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(Directory, "exitcode"), []byte(ExitCode), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Script
+}
+
+func hookRuns(Directory string) []string {
+	Data, _ := ioutil.ReadFile(filepath.Join(Directory, "runs.txt"))
+	return strings.Fields(string(Data))
+}
+
+func TestRunFileHook(t *testing.T) {
+	Directory := t.TempDir()
+	Script := hookStub(t, Directory, "0")
+	Metadata := FileMetadata{UID: 42, From: "price@supplier.ru", OriginalFilename: "price.xlsx"}
+
+	myEnv = map[string]string{"HookFileCommand": Script}
+	err := RunFileHook("Files/price.xlsx", Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var Received FileHookData
+	Data, _ := ioutil.ReadFile(filepath.Join(Directory, "stdin.json"))
+	err = json.Unmarshal(Data, &Received)
+	if err != nil || Received.Path != "Files/price.xlsx" || Received.From != "price@supplier.ru" {
+		t.Errorf("Wrong stdin of hook: %s %v", Data, err)
+	}
+	if Runs := hookRuns(Directory); len(Runs) != 1 || Runs[0] != "42" {
+		t.Errorf("Wrong DEA_UID: %v", Runs)
+	}
+}
+
+func TestRunHookPolicy(t *testing.T) {
+	var testData = []struct {
+		Policy string
+		Runs   int
+		Error  bool
+	}{
+		{"", 1, false},
+		{HookPolicyIgnore, 1, false},
+		{HookPolicyFail, 1, true},
+		{HookPolicyRetry, 2, true},
+	}
+
+	for i, Test := range testData {
+		Directory := t.TempDir()
+		Script := hookStub(t, Directory, "1")
+		myEnv = map[string]string{"HookMessageCommand": Script, "HookFailurePolicy": Test.Policy, "HookRetries": "1"}
+
+		err := RunMessageHook(FileMetadata{UID: 7}, nil)
+		var HookErr *HookError
+		if errors.As(err, &HookErr) != Test.Error {
+			t.Errorf("[Test Case %v] Wrong error: %v", i+1, err)
+		}
+		if Runs := hookRuns(Directory); len(Runs) != Test.Runs {
+			t.Errorf("[Test Case %v] Wrong runs count. Expected: %v, Got: %v", i+1, Test.Runs, len(Runs))
+		}
+	}
+}
+
+// hookTestMessage - message with one .xlsx attachment
+const hookTestMessage = "From: Supplier <price@supplier.ru>\r\n" +
+	"Subject: Price\r\n" +
+	"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/octet-stream; name=\"price.xlsx\"\r\n" +
+	"Content-Disposition: attachment; filename=\"price.xlsx\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"aXRlbTtwcmljZQ==\r\n" +
+	"--b1--\r\n"
+
+// setupHookTest creates hook stub, sink, catalog and dead-letter list in temporary directory
+func setupHookTest(t *testing.T, Settings map[string]string) (Root, Directory string) {
+	Root = t.TempDir()
+	Directory = filepath.Join(Root, "Hook")
+	if err := os.Mkdir(Directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	Script := hookStub(t, Directory, "1")
+	myEnv = map[string]string{"EMAIL": "buh@example.com", "FileExtensions": ".xlsx", "HookFileCommand": Script,
+		"DeadLetterFile": filepath.Join(Root, "DeadLetters.json"), "CatalogFile": filepath.Join(Root, "catalog.db")}
+	for Name, Value := range Settings {
+		myEnv[Name] = Value
+	}
+	err := LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = OpenCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Saved := Sink
+	Sink, err = NewLocalSink(filepath.Join(Root, "Files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Sink = Saved
+		Catalog.Close()
+		Catalog = nil
+	})
+
+	return Root, Directory
+}
+
+func catalogFileStatus(t *testing.T) string {
+	var Status string
+	err := Catalog.QueryRow("SELECT status FROM files WHERE uid = 109 ORDER BY id DESC").Scan(&Status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Status
+}
+
+func TestProcessMessageHookFailed(t *testing.T) {
+	Root, Directory := setupHookTest(t, map[string]string{"HookFailurePolicy": HookPolicyFail})
+	Options, err := NewProcessOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Message := &downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 1, UID: 109, Raw: []byte(hookTestMessage)}
+
+	//file is saved and marked hook_failed, message is not retried
+	if err = ProcessMessage(Message, Options); err != nil {
+		t.Errorf("Error is returned with fail policy: %v", err)
+	}
+	Files, _ := filepath.Glob(filepath.Join(Root, "Files", "*price.xlsx"))
+	if len(Files) != 1 {
+		t.Errorf("File is not saved: %v", Files)
+	}
+	if Status := catalogFileStatus(t); Status != FileStatusHookFailed {
+		t.Errorf("Wrong file status: %s", Status)
+	}
+	if List := DeadLetters.List(); len(List) != 0 {
+		t.Errorf("Message is in dead-letter list: %+v", List)
+	}
+	if Runs := hookRuns(Directory); len(Runs) != 1 {
+		t.Errorf("Wrong runs count. Expected: %v, Got: %v", 1, len(Runs))
+	}
+}
+
+func TestRetryFailedHooks(t *testing.T) {
+	for _, Policy := range []string{DuplicateSkip, DuplicateRename} {
+		t.Run(Policy, func(t *testing.T) { testRetryFailedHooks(t, Policy) })
+	}
+}
+
+// testRetryFailedHooks - file hook is run again from dead-letter list, file is not saved again with DuplicateFiles Policy
+func testRetryFailedHooks(t *testing.T, Policy string) {
+	Root, Directory := setupHookTest(t, map[string]string{"HookFailurePolicy": HookPolicyRetry, "HookRetries": "0",
+		"DuplicateFiles": Policy})
+	Options, err := NewProcessOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Message := &downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 1, UID: 109, Raw: []byte(hookTestMessage)}
+
+	//file is saved, hook is saved in dead-letter list
+	err = ProcessMessage(Message, Options)
+	var MsgError *MessageError
+	if errors.As(err, &MsgError) == false || MsgError.Stage != StageHook {
+		t.Errorf("[%s] Hook error is not returned: %v", Policy, err)
+	}
+	List := DeadLetters.List()
+	if len(List) != 1 || List[0].Stage != StageHook || len(List[0].Hooks) != 1 || List[0].Hooks[0].Type != HookTypeFile {
+		t.Fatalf("[%s] Hook is not in dead-letter list: %+v", Policy, List)
+	}
+
+	//hook fails again, message is not fetched again (downloader is not created)
+	if err = retryFailedMessages(context.Background(), downloader.CheckpointKey{Account: "buh@example.com", Folder: MailboxName}, true); err != nil {
+		t.Fatalf("[%s] %v", Policy, err)
+	}
+	if List = DeadLetters.List(); len(List) != 1 || List[0].Attempts != 2 || len(List[0].Hooks) != 1 {
+		t.Fatalf("[%s] Wrong dead-letter list: %+v", Policy, List)
+	}
+
+	//hook works again, only hook is run
+	err = ioutil.WriteFile(filepath.Join(Directory, "exitcode"), []byte("0"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = retryFailedMessages(context.Background(), downloader.CheckpointKey{Account: "buh@example.com", Folder: MailboxName}, true); err != nil {
+		t.Fatalf("[%s] %v", Policy, err)
+	}
+	if List = DeadLetters.List(); len(List) != 0 {
+		t.Errorf("[%s] Message is not removed from dead-letter list: %+v", Policy, List)
+	}
+	if Runs := hookRuns(Directory); len(Runs) != 3 {
+		t.Errorf("[%s] Wrong runs count. Expected: %v, Got: %v", Policy, 3, len(Runs))
+	}
+	Files, _ := filepath.Glob(filepath.Join(Root, "Files", "*"))
+	if len(Files) != 1 {
+		t.Errorf("[%s] File is saved again: %v", Policy, Files)
+	}
+	if Status := catalogFileStatus(t); Status != FileStatusSaved {
+		t.Errorf("[%s] Wrong file status: %s", Policy, Status)
+	}
+	var Status string
+	Catalog.QueryRow("SELECT status FROM messages WHERE uid = 109").Scan(&Status)
+	if Status != MessageStatusProcessed {
+		t.Errorf("[%s] Wrong message status: %s", Policy, Status)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// SetupLogging configures default logger from settings:
+// LogLevel - debug, info (default), warn, error; LogFormat - text (key=value, default) or json;
+// LogFile - file name, empty - stdout. File is rotated when it is bigger than LogMaxSizeMB (default 100),
+// old files are deleted after LogMaxAgeDays (default 30) or when there are more than LogMaxBackups (default 10).
+// Values of password, secret and token settings are replaced with *** in all records
+func SetupLogging() {
+	var Output io.Writer = os.Stdout
+	if myEnv["LogFile"] != "" {
+		Output = &lumberjack.Logger{
+			Filename:   myEnv["LogFile"],
+			MaxSize:    settingInt("LogMaxSizeMB", 100),
+			MaxAge:     settingInt("LogMaxAgeDays", 30),
+			MaxBackups: settingInt("LogMaxBackups", 10),
+			LocalTime:  true,
+		}
+	}
+
+	Level := slog.LevelInfo
+	switch strings.ToLower(myEnv["LogLevel"]) {
+	case "debug":
+		Level = slog.LevelDebug
+	case "warn":
+		Level = slog.LevelWarn
+	case "error":
+		Level = slog.LevelError
+	}
+
+	var Handler slog.Handler
+	Options := &slog.HandlerOptions{Level: Level}
+	if myEnv["LogFormat"] == "json" {
+		Handler = slog.NewJSONHandler(Output, Options)
+	} else {
+		Handler = slog.NewTextHandler(Output, Options)
+	}
+
+	slog.SetDefault(slog.New(NewRedactHandler(Handler, SecretValues())))
+}
+
+func settingInt(Name string, Default int) int {
+	n, err := strconv.Atoi(myEnv[Name])
+	if err != nil || n <= 0 {
+		return Default
+	}
+
+	return n
+}
+
+// MessageLogger returns logger with fields of message: account, folder, uid, message_id
+func MessageLogger(Metadata FileMetadata) *slog.Logger {
+	return slog.With("account", Metadata.Account, "folder", Metadata.Folder, "uid", Metadata.UID, "message_id", Metadata.MessageID)
+}
+
+// Fatal logs error and stops program
+func Fatal(Message string, Args ...any) {
+	slog.Error(Message, Args...)
+	os.Exit(1)
+}
+
+// isSecretName - settings and log fields with these words in name are never logged
+func isSecretName(Name string) bool {
+	Name = strings.ToLower(Name)
+	for _, Word := range []string{"password", "secret", "token", "passphrase"} {
+		if strings.Contains(Name, Word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SecretValues returns values of secret settings and passwords from ArchivePasswords.
+// Values shorter than 4 symbols are not returned, otherwise every log record would be damaged
+func SecretValues() []string {
+	var Otvet []string
+	for Name, Value := range myEnv {
+		if isSecretName(Name) == false {
+			continue
+		}
+		if Name == "ArchivePasswords" {
+			for _, Pair := range strings.Split(Value, ",") {
+				if pos1 := strings.Index(Pair, ":"); pos1 > 0 {
+					Otvet = append(Otvet, Pair[pos1+1:])
+				}
+			}
+			continue
+		}
+		Otvet = append(Otvet, Value)
+	}
+
+	Secrets := Otvet[:0]
+	for _, Secret := range Otvet {
+		if len(Secret) >= 4 {
+			Secrets = append(Secrets, Secret)
+		}
+	}
+
+	return Secrets
+}
+
+// RedactHandler replaces secret values in messages and fields and values of fields with secret names
+type RedactHandler struct {
+	Handler slog.Handler
+	Secrets []string
+}
+
+func NewRedactHandler(Handler slog.Handler, Secrets []string) *RedactHandler {
+	return &RedactHandler{Handler: Handler, Secrets: Secrets}
+}
+
+func (h *RedactHandler) Enabled(ctx context.Context, Level slog.Level) bool {
+	return h.Handler.Enabled(ctx, Level)
+}
+
+func (h *RedactHandler) Handle(ctx context.Context, r slog.Record) error {
+	Record := slog.NewRecord(r.Time, r.Level, h.redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		Record.AddAttrs(h.redactAttr(a))
+		return true
+	})
+
+	return h.Handler.Handle(ctx, Record)
+}
+
+func (h *RedactHandler) WithAttrs(Attrs []slog.Attr) slog.Handler {
+	Redacted := make([]slog.Attr, 0, len(Attrs))
+	for _, a := range Attrs {
+		Redacted = append(Redacted, h.redactAttr(a))
+	}
+
+	return &RedactHandler{Handler: h.Handler.WithAttrs(Redacted), Secrets: h.Secrets}
+}
+
+func (h *RedactHandler) WithGroup(Name string) slog.Handler {
+	return &RedactHandler{Handler: h.Handler.WithGroup(Name), Secrets: h.Secrets}
+}
+
+func (h *RedactHandler) redact(s string) string {
+	for _, Secret := range h.Secrets {
+		s = strings.ReplaceAll(s, Secret, "***")
+	}
+
+	return s
+}
+
+func (h *RedactHandler) redactAttr(a slog.Attr) slog.Attr {
+	if isSecretName(a.Key) {
+		return slog.String(a.Key, "***")
+	}
+
+	Value := a.Value.Resolve()
+	switch Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, h.redact(Value.String()))
+	case slog.KindGroup:
+		var Attrs []any
+		for _, a1 := range Value.Group() {
+			Attrs = append(Attrs, h.redactAttr(a1))
+		}
+		return slog.Group(a.Key, Attrs...)
+	case slog.KindAny:
+		if err, ok := Value.Any().(error); ok == true {
+			return slog.String(a.Key, h.redact(err.Error()))
+		}
+	}
+
+	return slog.Attr{Key: a.Key, Value: Value}
+}
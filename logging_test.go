@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactHandler(t *testing.T) {
+	myEnv = map[string]string{
+		"EMAIL":            "buh@example.com",
+		"PASSWORD":         "imap-secret-1",
+		"S3_SECRET_KEY":    "s3-secret-2",
+		"ArchivePasswords": "supplier@mail.ru:zip-secret-3,@domain.ru:abc",
+	}
+
+	var Output bytes.Buffer
+	Logger := slog.New(NewRedactHandler(slog.NewJSONHandler(&Output, nil), SecretValues()))
+	Logger = Logger.With("account", myEnv["EMAIL"])
+	Logger.Error("Can not login with imap-secret-1",
+		"error", errors.New("wrong password zip-secret-3"),
+		"password", "anything",
+		"group", slog.GroupValue(slog.String("key", "s3-secret-2")))
+
+	Log := Output.String()
+	for _, Secret := range []string{"imap-secret-1", "s3-secret-2", "zip-secret-3", "anything"} {
+		if strings.Contains(Log, Secret) {
+			t.Errorf("Secret %q is logged: %s", Secret, Log)
+		}
+	}
+	if strings.Contains(Log, `"account":"buh@example.com"`) == false {
+		t.Errorf("Field account is lost: %s", Log)
+	}
+	if strings.Contains(Log, `"msg":"Can not login with ***"`) == false {
+		t.Errorf("Message is not redacted: %s", Log)
+	}
+}
@@ -7,28 +7,20 @@ package main
 
 import (
 	//"github.com/DusanKasan/parsemail"
-	//"fmt"
-	//"bytes"
-	//"github.com/DusanKasan/parsemail"
-	"DownloadEmailsAttachments/parsemail"
-	b64 "encoding/base64"
-	"github.com/joho/godotenv"
-	"io/ioutil"
-	"path/filepath"
+	"context"
+	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"syscall"
 
 	//"io/ioutil"
-	"log"
-	"os"
+	"log/slog"
 	"time"
-
-	imap "github.com/emersion/go-imap"
-	"github.com/emersion/go-imap/client"
 )
 
 const EmailsCount = 100
 const Filename_Settings = "Settings.txt"
+const MailboxName = "INBOX"
 
 var myEnv map[string]string
 
@@ -37,306 +29,126 @@ type MessageStruct struct {
 	From, Subject, Body string
 }
 
-var EmailClient *client.Client
+func main() {
+
+	//var wg sync.WaitGroup
 
-func DownloadEmails(from int) int {
-	//var Messages []MessageStruct
-	MessageId := from - 1
+	LoadEnv()
+	SetupLogging()
 
-	OutputDirectory := myEnv["OutputDirectory"]
-	if OutputDirectory == "" {
-		OutputDirectory = "Files"
-		_ = os.Mkdir(OutputDirectory, os.ModePerm)
+	if len(os.Args) > 1 && os.Args[1] == "catalog" {
+		err := RunCatalogCommand(os.Args[2:])
+		if err != nil {
+			Fatal("Can not run catalog command", "error", err)
+		}
+		return
 	}
 
-	if strings.HasSuffix(OutputDirectory, "\\") == false {
-		OutputDirectory = OutputDirectory + "\\"
+	if len(os.Args) > 1 && os.Args[1] == "dry-run" {
+		DryRun = true
 	}
 
-	sDownloadFromDate := myEnv["DownloadFromDate"]
-	if sDownloadFromDate == "" {
-		sDownloadFromDate = "2000-01-01 00:00:00"
+	//catalog file is not created in dry-run
+	var err error
+	if DryRun == false {
+		err = OpenCatalog()
+		if err != nil {
+			Fatal("Can not open catalog", "error", err)
+		}
 	}
-	layout := "2006-01-02 15:04:05"
-	DownloadFromDate, err := time.Parse(layout, sDownloadFromDate)
+
+	Keys, err = LoadCryptoKeys()
 	if err != nil {
-		log.Fatal("Wrong date: " + sDownloadFromDate)
+		Fatal("Can not load keys", "error", err)
 	}
 
-	sLastEmailID := myEnv["LastEmailID"]
-	LastEmailID, err := strconv.Atoi(sLastEmailID)
+	Sink, err = NewOutputSink()
 	if err != nil {
-		log.Fatal("Wrong LastEmailID: " + sLastEmailID)
+		Fatal("Can not create output sink", "error", err)
 	}
 
-	sFileExtensions := myEnv["FileExtensions"]
-	var FileExtensions []string
-	FileExtensions = strings.Split(sFileExtensions, ",")
-	//LastEmailID, err := strconv.Atoi(sLastEmailID)
-	//if err != nil {
-	//	log.Fatal("Wrong LastEmailID: " + sLastEmailID)
-	//}
-
-	//from := LastEmailID
-	to := from + EmailsCount - 1
-
-	MessageChan := make(chan *imap.Message, EmailsCount)
-
-	done := make(chan error, 1)
-
-	seqset := new(imap.SeqSet)
-	seqset.AddRange(uint32(from), uint32(to))
-
-	log.Println("Fetching emails from number", seqset.String())
-	section := imap.BodySectionName{}
-	//section := imap.FetchEnvelope
-	go func() {
-		if EmailClient != nil {
-			done <- EmailClient.Fetch(seqset, []imap.FetchItem{section.FetchItem(), imap.FetchEnvelope}, MessageChan)
-			//done <- EmailClient.Fetch(seqset, []imap.FetchItem{section.FetchItem()}, MessageChan)
-		}
-	}()
-
-	if EmailClient == nil {
-		return MessageId
+	err = LoadDeadLetters()
+	if err != nil {
+		Fatal("Can not load dead-letter list", "error", err)
 	}
 
-	if err := <-done; err != nil {
-		log.Println(err)
-		//os.Exit(1)
-		return MessageId
+	_, err = NewProcessOptions()
+	if err != nil {
+		Fatal("Wrong settings", "error", err)
 	}
 
-	for RawMessage := range MessageChan {
-		MessageId = int(RawMessage.SeqNum)
-		sMessageId := strconv.Itoa(MessageId)
-
-		r := RawMessage.GetBody(&section)
-		if r == nil {
-			log.Fatal("Server didn't return message body id: " + sMessageId)
-			os.Exit(1)
-		}
-
-		email, err := parsemail.Parse(r)
+	if len(os.Args) > 1 && os.Args[1] == "retry-failed" {
+		err = RunRetryFailedCommand(os.Args[2:])
 		if err != nil {
-			log.Println("Can not parse email id: " + sMessageId + " error: " + err.Error())
-			continue
-			//os.Exit(1)
+			Fatal("Can not retry failed messages", "error", err)
 		}
+		return
+	}
 
-		//MessageId, err := strconv.Atoi(sMessageId)
-		//if err != nil {
-		//	log.Println("Can not parse MessageId to int")
-		//	return
-		//}
-		if MessageId <= LastEmailID {
-			SaveEnv(sMessageId)
-			continue
-		}
-
-		EmailDate := RawMessage.Envelope.Date
-		if EmailDate.Before(DownloadFromDate) {
-			SaveEnv(sMessageId)
-			continue
-		}
-
-		for _, file1 := range email.Attachments {
-			Filename := file1.Filename
-			ext := filepath.Ext(Filename)
-			ext = strings.ToLower(ext)
-
-			if Filename == "" {
-				log.Println("Empty filename EMail id: " + strconv.Itoa(MessageId))
-			}
-
-			//if Filename[0:9] == "=?utf-8?B?" {
-			//sDec, err := b64.StdEncoding.DecodeString(Filename)
-			//if err != nil {
-			//	Filename = string(sDec)
-			//}
-			//}
-
-			if contains(FileExtensions, ext) == false {
-				//if ext != ".xls" && ext != ".xlsx" {
-				//SaveEnv(sMessageId)
-				continue
-			}
-
-			println(file1.Filename)
-			massBytes, err := ioutil.ReadAll(file1.Data)
-			if err != nil {
-				log.Fatal("Can not read message id: " + sMessageId)
-				//os.Exit(1)
-			}
-
-			PersonalName := RawMessage.Envelope.From[0].PersonalName
-			PersonalName = StringFromBase64(PersonalName)
-			PersonalName2 := parsemail.FindFilenameFromAttachment(PersonalName)
-			if PersonalName2 != "" {
-				PersonalName = PersonalName2
-			}
-			PersonalName = strings.TrimSpace(PersonalName)
-
-			EmailFrom := "From(" + PersonalName + " (" + RawMessage.Envelope.From[0].MailboxName + "@" + RawMessage.Envelope.From[0].HostName + "))"
-			FilenameNew := OutputDirectory + EmailFrom + "_" + Filename
-			err = ioutil.WriteFile(FilenameNew, massBytes, 0644)
-			if err != nil {
-				log.Println("Can not save file: " + FilenameNew + " Error: " + err.Error())
-			}
-
+	if DryRun == true {
+		err = RunDryRunCommand(os.Args[2:])
+		if err != nil {
+			Fatal("Can not run dry-run", "error", err)
 		}
-		SaveEnv(sMessageId)
-
+		return
 	}
 
-	return MessageId
-}
-
-func main() {
-
-	//var wg sync.WaitGroup
-
-	LoadEnv()
-
-	sLastEmailID := myEnv["LastEmailID"]
-	LastEmailID, err := strconv.Atoi(sLastEmailID)
+	StartWebhooks()
+	StartMetricsServer()
+	err = StartAdminServer()
 	if err != nil {
-		log.Fatal("Wrong LastEmailID: " + sLastEmailID)
+		Fatal("Can not start admin server", "error", err)
 	}
 
 	sPauseSeconds := myEnv["PauseSeconds"]
 	PauseSeconds, err := strconv.Atoi(sPauseSeconds)
 	if err != nil {
-		log.Fatal("Wrong LastEmailID: " + sPauseSeconds)
-	}
-
-	start := time.Now()
-	LoginEmail()
-	defer func() {
-		if EmailClient != nil {
-			EmailClient.Logout()
-			log.Println("Logging out")
-		}
-	}()
-
-	defer func() {
-		//log.Printf("Read %v messages", len(Messages))
-		elapsed := time.Since(start)
-		log.Printf("Time taken %s", elapsed)
-	}()
-
-	from := LastEmailID + 1
-
-	for {
-		from = DownloadEmails(from)
-		from = from + 1
-		time.Sleep(time.Second * time.Duration(PauseSeconds))
-		EMailClientSelect()
-	}
-
-	//const EmailsPerBatch = 1
-	//const TotalEmails = 1
-
-}
-
-func SaveEnv(sMessageId string) {
-	myEnv["LastEmailID"] = sMessageId
-	err := godotenv.Write(myEnv, Filename_Settings)
-	if err != nil {
-		log.Fatal("Can not write message id: " + sMessageId)
-		os.Exit(1)
-		//return
+		Fatal("Wrong PauseSeconds", "value", sPauseSeconds)
 	}
 
-}
-
-func LoadEnv() {
-	var err error
-	//err := godotenv.Load(Filename_Settings)
-	//if err != nil {
-	//	log.Fatal("Error loading " + Filename_Settings + " file, error: " + err.Error())
-	//}
-
-	myEnv, err = godotenv.Read(Filename_Settings)
+	Source, err := NewMailSource(false)
 	if err != nil {
-		log.Fatal("Error parse " + Filename_Settings + " file, error: " + err.Error())
+		Fatal("Can not create mail source", "error", err)
 	}
-
-}
-
-func LoginEmail() *client.Client {
-
-	log.Println("Connecting to server...")
-
-	var err error
-	// Connect to server
-	EmailClient, err = client.DialTLS(myEnv["IMAP_SERVER"], nil)
+	Checkpoints, err := NewCheckpointStore(Source)
 	if err != nil {
-		log.Println(err)
-		return EmailClient
-	}
-
-	// Don't forget to logout
-	//defer EmailClient.Logout()
-	//defer log.Println("Logging out")
-
-	// Login
-	email := myEnv["EMAIL"]
-	password := myEnv["PASSWORD"]
-	if err := EmailClient.Login(email, password); err != nil {
-		log.Println(err)
-		return EmailClient
+		Fatal("Can not open checkpoint store", "error", err)
 	}
+	defer Checkpoints.Close()
+	MailDownloader, err = NewDownloader(Source, Checkpoints)
 	if err != nil {
-		log.Println(err)
-		return EmailClient
-	} else {
-		log.Println("Logged in")
+		Fatal("Can not create downloader", "error", err)
 	}
 
-	EMailClientSelect()
-
-	//seqset := new(imap.SeqSet)
-	//seqset.AddRange(uint32(from), uint32(to))
-	//
-	//log.Println("Fetching emails from number", seqset.String())
-	//err = EmailClient.Fetch(seqset, []imap.FetchItem{section.FetchItem()}, MessageChan)
-	//if err != nil {
-	//	log.Println(err)
-	//}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	return EmailClient
-}
-
-func EMailClientSelect() {
-	if EmailClient == nil {
-		log.Println("Error: EmailClient=nil !")
-		LoginEmail()
-		return
-	}
+	start := time.Now()
+	defer func() {
+		MailDownloader.Close()
+		slog.Info("Logging out")
+		elapsed := time.Since(start)
+		slog.Info("Time taken", "elapsed", elapsed)
+	}()
 
-	// Select INBOX
-	mbox, err := EmailClient.Select("INBOX", false)
-	if err != nil {
-		log.Println("Can not select emails, error:", err)
-		LoginEmail()
-		return
+	for ctx.Err() == nil {
+		Status.SetSyncing(true)
+		_, err = MailDownloader.RunOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Can not download emails", "account", myEnv["EMAIL"], "folder", MailboxName, "error", err)
+			Status.SetError(err)
+		}
+		err = RetryFailedMessages(ctx, false)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Can not retry failed messages", "error", err)
+			Status.SetError(err)
+		}
+		Status.SetSyncing(false)
+		WaitNextSync(ctx, PauseSeconds)
 	}
-	log.Println("Number of messages total: ", mbox.Messages)
-
-}
 
-func FetchEmail(MessageChan chan *imap.Message, from, to int, section *imap.BodySectionName) {
-	done := make(chan error, 1)
-
-	seqset := new(imap.SeqSet)
-	seqset.AddRange(uint32(from), uint32(to))
-
-	log.Println("Fetching emails numbers", seqset.String())
-	done <- EmailClient.Fetch(seqset, []imap.FetchItem{section.FetchItem()}, MessageChan)
-	if err := <-done; err != nil {
-		log.Fatal(err)
-	}
+	//const EmailsPerBatch = 1
+	//const TotalEmails = 1
 
 }
 
@@ -349,22 +161,3 @@ func contains(s []string, str string) bool {
 
 	return false
 }
-
-func StringFromBase64(s string) string {
-	Otvet := s
-
-	if len(s) > 10 && s[0:10] == "=?utf-8?B?" {
-		sDec, err := b64.StdEncoding.DecodeString(s[10:])
-		if err != nil {
-			Otvet = string(sDec)
-		}
-	} else if len(s) > 17 && s[0:17] == "=?windows-1251?B?" {
-		s2, err := b64.StdEncoding.DecodeString(s[17:])
-		s2 = parsemail.DecodeWindows1251(s2)
-		if err != nil {
-			Otvet = string(s2)
-		}
-	}
-
-	return Otvet
-}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+	"DownloadEmailsAttachments/parsemail"
+)
+
+// FileMetadata - content of .json sidecar file, saved near every attachment if SaveMetadata=true
+type FileMetadata struct {
+	From             string    `json:"from"`
+	ForwardedFrom    string    `json:"forwarded_from,omitempty"` //sender of forwarded message, not authenticated
+	To               []string  `json:"to"`
+	Cc               []string  `json:"cc,omitempty"`
+	Subject          string    `json:"subject"`
+	Date             time.Time `json:"date"`
+	ReceivedDate     time.Time `json:"received_date"`
+	MessageID        string    `json:"message_id"`
+	UID              uint32    `json:"uid"`
+	Folder           string    `json:"folder"`
+	Account          string    `json:"account"`
+	OriginalFilename string    `json:"original_filename"`
+	ContentType      string    `json:"content_type"`
+	Size             int       `json:"size"`
+	SHA256           string    `json:"sha256"`
+	DownloadedAt     time.Time `json:"downloaded_at"`
+}
+
+// NewMessageMetadata fills message fields of metadata, file fields are filled in SaveAttachmentFile.
+// If email was not parsed fields are taken from message header
+func NewMessageMetadata(m *downloader.Message, email parsemail.Email) FileMetadata {
+	Otvet := FileMetadata{
+		To:           addressList(email.To),
+		Cc:           addressList(email.Cc),
+		Subject:      email.Subject,
+		Date:         email.Date,
+		MessageID:    email.MessageID,
+		UID:          m.UID,
+		ReceivedDate: m.InternalDate,
+		Folder:       m.Folder,
+		Account:      m.Account,
+	}
+	if len(email.From) > 0 {
+		Otvet.From = email.From[0].Address
+	}
+
+	if m.Raw == nil || (Otvet.From != "" && Otvet.Date.IsZero() == false) {
+		return Otvet
+	}
+
+	Header, err := mail.ReadMessage(bytes.NewReader(m.Raw))
+	if err != nil {
+		return Otvet
+	}
+
+	if Otvet.From == "" {
+		if From, err := mail.ParseAddress(Header.Header.Get("From")); err == nil {
+			Otvet.From = From.Address
+		}
+	}
+	if Otvet.Date.IsZero() {
+		if Date, err := Header.Header.Date(); err == nil {
+			Otvet.Date = Date
+		}
+	}
+	if Otvet.Subject == "" {
+		Otvet.Subject = Header.Header.Get("Subject")
+		if Subject, err := new(mime.WordDecoder).DecodeHeader(Otvet.Subject); err == nil {
+			Otvet.Subject = Subject
+		}
+	}
+	if Otvet.MessageID == "" {
+		Otvet.MessageID = strings.Trim(Header.Header.Get("Message-ID"), "<>")
+	}
+
+	return Otvet
+}
+
+// FillFileMetadata fills size, hash and download time of file
+func FillFileMetadata(Metadata FileMetadata, massBytes []byte) FileMetadata {
+	Hash := sha256.Sum256(massBytes)
+	Metadata.Size = len(massBytes)
+	Metadata.SHA256 = hex.EncodeToString(Hash[:])
+	Metadata.DownloadedAt = time.Now()
+
+	return Metadata
+}
+
+// SaveAttachmentFile saves attachment, its .json metadata sidecar and record in catalog, runs file hook.
+// Returns location of saved file, ErrDuplicateFile if the same file is already saved, error of sink
+// or *HookError if file is saved but hook failed
+func SaveAttachmentFile(FilenameNew string, massBytes []byte, Metadata FileMetadata) (string, error) {
+	Metadata = FillFileMetadata(Metadata, massBytes)
+
+	FilenameNew, err := SaveFileWithTime(FilenameNew, massBytes, Metadata.FileTime())
+	Location := Sink.Location(FilenameNew)
+	if err == ErrDuplicateFile {
+		CatalogAddFile(Metadata, Location, FileStatusDuplicate, err)
+		MetricAttachmentsSkipped.WithLabelValues(SkipReasonDuplicate).Inc()
+		ReportSkippedFile(Metadata.OriginalFilename, SkipReasonDuplicate+": "+Location)
+		return Location, err
+	} else if err != nil {
+		CatalogAddFile(Metadata, Location, FileStatusError, err)
+		MetricAttachmentsSkipped.WithLabelValues(SkipReasonSaveError).Inc()
+		return Location, err
+	}
+	MetricAttachmentsSaved.Inc()
+	Status.AddDownload(Metadata, Location)
+
+	if myEnv["SaveMetadata"] == "true" {
+		SaveMetadataFile(FilenameNew, Metadata)
+	}
+
+	PostWebhookEvent(WebhookEvent{Type: EventFileSaved, File: &FileHookData{Path: Location, FileMetadata: Metadata}})
+
+	err = RunFileHook(Location, Metadata)
+	if err != nil {
+		CatalogAddFile(Metadata, Location, FileStatusHookFailed, err)
+		return Location, err
+	}
+	CatalogAddFile(Metadata, Location, FileStatusSaved, nil)
+
+	return Location, nil
+}
+
+// SaveMetadataFile saves .json sidecar file near attachment
+func SaveMetadataFile(FilenameNew string, Metadata FileMetadata) {
+	massJson, err := json.MarshalIndent(Metadata, "", "  ")
+	if err != nil {
+		MessageLogger(Metadata).Error("Can not create metadata", "file", FilenameNew, "error", err)
+		return
+	}
+
+	err = Sink.Put(FilenameNew+".json", massJson, time.Time{})
+	if err != nil {
+		MessageLogger(Metadata).Error("Can not save file", "path", Sink.Location(FilenameNew+".json"), "error", err)
+	}
+}
+
+// FileTime returns modification time for saved files from FileTime setting:
+// sent - message date, received - date when server received message (INTERNALDATE), download (default) - zero time, file time is not changed
+func (Metadata FileMetadata) FileTime() time.Time {
+	switch myEnv["FileTime"] {
+	case "sent":
+		return Metadata.Date
+	case "received":
+		if Metadata.ReceivedDate.IsZero() {
+			return Metadata.Date
+		}
+		return Metadata.ReceivedDate
+	}
+
+	return time.Time{}
+}
+
+func addressList(Addresses []*mail.Address) []string {
+	Otvet := make([]string, 0, len(Addresses))
+	for _, Address1 := range Addresses {
+		Otvet = append(Otvet, Address1.String())
+	}
+
+	return Otvet
+}
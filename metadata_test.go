@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+	"DownloadEmailsAttachments/parsemail"
+)
+
+func TestNewMessageMetadata(t *testing.T) {
+	Received := time.Date(2021, 3, 1, 7, 5, 0, 0, time.UTC)
+	Message := &downloader.Message{Account: "buh@example.com", Folder: MailboxName, UID: 109, InternalDate: Received}
+	Date := time.Date(2021, 3, 1, 10, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	email := parsemail.Email{
+		From:      []*mail.Address{{Name: "Supplier", Address: "price@supplier.ru"}},
+		To:        []*mail.Address{{Address: "buh@example.com"}},
+		Subject:   "Price",
+		Date:      Date,
+		MessageID: "1@supplier.ru",
+	}
+
+	Metadata := NewMessageMetadata(Message, email)
+	if Metadata.From != "price@supplier.ru" || Metadata.Subject != "Price" || Metadata.Date.Equal(Date) == false ||
+		Metadata.MessageID != "1@supplier.ru" || Metadata.UID != 109 || Metadata.ReceivedDate.Equal(Received) == false ||
+		Metadata.Account != "buh@example.com" || Metadata.Folder != MailboxName {
+		t.Errorf("Wrong metadata: %+v", Metadata)
+	}
+	if len(Metadata.To) != 1 || Metadata.To[0] != "<buh@example.com>" || Metadata.Cc == nil || len(Metadata.Cc) != 0 {
+		t.Errorf("Wrong recipients: %v %v", Metadata.To, Metadata.Cc)
+	}
+
+	//fields of not parsed message are taken from header
+	Message.Raw = []byte("From: Supplier <price@supplier.ru>\r\n" +
+		"Subject: =?utf-8?B?0J/RgNCw0LnRgQ==?=\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"Message-ID: <1@supplier.ru>\r\n" +
+		"\r\n" +
+		"Hello\r\n")
+	Metadata = NewMessageMetadata(Message, parsemail.Email{})
+	if Metadata.From != "price@supplier.ru" || Metadata.Subject != "Прайс" || Metadata.Date.Equal(Date) == false ||
+		Metadata.MessageID != "1@supplier.ru" {
+		t.Errorf("Wrong metadata from header: %+v", Metadata)
+	}
+}
+
+func TestFillFileMetadata(t *testing.T) {
+	Metadata := FillFileMetadata(FileMetadata{OriginalFilename: "price.csv"}, []byte("abc"))
+	if Metadata.Size != 3 || Metadata.SHA256 != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" ||
+		Metadata.OriginalFilename != "price.csv" || time.Since(Metadata.DownloadedAt) > time.Minute {
+		t.Errorf("Wrong file metadata: %+v", Metadata)
+	}
+}
+
+func TestSaveAttachmentFileMetadata(t *testing.T) {
+	Root := t.TempDir()
+	defer func(s OutputSink) { Sink = s }(Sink)
+	var err error
+	Sink, err = NewLocalSink(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Metadata := FileMetadata{From: "price@supplier.ru", UID: 109, OriginalFilename: "price.csv", ContentType: "text/csv"}
+
+	myEnv = map[string]string{}
+	_, err = SaveAttachmentFile("price@supplier.ru_price.csv", []byte("abc"), Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Files, _ := filepath.Glob(filepath.Join(Root, "*.json")); len(Files) != 0 {
+		t.Errorf("Metadata is saved without SaveMetadata: %v", Files)
+	}
+
+	myEnv = map[string]string{"SaveMetadata": "true"}
+	_, err = SaveAttachmentFile("price@supplier.ru_price.csv", []byte("abc"), Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Data, err := ioutil.ReadFile(filepath.Join(Root, "price@supplier.ru_price.csv.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var Saved FileMetadata
+	err = json.Unmarshal(Data, &Saved)
+	if err != nil || Saved.From != "price@supplier.ru" || Saved.UID != 109 || Saved.OriginalFilename != "price.csv" ||
+		Saved.ContentType != "text/csv" || Saved.Size != 3 || Saved.SHA256 == "" {
+		t.Errorf("Wrong metadata file: %s %v", Data, err)
+	}
+}
+
+func TestFileTime(t *testing.T) {
+	Date := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	Received := Date.Add(5 * time.Minute)
+
+	var testData = []struct {
+		FileTime     string
+		ReceivedDate time.Time
+		Result       time.Time
+	}{
+		{"", Received, time.Time{}},
+		{"download", Received, time.Time{}},
+		{"sent", Received, Date},
+		{"received", Received, Received},
+		{"received", time.Time{}, Date},
+	}
+
+	for i, Test := range testData {
+		myEnv = map[string]string{"FileTime": Test.FileTime}
+		Metadata := FileMetadata{Date: Date, ReceivedDate: Test.ReceivedDate}
+		if Result := Metadata.FileTime(); Result.Equal(Test.Result) == false {
+			t.Errorf("[Test Case %v] Wrong file time for %q. Expected: %v, Got: %v", i+1, Test.FileTime, Test.Result, Result)
+		}
+	}
+}
+
+func TestProcessMessageFileTime(t *testing.T) {
+	Raw := "From: Supplier <price@supplier.ru>\r\n" +
+		"Subject: Price\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream; name=\"price.xlsx\"\r\n" +
+		"Content-Disposition: attachment; filename=\"price.xlsx\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aXRlbTtwcmljZQ==\r\n" +
+		"--b1--\r\n"
+	Date := time.Date(2021, 3, 1, 7, 0, 0, 0, time.UTC)
+	Received := Date.Add(5 * time.Minute)
+
+	var testData = []struct {
+		FileTime string
+		Result   time.Time
+	}{
+		{"sent", Date},
+		{"received", Received},
+		{"", time.Time{}},
+	}
+
+	defer func(s OutputSink) { Sink = s }(Sink)
+	for i, Test := range testData {
+		Root := t.TempDir()
+		myEnv = map[string]string{"EMAIL": "buh@example.com", "FileExtensions": ".xlsx", "FileTime": Test.FileTime,
+			"SaveEml": SaveEmlWithAttachments, "SaveBody": "txt", "DeadLetterFile": filepath.Join(Root, "DeadLetters.json")}
+		err := LoadDeadLetters()
+		if err != nil {
+			t.Fatal(err)
+		}
+		Sink, err = NewLocalSink(filepath.Join(Root, "Files"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		Options, err := NewProcessOptions()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		Message := &downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 1, UID: 109, InternalDate: Received, Raw: []byte(Raw)}
+		if err = ProcessMessage(Message, Options); err != nil {
+			t.Fatal(err)
+		}
+
+		//attachment, .eml and .txt body get the same time
+		Files, _ := filepath.Glob(filepath.Join(Root, "Files", "*"))
+		if len(Files) != 3 {
+			t.Errorf("[Test Case %v] Wrong saved files: %v", i+1, Files)
+		}
+		for _, Filename := range Files {
+			Info, err := os.Stat(Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if Test.Result.IsZero() && time.Since(Info.ModTime()) > time.Hour {
+				t.Errorf("[Test Case %v] Time of %s is changed: %v", i+1, filepath.Base(Filename), Info.ModTime())
+			} else if Test.Result.IsZero() == false && Info.ModTime().Equal(Test.Result) == false {
+				t.Errorf("[Test Case %v] Wrong time of %s. Expected: %v, Got: %v", i+1, filepath.Base(Filename), Test.Result, Info.ModTime())
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// reasons of skipped attachments for MetricAttachmentsSkipped
+const (
+	SkipReasonExtension   = "extension"
+	SkipReasonDuplicate   = "duplicate"
+	SkipReasonSaveError   = "save_error"
+	SkipReasonInvalid     = "invalid"
+	SkipReasonQuarantined = "quarantined"
+	SkipReasonInfected    = "infected"
+)
+
+var (
+	MetricMessagesScanned = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emails_messages_scanned_total",
+		Help: "Messages fetched from mailbox.",
+	})
+	MetricMessagesSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "emails_messages_skipped_total",
+		Help: "Messages skipped because signature or sender authentication failed.",
+	}, []string{"reason"})
+	MetricAttachmentsSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emails_attachments_saved_total",
+		Help: "Files saved to output.",
+	})
+	MetricAttachmentsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "emails_attachments_skipped_total",
+		Help: "Attachments which are not saved, by reason.",
+	}, []string{"reason"})
+	MetricBytesDownloaded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emails_bytes_downloaded_total",
+		Help: "Size of fetched messages in bytes.",
+	})
+	MetricParseErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emails_parse_errors_total",
+		Help: "Messages which can not be parsed.",
+	})
+	MetricLoginFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emails_login_failures_total",
+		Help: "Failed connections and logins to IMAP server.",
+	})
+	MetricReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emails_reconnects_total",
+		Help: "Reconnections to IMAP server after lost connection.",
+	})
+	MetricLastSync = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "emails_last_sync_timestamp_seconds",
+		Help: "Unix time of last successful fetch from folder.",
+	}, []string{"account", "folder"})
+	MetricDeadLetters = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "emails_dead_letters",
+		Help: "Failed messages in dead-letter list.",
+	})
+	MetricFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "emails_fetch_duration_seconds",
+		Help:    "Duration of IMAP fetch of one batch of messages.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+)
+
+// StartMetricsServer serves /metrics on MetricsAddress (for example :9100), does nothing if it is empty.
+// If MetricsAddress is the same as AdminAddress metrics are served by admin server
+func StartMetricsServer() {
+	if myEnv["MetricsAddress"] == "" || myEnv["MetricsAddress"] == myEnv["AdminAddress"] {
+		return
+	}
+
+	Mux := http.NewServeMux()
+	Mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		err := http.ListenAndServe(myEnv["MetricsAddress"], Mux)
+		if err != nil {
+			slog.Error("Can not start metrics server", "address", myEnv["MetricsAddress"], "error", err)
+		}
+	}()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAttachmentMetrics(t *testing.T) {
+	s, err := NewLocalSink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	Sink = s
+	myEnv = map[string]string{"DuplicateFiles": DuplicateSkip}
+
+	Saved := testutil.ToFloat64(MetricAttachmentsSaved)
+	Duplicates := testutil.ToFloat64(MetricAttachmentsSkipped.WithLabelValues(SkipReasonDuplicate))
+
+	SaveAttachmentFile("report.xlsx", []byte("first"), FileMetadata{})
+	SaveAttachmentFile("report.xlsx", []byte("second"), FileMetadata{})
+
+	if n := testutil.ToFloat64(MetricAttachmentsSaved) - Saved; n != 1 {
+		t.Errorf("Wrong saved count. Expected: 1, Got: %v", n)
+	}
+	if n := testutil.ToFloat64(MetricAttachmentsSkipped.WithLabelValues(SkipReasonDuplicate)) - Duplicates; n != 1 {
+		t.Errorf("Wrong duplicate count. Expected: 1, Got: %v", n)
+	}
+}
@@ -0,0 +1,97 @@
+package parsemail
+
+import (
+	"bytes"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// htmlMetaCharset finds <meta charset="..."> or <meta http-equiv="Content-Type" content="text/html; charset=...">
+var htmlMetaCharset = regexp.MustCompile(`(?i)(<meta[^>]+charset\s*=\s*["']?\s*)([a-z0-9_:.\-]+)`)
+
+// decodeCharset converts text body to UTF-8 and returns it with name of original charset.
+// Charset is taken from Content-Type, for HTML from <meta> tag, otherwise it is detected by content.
+// <meta> charset of converted HTML is changed to utf-8, so saved .html is shown correctly
+func decodeCharset(data []byte, contentType string) (string, string) {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+
+	name := params["charset"]
+	if name == "" && mediaType == contentTypeTextHtml {
+		head := data
+		if len(head) > 1024 {
+			head = head[:1024]
+		}
+		if m := htmlMetaCharset.FindSubmatch(head); m != nil {
+			name = string(m[2])
+		}
+	}
+
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || isUTF8Charset(name) && utf8.Valid(data) == false {
+		name = detectCharset(data)
+	}
+	if isUTF8Charset(name) {
+		return string(data), name
+	}
+
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		name = detectCharset(data)
+		if isUTF8Charset(name) {
+			return string(data), name
+		}
+		enc, _ = htmlindex.Get(name)
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data), name
+	}
+	if mediaType == contentTypeTextHtml {
+		decoded = htmlMetaCharset.ReplaceAll(decoded, []byte("${1}utf-8"))
+	}
+
+	return string(decoded), name
+}
+
+func isUTF8Charset(name string) bool {
+	return name == "utf-8" || name == "utf8" || name == "us-ascii" || name == "ascii"
+}
+
+// detectCharset guesses charset of text without declared charset: utf-8, windows-1251, koi8-r or windows-1252.
+// Cyrillic text has more lowercase letters than uppercase, they are 0xE0-0xFF in windows-1251 and 0xC0-0xDF in koi8-r
+func detectCharset(data []byte) string {
+	if utf8.Valid(data) {
+		if bytes.IndexFunc(data, func(r rune) bool { return r >= utf8.RuneSelf }) == -1 {
+			return "us-ascii"
+		}
+		return "utf-8"
+	}
+
+	high, e0ff, c0df := 0, 0, 0
+	for _, c := range data {
+		switch {
+		case c >= 0xE0:
+			e0ff++
+		case c >= 0xC0:
+			c0df++
+		}
+		if c >= 0x80 {
+			high++
+		}
+	}
+
+	//most of non-ASCII bytes are not letters of cyrillic alphabet
+	if (e0ff+c0df)*2 < high {
+		return "windows-1252"
+	}
+	if e0ff >= c0df {
+		return "windows-1251"
+	}
+
+	return "koi8-r"
+}
@@ -0,0 +1,84 @@
+package parsemail
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+func encodeCharset(t *testing.T, s string, enc *charmap.Charmap) string {
+	b, err := enc.NewEncoder().String(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestDecodeCharset(t *testing.T) {
+	text := "Счёт на оплату, цена в рублях"
+	cp1251 := encodeCharset(t, text, charmap.Windows1251)
+	koi8r := encodeCharset(t, text, charmap.KOI8R)
+
+	var testData = []struct {
+		data        string
+		contentType string
+		expected    string
+		charset     string
+	}{
+		{cp1251, "text/plain; charset=windows-1251", text, "windows-1251"},
+		{koi8r, "text/plain; charset=\"KOI8-R\"", text, "koi8-r"},
+		{text, "text/plain; charset=utf-8", text, "utf-8"},
+		{text, "text/plain", text, "utf-8"},
+		{"Price list", "text/plain", "Price list", "us-ascii"},
+		{cp1251, "text/plain", text, "windows-1251"},
+		{koi8r, "text/plain", text, "koi8-r"},
+		{cp1251, "text/plain; charset=utf-8", text, "windows-1251"},
+		{cp1251, "text/plain; charset=x-unknown", text, "windows-1251"},
+		{"<html><head><meta charset=\"windows-1251\"></head><body>" + cp1251 + "</body></html>", "text/html",
+			"<html><head><meta charset=\"utf-8\"></head><body>" + text + "</body></html>", "windows-1251"},
+		{"<meta http-equiv=\"Content-Type\" content=\"text/html; charset=koi8-r\">" + koi8r, "text/html",
+			"<meta http-equiv=\"Content-Type\" content=\"text/html; charset=utf-8\">" + text, "koi8-r"},
+	}
+
+	for i, td := range testData {
+		decoded, charset := decodeCharset([]byte(td.data), td.contentType)
+		if decoded != td.expected || charset != td.charset {
+			t.Errorf("[Test Case %v] Expected: %q %s, Got: %q %s", i, td.expected, td.charset, decoded, charset)
+		}
+	}
+}
+
+func TestParseCharset(t *testing.T) {
+	mailData := "From: Supplier <supplier@example.com>\r\n" +
+		"Subject: Price list\r\n" +
+		"Content-Type: multipart/alternative; boundary=altboundary\r\n" +
+		"\r\n" +
+		"--altboundary\r\n" +
+		"Content-Type: text/plain; charset=windows-1251\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		encodeCharset(t, "Цена: 100 руб.", charmap.Windows1251) + "\r\n" +
+		"--altboundary\r\n" +
+		"Content-Type: text/html; charset=windows-1251\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<p>=D6=E5=ED=E0</p>\r\n" +
+		"--altboundary--\r\n"
+
+	e, err := Parse(strings.NewReader(mailData))
+	if err != nil {
+		t.Fatalf("Error while parsing email: %v", err)
+	}
+
+	if e.TextBody != "Цена: 100 руб." {
+		t.Errorf("Wrong text body. Expected: '%s', Got: '%s'", "Цена: 100 руб.", e.TextBody)
+	}
+	if e.HTMLBody != "<p>Цена</p>" {
+		t.Errorf("Wrong html body. Expected: '%s', Got: '%s'", "<p>Цена</p>", e.HTMLBody)
+	}
+	if e.Charset != "windows-1251" {
+		t.Errorf("Wrong charset. Expected: %s, Got: %s", "windows-1251", e.Charset)
+	}
+}
@@ -21,9 +21,20 @@ const contentTypeMultipartAlternative = "multipart/alternative"
 const contentTypeMultipartRelated = "multipart/related"
 const contentTypeTextHtml = "text/html"
 const contentTypeTextPlain = "text/plain"
+const contentTypeMessageRfc822 = "message/rfc822"
 
-// Parse an email message read from io.Reader into parsemail.Email struct
+// Parse an email message read from io.Reader into parsemail.Email struct.
+// Encrypted messages can not be decrypted, signatures are checked with system roots only
 func Parse(r io.Reader) (email Email, err error) {
+	return ParseWithKeys(r, nil)
+}
+
+// ParseWithKeys parses email message, keys are used for signed and encrypted messages
+func ParseWithKeys(r io.Reader, keys *CryptoKeys) (email Email, err error) {
+	if keys == nil {
+		keys = &CryptoKeys{}
+	}
+
 	msg, err := mail.ReadMessage(r)
 	if err != nil {
 		return
@@ -35,26 +46,40 @@ func Parse(r io.Reader) (email Email, err error) {
 	}
 
 	email.ContentType = msg.Header.Get("Content-Type")
-	contentType, params, err := parseContentType(email.ContentType)
+	err = parseBody(&email, msg.Header, msg.Body, keys)
+
+	return
+}
+
+// parseBody fills body, attachments and embedded files of email from message content
+func parseBody(email *Email, header mail.Header, body io.Reader, keys *CryptoKeys) (err error) {
+	contentType, params, err := parseContentType(header.Get("Content-Type"))
 	if err != nil {
 		return
 	}
 
 	switch contentType {
 	case contentTypeMultipartMixed:
-		email.TextBody, email.HTMLBody, email.Attachments, email.EmbeddedFiles, err = parseMultipartMixed(msg.Body, params["boundary"])
+		var signature *Signature
+		var encrypted bool
+		email.TextBody, email.HTMLBody, email.Charset, email.Attachments, email.EmbeddedFiles, email.AttachedEmails, signature, encrypted, err = parseMultipartMixed(body, params["boundary"], keys)
+		//signature of whole message is preferred to signature of nested part
+		if email.Signature == nil {
+			email.Signature = signature
+		}
+		email.Encrypted = email.Encrypted || encrypted
 	case contentTypeMultipartAlternative:
-		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartAlternative(msg.Body, params["boundary"])
+		email.TextBody, email.HTMLBody, email.Charset, email.EmbeddedFiles, err = parseMultipartAlternative(body, params["boundary"])
 	case contentTypeMultipartRelated:
-		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartRelated(msg.Body, params["boundary"])
+		email.TextBody, email.HTMLBody, email.Charset, email.EmbeddedFiles, err = parseMultipartRelated(body, params["boundary"])
 	case contentTypeTextPlain:
-		message, _ := ioutil.ReadAll(msg.Body)
-		email.TextBody = strings.TrimSuffix(string(message[:]), "\n")
+		email.TextBody, email.Charset, err = readTextPart(body, header)
 	case contentTypeTextHtml:
-		message, _ := ioutil.ReadAll(msg.Body)
-		email.HTMLBody = strings.TrimSuffix(string(message[:]), "\n")
+		email.HTMLBody, email.Charset, err = readTextPart(body, header)
+	case contentTypeMultipartSigned, contentTypeMultipartEncrypted, contentTypePkcs7Mime, contentTypeXPkcs7Mime:
+		err = parseSecure(email, contentType, params, header, body, keys)
 	default:
-		email.Content, err = decodeContent(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+		email.Content, err = decodeContent(body, header.Get("Content-Transfer-Encoding"))
 	}
 
 	return
@@ -106,7 +131,7 @@ func parseContentType(contentTypeHeader string) (contentType string, params map[
 	return mime.ParseMediaType(contentTypeHeader)
 }
 
-func parseMultipartRelated(msg io.Reader, boundary string) (textBody, htmlBody string, embeddedFiles []EmbeddedFile, err error) {
+func parseMultipartRelated(msg io.Reader, boundary string) (textBody, htmlBody, charset string, embeddedFiles []EmbeddedFile, err error) {
 	pmr := multipart.NewReader(msg, boundary)
 	for {
 		part, err := pmr.NextPart()
@@ -114,56 +139,65 @@ func parseMultipartRelated(msg io.Reader, boundary string) (textBody, htmlBody s
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
+			return textBody, htmlBody, charset, embeddedFiles, err
 		}
 
 		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
 		if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
+			return textBody, htmlBody, charset, embeddedFiles, err
 		}
 
 		switch contentType {
 		case contentTypeTextPlain:
-			ppContent, err := ioutil.ReadAll(part)
+			ppContent, cs, err := readTextPart(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				return textBody, htmlBody, charset, embeddedFiles, err
 			}
 
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			textBody += ppContent
+			if charset == "" {
+				charset = cs
+			}
 		case contentTypeTextHtml:
-			ppContent, err := ioutil.ReadAll(part)
+			ppContent, cs, err := readTextPart(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				return textBody, htmlBody, charset, embeddedFiles, err
 			}
 
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			htmlBody += ppContent
+			if charset == "" {
+				charset = cs
+			}
 		case contentTypeMultipartAlternative:
-			tb, hb, ef, err := parseMultipartAlternative(part, params["boundary"])
+			tb, hb, cs, ef, err := parseMultipartAlternative(part, params["boundary"])
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				return textBody, htmlBody, charset, embeddedFiles, err
 			}
 
 			htmlBody += hb
 			textBody += tb
+			if charset == "" {
+				charset = cs
+			}
 			embeddedFiles = append(embeddedFiles, ef...)
 		default:
 			if isEmbeddedFile(part) {
 				ef, err := decodeEmbeddedFile(part)
 				if err != nil {
-					return textBody, htmlBody, embeddedFiles, err
+					return textBody, htmlBody, charset, embeddedFiles, err
 				}
 
 				embeddedFiles = append(embeddedFiles, ef)
 			} else {
-				return textBody, htmlBody, embeddedFiles, fmt.Errorf("Can't process multipart/related inner mime type: %s", contentType)
+				return textBody, htmlBody, charset, embeddedFiles, fmt.Errorf("Can't process multipart/related inner mime type: %s", contentType)
 			}
 		}
 	}
 
-	return textBody, htmlBody, embeddedFiles, err
+	return textBody, htmlBody, charset, embeddedFiles, err
 }
 
-func parseMultipartAlternative(msg io.Reader, boundary string) (textBody, htmlBody string, embeddedFiles []EmbeddedFile, err error) {
+func parseMultipartAlternative(msg io.Reader, boundary string) (textBody, htmlBody, charset string, embeddedFiles []EmbeddedFile, err error) {
 	pmr := multipart.NewReader(msg, boundary)
 	for {
 		part, err := pmr.NextPart()
@@ -171,107 +205,167 @@ func parseMultipartAlternative(msg io.Reader, boundary string) (textBody, htmlBo
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
+			return textBody, htmlBody, charset, embeddedFiles, err
 		}
 
 		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
 		if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
+			return textBody, htmlBody, charset, embeddedFiles, err
 		}
 
 		switch contentType {
 		case contentTypeTextPlain:
-			ppContent, err := ioutil.ReadAll(part)
+			ppContent, cs, err := readTextPart(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				return textBody, htmlBody, charset, embeddedFiles, err
 			}
 
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			textBody += ppContent
+			if charset == "" {
+				charset = cs
+			}
 		case contentTypeTextHtml:
-			ppContent, err := ioutil.ReadAll(part)
+			ppContent, cs, err := readTextPart(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				return textBody, htmlBody, charset, embeddedFiles, err
 			}
 
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			htmlBody += ppContent
+			if charset == "" {
+				charset = cs
+			}
 		case contentTypeMultipartRelated:
-			tb, hb, ef, err := parseMultipartRelated(part, params["boundary"])
+			tb, hb, cs, ef, err := parseMultipartRelated(part, params["boundary"])
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				return textBody, htmlBody, charset, embeddedFiles, err
 			}
 
 			htmlBody += hb
 			textBody += tb
+			if charset == "" {
+				charset = cs
+			}
 			embeddedFiles = append(embeddedFiles, ef...)
 		default:
 			if isEmbeddedFile(part) {
 				ef, err := decodeEmbeddedFile(part)
 				if err != nil {
-					return textBody, htmlBody, embeddedFiles, err
+					return textBody, htmlBody, charset, embeddedFiles, err
 				}
 
 				embeddedFiles = append(embeddedFiles, ef)
 			} else {
-				return textBody, htmlBody, embeddedFiles, fmt.Errorf("Can't process multipart/alternative inner mime type: %s", contentType)
+				return textBody, htmlBody, charset, embeddedFiles, fmt.Errorf("Can't process multipart/alternative inner mime type: %s", contentType)
 			}
 		}
 	}
 
-	return textBody, htmlBody, embeddedFiles, err
+	return textBody, htmlBody, charset, embeddedFiles, err
 }
 
-func parseMultipartMixed(msg io.Reader, boundary string) (textBody, htmlBody string, attachments []Attachment, embeddedFiles []EmbeddedFile, err error) {
+func parseMultipartMixed(msg io.Reader, boundary string, keys *CryptoKeys) (textBody, htmlBody, charset string, attachments []Attachment, embeddedFiles []EmbeddedFile, attachedEmails []Email, signature *Signature, encrypted bool, err error) {
+	unsigned := false
 	mr := multipart.NewReader(msg, boundary)
 	for {
 		part, err := mr.NextPart()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return textBody, htmlBody, attachments, embeddedFiles, err
+			return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, err
 		}
 
 		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
 		if err != nil {
-			return textBody, htmlBody, attachments, embeddedFiles, err
+			return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, err
 		}
 
 		if contentType == contentTypeMultipartAlternative {
-			textBody, htmlBody, embeddedFiles, err = parseMultipartAlternative(part, params["boundary"])
+			textBody, htmlBody, charset, embeddedFiles, err = parseMultipartAlternative(part, params["boundary"])
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, err
 			}
 		} else if contentType == contentTypeMultipartRelated {
-			textBody, htmlBody, embeddedFiles, err = parseMultipartRelated(part, params["boundary"])
+			textBody, htmlBody, charset, embeddedFiles, err = parseMultipartRelated(part, params["boundary"])
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, err
 			}
 		} else if contentType == contentTypeTextPlain {
-			ppContent, err := ioutil.ReadAll(part)
+			ppContent, cs, err := readTextPart(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, err
 			}
 
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			textBody += ppContent
+			if charset == "" {
+				charset = cs
+			}
 		} else if contentType == contentTypeTextHtml {
-			ppContent, err := ioutil.ReadAll(part)
+			ppContent, cs, err := readTextPart(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, err
 			}
 
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			htmlBody += ppContent
+			if charset == "" {
+				charset = cs
+			}
+		} else if contentType == contentTypeMessageRfc822 {
+			at, ae, err := decodeAttachedEmail(part, keys)
+			if err != nil {
+				return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, err
+			}
+
+			attachments = append(attachments, at)
+			unsigned = true
+			if ae != nil {
+				attachedEmails = append(attachedEmails, *ae)
+			}
+		} else if isSecureContentType(contentType) {
+			var inner Email
+			err = parseSecure(&inner, contentType, params, mail.Header(part.Header), part, keys)
+			if err != nil {
+				return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, err
+			}
+
+			textBody += inner.TextBody
+			htmlBody += inner.HTMLBody
+			if charset == "" {
+				charset = inner.Charset
+			}
+			attachments = append(attachments, inner.Attachments...)
+			embeddedFiles = append(embeddedFiles, inner.EmbeddedFiles...)
+			attachedEmails = append(attachedEmails, inner.AttachedEmails...)
+			//invalid signature of any part is kept
+			if inner.Signature != nil && (signature == nil || signature.Valid == true) {
+				signature = inner.Signature
+			}
+			encrypted = encrypted || inner.Encrypted
 		} else if isAttachment(part) {
 			at, err := decodeAttachment(part)
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, err
 			}
 
-			attachments = append(attachments, at)
+			if IsTnef(at) {
+				attachments = append(attachments, expandTnefAttachment(at)...)
+			} else {
+				attachments = append(attachments, at)
+			}
+			unsigned = true
 		} else {
-			return textBody, htmlBody, attachments, embeddedFiles, fmt.Errorf("Unknown multipart/mixed nested mime type: %s", contentType)
+			return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, fmt.Errorf("Unknown multipart/mixed nested mime type: %s", contentType)
 		}
 	}
 
-	return textBody, htmlBody, attachments, embeddedFiles, err
+	//attachments outside of signed part could be added by anyone
+	if signature != nil && signature.Valid == true && unsigned == true {
+		s := *signature
+		s.Valid = false
+		s.Error = "message has attachments outside of signed part"
+		signature = &s
+	}
+
+	return textBody, htmlBody, charset, attachments, embeddedFiles, attachedEmails, signature, encrypted, err
 }
 
 func decodeMimeSentence(s string) string {
@@ -382,28 +476,140 @@ func decodeAttachment(part *multipart.Part) (at Attachment, err error) {
 	return
 }
 
+// decodeAttachedEmail returns forwarded message (message/rfc822 part) as .eml attachment and parses it recursively.
+// If forwarded message can not be parsed, only attachment is returned and outer message is still parsed
+func decodeAttachedEmail(part *multipart.Part, keys *CryptoKeys) (at Attachment, email *Email, err error) {
+	if isAttachment(part) {
+		at, err = decodeAttachment(part)
+	} else {
+		at.Data, err = decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
+	}
+	if err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadAll(at.Data)
+	if err != nil {
+		return
+	}
+	at.Data = bytes.NewReader(data)
+	at.ContentType = contentTypeMessageRfc822
+
+	inner, err := ParseWithKeys(bytes.NewReader(data), keys)
+	if err != nil {
+		err = nil
+	} else {
+		email = &inner
+	}
+
+	if at.Filename == "" {
+		at.Filename = "message.eml"
+		if email != nil && strings.TrimSpace(email.Subject) != "" {
+			at.Filename = strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(strings.TrimSpace(email.Subject)) + ".eml"
+		}
+	}
+
+	return
+}
+
+// expandTnefAttachment replaces winmail.dat with files embedded in it,
+// if it can not be decoded winmail.dat is returned as is
+func expandTnefAttachment(at Attachment) []Attachment {
+	data, err := ioutil.ReadAll(at.Data)
+	if err != nil {
+		return []Attachment{at}
+	}
+
+	at.Data = bytes.NewReader(data)
+	attachments, err := DecodeTnef(data)
+	if err != nil || len(attachments) == 0 {
+		return []Attachment{at}
+	}
+
+	return attachments
+}
+
+// decodeContent decodes content by Content-Transfer-Encoding (RFC 2045), name of encoding is case-insensitive.
+// Content is read to memory, so it can be used after the next part of multipart message is read
 func decodeContent(content io.Reader, encoding string) (io.Reader, error) {
-	switch encoding {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
 	case "base64":
-		decoded := base64.NewDecoder(base64.StdEncoding, content)
-		b, err := ioutil.ReadAll(decoded)
+		data, err = decodeBase64(data)
+	case "quoted-printable":
+		data, err = ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+	case "", "7bit", "8bit", "binary":
+	default:
+		return nil, fmt.Errorf("unknown encoding: %s", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// decodeBase64 decodes base64 written with any line length, with or without padding.
+// Characters out of base64 alphabet (spaces, line breaks) are skipped as RFC 2045 requires,
+// padding inside data starts the next encoded block
+func decodeBase64(data []byte) ([]byte, error) {
+	var result []byte
+	block := make([]byte, 0, len(data))
+	flush := func() error {
+		//one extra character can not be decoded, it is dropped
+		if len(block)%4 == 1 {
+			block = block[:len(block)-1]
+		}
+		decoded, err := base64.RawStdEncoding.DecodeString(string(block))
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		return bytes.NewReader(b), nil
-	case "7bit":
-		dd, err := ioutil.ReadAll(content)
-		if err != nil {
-			return nil, err
+		result = append(result, decoded...)
+		block = block[:0]
+		return nil
+	}
+
+	for _, c := range data {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '+', c == '/':
+			block = append(block, c)
+		case c == '=' && len(block) > 0:
+			if err := flush(); err != nil {
+				return nil, err
+			}
 		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
 
-		return bytes.NewReader(dd), nil
-	case "":
-		return content, nil
-	default:
-		return nil, fmt.Errorf("unknown encoding: %s", encoding)
+	return result, nil
+}
+
+// partHeader - header of message or of multipart part
+type partHeader interface {
+	Get(key string) string
+}
+
+// readTextPart returns text body decoded by Content-Transfer-Encoding and converted to UTF-8, and its original charset
+func readTextPart(content io.Reader, header partHeader) (string, string, error) {
+	decoded, err := decodeContent(content, header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return "", "", err
 	}
+
+	data, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		return "", "", err
+	}
+
+	text, charset := decodeCharset(data, header.Get("Content-Type"))
+	return strings.TrimSuffix(text, "\n"), charset, nil
 }
 
 type headerParser struct {
@@ -525,9 +731,19 @@ type Email struct {
 
 	HTMLBody string
 	TextBody string
+	// Charset - original charset of text and html bodies, they are converted to UTF-8
+	Charset string
 
 	Attachments   []Attachment
 	EmbeddedFiles []EmbeddedFile
+
+	// AttachedEmails - forwarded messages (message/rfc822 parts), parsed recursively
+	AttachedEmails []Email
+
+	// Signature - result of S/MIME or PGP signature verification, nil if message is not signed
+	Signature *Signature
+	// Encrypted - message was decrypted with Keys
+	Encrypted bool
 }
 
 ////Sanek
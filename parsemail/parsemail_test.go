@@ -1,6 +1,7 @@
 package parsemail
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
@@ -585,6 +586,91 @@ So, "Hello".`,
 	}
 }
 
+func TestParseForwardedEmail(t *testing.T) {
+	e, err := Parse(strings.NewReader(forwardedEmail))
+	if err != nil {
+		t.Fatalf("Error while parsing email: %v", err)
+	}
+
+	if e.TextBody != "See the report below." {
+		t.Errorf("Wrong text body. Expected: '%s', Got: '%s'", "See the report below.", e.TextBody)
+	}
+
+	if len(e.Attachments) != 1 {
+		t.Fatalf("Incorrect number of attachments! Expected: %v, Got: %v.", 1, len(e.Attachments))
+	}
+
+	if e.Attachments[0].Filename != "Price list.eml" || e.Attachments[0].ContentType != "message/rfc822" {
+		t.Errorf("Wrong forwarded attachment. Got: %s %s", e.Attachments[0].Filename, e.Attachments[0].ContentType)
+	}
+
+	if len(e.AttachedEmails) != 1 {
+		t.Fatalf("Incorrect number of attached emails! Expected: %v, Got: %v.", 1, len(e.AttachedEmails))
+	}
+
+	inner := e.AttachedEmails[0]
+	if len(inner.From) != 1 || inner.From[0].Address != "supplier@example.com" {
+		t.Errorf("Wrong inner from. Expected: %s, Got: %v", "supplier@example.com", dereferenceAddressList(inner.From))
+	}
+
+	if inner.Subject != "Price list" {
+		t.Errorf("Wrong inner subject. Expected: '%s', Got: '%s'", "Price list", inner.Subject)
+	}
+
+	if len(inner.Attachments) != 1 {
+		t.Fatalf("Incorrect number of inner attachments! Expected: %v, Got: %v.", 1, len(inner.Attachments))
+	}
+
+	b, err := ioutil.ReadAll(inner.Attachments[0].Data)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if inner.Attachments[0].Filename != "prices.csv" || string(b) != "a;b;c" {
+		t.Errorf("Wrong inner attachment. Got: %s '%s'", inner.Attachments[0].Filename, b)
+	}
+}
+
+func TestParseMalformedForwardedEmail(t *testing.T) {
+	var testData = []struct {
+		mailData       string
+		filename       string
+		attachedEmails int
+	}{
+		{forwardedEmail, "Price list.eml", 1},
+		{strings.Replace(forwardedEmail, "From: Supplier <supplier@example.com>", "broken header without colon", 1), "Price list.eml", 0},
+		{strings.Replace(forwardedEmail, "Content-Disposition: attachment; filename=\"Price list.eml\"\n", "", 1), "Price list.eml", 1},
+		{strings.Replace(strings.Replace(forwardedEmail, "Content-Disposition: attachment; filename=\"Price list.eml\"\n", "", 1),
+			"From: Supplier <supplier@example.com>", "broken header without colon", 1), "message.eml", 0},
+	}
+
+	for index, td := range testData {
+		e, err := Parse(strings.NewReader(td.mailData))
+		if err != nil {
+			t.Errorf("[Test Case %v] Error while parsing email: %v", index, err)
+			continue
+		}
+
+		if e.TextBody != "See the report below." {
+			t.Errorf("[Test Case %v] Wrong text body. Got: '%s'", index, e.TextBody)
+		}
+
+		if len(e.AttachedEmails) != td.attachedEmails {
+			t.Errorf("[Test Case %v] Incorrect number of attached emails! Expected: %v, Got: %v.", index, td.attachedEmails, len(e.AttachedEmails))
+		}
+
+		if len(e.Attachments) != 1 {
+			t.Errorf("[Test Case %v] Incorrect number of attachments! Expected: %v, Got: %v.", index, 1, len(e.Attachments))
+			continue
+		}
+
+		b, _ := ioutil.ReadAll(e.Attachments[0].Data)
+		if e.Attachments[0].Filename != td.filename || bytes.Contains(b, []byte("Subject: Price list")) == false {
+			t.Errorf("[Test Case %v] Wrong forwarded attachment. Got: %s '%s'", index, e.Attachments[0].Filename, b)
+		}
+	}
+}
+
 func parseDate(in string) time.Time {
 	out, err := time.Parse(time.RFC1123Z, in)
 	if err != nil {
@@ -946,3 +1032,145 @@ Content-Disposition: attachment;
 
 --f403045f1dcc043a44054c8e6bbf--
 `
+
+var forwardedEmail = `From: Manager <manager@example.org>
+Date: Tue, 2 Apr 2019 11:12:26 +0000
+Subject: Fwd: Price list
+To: buyer@example.org
+Content-Type: multipart/mixed; boundary=outerboundary
+
+--outerboundary
+Content-Type: text/plain; charset=UTF-8
+
+See the report below.
+--outerboundary
+Content-Type: message/rfc822
+Content-Disposition: attachment; filename="Price list.eml"
+
+From: Supplier <supplier@example.com>
+Date: Mon, 1 Apr 2019 10:00:00 +0000
+Subject: Price list
+To: manager@example.org
+Content-Type: multipart/mixed; boundary=innerboundary
+
+--innerboundary
+Content-Type: text/plain; charset=UTF-8
+
+Prices attached.
+--innerboundary
+Content-Type: text/csv; name="prices.csv"
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="prices.csv"
+
+YTtiO2M=
+--innerboundary--
+
+--outerboundary--
+`
+
+func TestDecodeContent(t *testing.T) {
+	var testData = []struct {
+		encoding string
+		content  string
+		expected string
+	}{
+		{"base64", "aXRlbTtwcmljZQ==", "item;price"},
+		{"Base64", "aXRlbTtwcmljZQ==", "item;price"},
+		{" BASE64 ", "aXRlbTtwcmljZQ==", "item;price"},
+		{"base64", "aXRlbTtwcmljZQ", "item;price"},
+		{"base64", "aXRl\r\nbTtw cmlj\tZQ==\r\n", "item;price"},
+		{"base64", "aXRlbQ==O3ByaWNl", "item;price"},
+		{"base64", "aXRlbTtwcmljZQ==!", "item;price"},
+		{"quoted-printable", "price=3D10=\r\n0 rub", "price=100 rub"},
+		{"Quoted-Printable", "=D1=86=D0=B5=D0=BD=D0=B0", "цена"},
+		{"7bit", "item;price", "item;price"},
+		{"8bit", "цена", "цена"},
+		{"binary", "\x00\x01", "\x00\x01"},
+		{"", "item;price", "item;price"},
+	}
+
+	for _, td := range testData {
+		decoded, err := decodeContent(strings.NewReader(td.content), td.encoding)
+		if err != nil {
+			t.Errorf("[%s] %q: %v", td.encoding, td.content, err)
+			continue
+		}
+
+		b, _ := ioutil.ReadAll(decoded)
+		if string(b) != td.expected {
+			t.Errorf("[%s] %q: Expected: %q, Got: %q", td.encoding, td.content, td.expected, b)
+		}
+	}
+
+	_, err := decodeContent(strings.NewReader("data"), "x-uuencode")
+	if err == nil {
+		t.Errorf("Unknown encoding is accepted")
+	}
+}
+
+func TestParseTransferEncodings(t *testing.T) {
+	e, err := Parse(strings.NewReader(transferEncodingsEmail))
+	if err != nil {
+		t.Fatalf("Error while parsing email: %v", err)
+	}
+
+	if e.TextBody != "Цена: 100 руб." {
+		t.Errorf("Wrong text body. Expected: '%s', Got: '%s'", "Цена: 100 руб.", e.TextBody)
+	}
+	if e.HTMLBody != "<p>price=100</p>" {
+		t.Errorf("Wrong html body. Expected: '%s', Got: '%s'", "<p>price=100</p>", e.HTMLBody)
+	}
+
+	expected := map[string]string{"price.csv": "item;price", "plain.csv": "a;b", "qp.csv": "a=b"}
+	if len(e.Attachments) != len(expected) {
+		t.Fatalf("Incorrect number of attachments! Expected: %v, Got: %v.", len(expected), len(e.Attachments))
+	}
+	for _, at := range e.Attachments {
+		b, _ := ioutil.ReadAll(at.Data)
+		if string(b) != expected[at.Filename] {
+			t.Errorf("Wrong attachment %s. Expected: %q, Got: %q", at.Filename, expected[at.Filename], b)
+		}
+	}
+}
+
+var transferEncodingsEmail = `From: Supplier <supplier@example.com>
+Date: Mon, 1 Apr 2019 10:00:00 +0000
+Subject: Price list
+To: manager@example.org
+Content-Type: multipart/mixed; boundary=outerboundary
+
+--outerboundary
+Content-Type: multipart/alternative; boundary=altboundary
+
+--altboundary
+Content-Type: text/plain; charset=UTF-8
+Content-Transfer-Encoding: BASE64
+
+0KbQtdC90LA6IDEw
+MCDRgNGD0LEu
+--altboundary
+Content-Type: text/html; charset=UTF-8
+Content-Transfer-Encoding: Quoted-Printable
+
+<p>price=3D10=
+0</p>
+--altboundary--
+--outerboundary
+Content-Type: text/csv; name="price.csv"
+Content-Transfer-Encoding: Base64
+Content-Disposition: attachment; filename="price.csv"
+
+aXRlbTtwcmljZQ
+--outerboundary
+Content-Type: text/csv; name="plain.csv"
+Content-Disposition: attachment; filename="plain.csv"
+
+a;b
+--outerboundary
+Content-Type: text/csv; name="qp.csv"
+Content-Transfer-Encoding: QUOTED-PRINTABLE
+Content-Disposition: attachment; filename="qp.csv"
+
+a=3Db
+--outerboundary--
+`
@@ -0,0 +1,324 @@
+package parsemail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"go.mozilla.org/pkcs7"
+)
+
+const contentTypeMultipartSigned = "multipart/signed"
+const contentTypeMultipartEncrypted = "multipart/encrypted"
+const contentTypePkcs7Mime = "application/pkcs7-mime"
+const contentTypeXPkcs7Mime = "application/x-pkcs7-mime"
+const contentTypePgpEncrypted = "application/pgp-encrypted"
+const contentTypePgpSignature = "application/pgp-signature"
+
+// signature types
+const (
+	SignatureSMIME = "smime"
+	SignaturePGP   = "pgp"
+)
+
+// CryptoKeys - keys for decryption and signature verification of S/MIME and PGP/MIME messages
+type CryptoKeys struct {
+	// SMIMECertificate and SMIMEPrivateKey - own certificate and key for decryption of S/MIME messages
+	SMIMECertificate *x509.Certificate
+	SMIMEPrivateKey  crypto.PrivateKey
+	// SMIMERoots - trusted root certificates for signature verification, system roots are used if nil
+	SMIMERoots *x509.CertPool
+	// PGPKeyring - own private keys for decryption and public keys of senders for signature verification
+	PGPKeyring openpgp.EntityList
+}
+
+// Signature - result of signature verification of S/MIME or PGP/MIME message
+type Signature struct {
+	Type   string // SignatureSMIME or SignaturePGP
+	Valid  bool   // signature is correct and signer is trusted
+	Signer string // email of certificate or PGP key identity
+	Error  string // reason if signature is not valid
+}
+
+func isSecureContentType(contentType string) bool {
+	switch contentType {
+	case contentTypeMultipartSigned, contentTypeMultipartEncrypted, contentTypePkcs7Mime, contentTypeXPkcs7Mime:
+		return true
+	}
+
+	return false
+}
+
+// parseSecure verifies or decrypts signed or encrypted content and parses message inside it into email
+func parseSecure(email *Email, contentType string, params map[string]string, header mail.Header, body io.Reader, keys *CryptoKeys) error {
+	var inner []byte
+	var err error
+
+	switch contentType {
+	case contentTypeMultipartSigned:
+		inner, err = unwrapMultipartSigned(email, params, body, keys)
+	case contentTypeMultipartEncrypted:
+		inner, err = unwrapMultipartEncrypted(email, params, body, keys)
+	default:
+		inner, err = unwrapPkcs7Mime(email, header, body, keys)
+	}
+	if err != nil {
+		return err
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(inner))
+	if err != nil {
+		return err
+	}
+
+	return parseBody(email, msg.Header, msg.Body, keys)
+}
+
+// unwrapMultipartSigned checks detached signature (RFC 1847) and returns signed part.
+// Signature error does not stop parsing, it is saved in email.Signature
+func unwrapMultipartSigned(email *Email, params map[string]string, body io.Reader, keys *CryptoKeys) ([]byte, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := splitMultipartRaw(data, params["boundary"])
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("multipart/signed must have 2 parts, found: %d", len(parts))
+	}
+
+	sigMsg, err := mail.ReadMessage(bytes.NewReader(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+	sigData, err := decodeContent(sigMsg.Body, sigMsg.Header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := ioutil.ReadAll(sigData)
+	if err != nil {
+		return nil, err
+	}
+
+	//signature is made for canonical form of content with CRLF line ends
+	signed := canonicalCRLF(parts[0])
+	if strings.ToLower(params["protocol"]) == contentTypePgpSignature {
+		email.Signature = verifyPGPDetached(signed, sig, keys)
+	} else {
+		email.Signature = verifySMIME(signed, sig, keys)
+	}
+
+	return parts[0], nil
+}
+
+// unwrapMultipartEncrypted decrypts PGP/MIME message (RFC 3156), signature inside encrypted data is checked too
+func unwrapMultipartEncrypted(email *Email, params map[string]string, body io.Reader, keys *CryptoKeys) ([]byte, error) {
+	if strings.ToLower(params["protocol"]) != contentTypePgpEncrypted {
+		return nil, fmt.Errorf("unknown multipart/encrypted protocol: %s", params["protocol"])
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := splitMultipartRaw(data, params["boundary"])
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("multipart/encrypted must have 2 parts, found: %d", len(parts))
+	}
+
+	encMsg, err := mail.ReadMessage(bytes.NewReader(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+	block, err := armor.Decode(encMsg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, keys.PGPKeyring, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can not decrypt pgp message: %v", err)
+	}
+	inner, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, fmt.Errorf("can not decrypt pgp message: %v", err)
+	}
+
+	email.Encrypted = true
+	if md.IsSigned {
+		email.Signature = &Signature{Type: SignaturePGP}
+		if md.SignedBy != nil {
+			email.Signature.Signer = pgpSigner(md.SignedBy.Entity)
+		}
+		if md.SignatureError != nil {
+			email.Signature.Error = md.SignatureError.Error()
+		} else if md.SignedBy == nil {
+			email.Signature.Error = "unknown pgp key"
+		} else {
+			email.Signature.Valid = true
+		}
+	}
+
+	return inner, nil
+}
+
+// unwrapPkcs7Mime decrypts S/MIME enveloped-data or checks opaque signed-data (RFC 8551)
+func unwrapPkcs7Mime(email *Email, header mail.Header, body io.Reader, keys *CryptoKeys) ([]byte, error) {
+	decoded, err := decodeContent(body, header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse pkcs7: %v", err)
+	}
+
+	if len(p7.Signers) > 0 {
+		email.Signature = verifyPkcs7(p7, keys)
+		return p7.Content, nil
+	}
+
+	if keys.SMIMECertificate == nil || keys.SMIMEPrivateKey == nil {
+		return nil, errors.New("can not decrypt s/mime message: certificate and private key are not set")
+	}
+	inner, err := p7.Decrypt(keys.SMIMECertificate, keys.SMIMEPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("can not decrypt s/mime message: %v", err)
+	}
+
+	email.Encrypted = true
+
+	return inner, nil
+}
+
+func verifySMIME(signed, sig []byte, keys *CryptoKeys) *Signature {
+	p7, err := pkcs7.Parse(sig)
+	if err != nil {
+		return &Signature{Type: SignatureSMIME, Error: err.Error()}
+	}
+	p7.Content = signed
+
+	return verifyPkcs7(p7, keys)
+}
+
+// verifyPkcs7 checks signature and certificate chain to SMIMERoots or system roots
+func verifyPkcs7(p7 *pkcs7.PKCS7, keys *CryptoKeys) *Signature {
+	result := &Signature{Type: SignatureSMIME}
+	if cert := p7.GetOnlySigner(); cert != nil {
+		result.Signer = cert.Subject.CommonName
+		if len(cert.EmailAddresses) > 0 {
+			result.Signer = cert.EmailAddresses[0]
+		}
+	}
+
+	roots := keys.SMIMERoots
+	if roots == nil {
+		var err error
+		roots, err = x509.SystemCertPool()
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	err := p7.VerifyWithChain(roots)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Valid = true
+
+	return result
+}
+
+func verifyPGPDetached(signed, sig []byte, keys *CryptoKeys) *Signature {
+	result := &Signature{Type: SignaturePGP}
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(keys.PGPKeyring, bytes.NewReader(signed), bytes.NewReader(sig), nil)
+	if signer != nil {
+		result.Signer = pgpSigner(signer)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Valid = true
+
+	return result
+}
+
+// pgpSigner returns email of primary identity of key
+func pgpSigner(entity *openpgp.Entity) string {
+	if entity == nil {
+		return ""
+	}
+	if ident := entity.PrimaryIdentity(); ident != nil && ident.UserId != nil {
+		return ident.UserId.Email
+	}
+
+	return ""
+}
+
+// splitMultipartRaw returns parts of multipart body byte to byte, without changes made by multipart.Reader
+func splitMultipartRaw(body []byte, boundary string) ([][]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("multipart boundary is not set")
+	}
+
+	delimiter := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for pos := 0; pos < len(body); {
+		lineEnd := len(body)
+		if i := bytes.IndexByte(body[pos:], '\n'); i >= 0 {
+			lineEnd = pos + i + 1
+		}
+
+		line := bytes.TrimRight(body[pos:lineEnd], " \t\r\n")
+		if bytes.HasPrefix(line, delimiter) {
+			rest := string(line[len(delimiter):])
+			if rest == "" || rest == "--" {
+				if start >= 0 {
+					//line break before delimiter belongs to delimiter
+					part := bytes.TrimSuffix(body[start:pos], []byte("\n"))
+					parts = append(parts, bytes.TrimSuffix(part, []byte("\r")))
+				}
+				if rest == "--" {
+					return parts, nil
+				}
+				start = lineEnd
+			}
+		}
+
+		pos = lineEnd
+	}
+
+	return parts, errors.New("multipart end is not found")
+}
+
+func canonicalCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,362 @@
+package parsemail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"go.mozilla.org/pkcs7"
+)
+
+const secureInnerPart = "Content-Type: multipart/mixed; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Statement attached\r\n" +
+	"--inner\r\n" +
+	"Content-Type: application/pdf; name=\"statement.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"statement.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--inner--\r\n"
+
+const secureHeader = "From: Bank <statements@bank.example>\r\n" +
+	"To: Buh <buh@example.com>\r\n" +
+	"Subject: Statement\r\n" +
+	"Date: Mon, 01 Mar 2021 10:00:00 +0300\r\n" +
+	"MIME-Version: 1.0\r\n"
+
+func newTestCertificate(t *testing.T, Email string, Parent *x509.Certificate, ParentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: Email},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	if Parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		Parent, ParentKey = template, key
+	} else {
+		template.EmailAddresses = []string{Email}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, Parent, &key.PublicKey, ParentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func base64Lines(data []byte) string {
+	s := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	for len(s) > 76 {
+		b.WriteString(s[:76] + "\r\n")
+		s = s[76:]
+	}
+	b.WriteString(s + "\r\n")
+
+	return b.String()
+}
+
+func checkSecureEmail(t *testing.T, name string, email Email) {
+	if email.Subject != "Statement" {
+		t.Errorf("[%s] Wrong subject: %s", name, email.Subject)
+	}
+	if email.TextBody != "Statement attached" {
+		t.Errorf("[%s] Wrong text body: %q", name, email.TextBody)
+	}
+	if len(email.Attachments) != 1 || email.Attachments[0].Filename != "statement.pdf" {
+		t.Fatalf("[%s] Attachment not found: %v", name, email.Attachments)
+	}
+	data, _ := ioutil.ReadAll(email.Attachments[0].Data)
+	if string(data) != "%PDF-1.4\n" {
+		t.Errorf("[%s] Wrong attachment data: %q", name, data)
+	}
+}
+
+func TestParseSMIME(t *testing.T) {
+	ca, caKey := newTestCertificate(t, "Test CA", nil, nil)
+	cert, key := newTestCertificate(t, "statements@bank.example", ca, caKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	Keys := &CryptoKeys{SMIMECertificate: cert, SMIMEPrivateKey: key, SMIMERoots: roots}
+
+	//multipart/signed with detached signature
+	sd, err := pkcs7.NewSignedData([]byte(secureInnerPart))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.Detach()
+	sig, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := secureHeader +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		secureInnerPart +
+		"\r\n--outer\r\n" +
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64Lines(sig) +
+		"--outer--\r\n"
+
+	email, err := ParseWithKeys(strings.NewReader(signed), Keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSecureEmail(t, "smime signed", email)
+	if email.Signature == nil || email.Signature.Valid == false || email.Signature.Signer != "statements@bank.example" {
+		t.Errorf("[smime signed] Wrong signature: %+v", email.Signature)
+	}
+
+	//changed content
+	email, err = ParseWithKeys(strings.NewReader(strings.Replace(signed, "Statement attached", "Statement changed!", 1)), Keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email.Signature == nil || email.Signature.Valid == true {
+		t.Errorf("[smime changed] Signature must be invalid: %+v", email.Signature)
+	}
+
+	//untrusted root
+	Keys.SMIMERoots = x509.NewCertPool()
+	email, err = ParseWithKeys(strings.NewReader(signed), Keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email.Signature == nil || email.Signature.Valid == true {
+		t.Errorf("[smime untrusted] Signature must be invalid: %+v", email.Signature)
+	}
+
+	//enveloped-data
+	encrypted, err := pkcs7.Encrypt([]byte(secureInnerPart), []*x509.Certificate{cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := secureHeader +
+		"Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64Lines(encrypted)
+
+	email, err = ParseWithKeys(strings.NewReader(message), Keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSecureEmail(t, "smime encrypted", email)
+	if email.Encrypted == false || email.Signature != nil {
+		t.Errorf("[smime encrypted] Wrong flags: %v %+v", email.Encrypted, email.Signature)
+	}
+
+	_, err = Parse(strings.NewReader(message))
+	if err == nil {
+		t.Errorf("[smime encrypted] Error expected without private key")
+	}
+}
+
+func TestParsePGP(t *testing.T) {
+	sender, err := openpgp.NewEntity("Bank", "", "statements@bank.example", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := openpgp.NewEntity("Buh", "", "buh@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Keys := &CryptoKeys{PGPKeyring: openpgp.EntityList{sender, recipient}}
+
+	//multipart/signed
+	var sig bytes.Buffer
+	err = openpgp.ArmoredDetachSign(&sig, sender, strings.NewReader(secureInnerPart), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := secureHeader +
+		"Content-Type: multipart/signed; protocol=\"application/pgp-signature\"; micalg=pgp-sha256; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		secureInnerPart +
+		"\r\n--outer\r\n" +
+		"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n" +
+		"\r\n" +
+		sig.String() + "\r\n" +
+		"--outer--\r\n"
+
+	email, err := ParseWithKeys(strings.NewReader(signed), Keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSecureEmail(t, "pgp signed", email)
+	if email.Signature == nil || email.Signature.Valid == false || email.Signature.Signer != "statements@bank.example" {
+		t.Errorf("[pgp signed] Wrong signature: %+v", email.Signature)
+	}
+
+	//unix line ends in stored message
+	email, err = ParseWithKeys(strings.NewReader(strings.ReplaceAll(signed, "\r\n", "\n")), Keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email.Signature == nil || email.Signature.Valid == false {
+		t.Errorf("[pgp signed lf] Wrong signature: %+v", email.Signature)
+	}
+
+	//multipart/encrypted, signed inside
+	var encrypted bytes.Buffer
+	aw, err := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := openpgp.Encrypt(aw, []*openpgp.Entity{recipient}, sender, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte(secureInnerPart))
+	w.Close()
+	aw.Close()
+
+	message := secureHeader +
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pgp-encrypted\r\n" +
+		"\r\n" +
+		"Version: 1\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n" +
+		"\r\n" +
+		encrypted.String() + "\r\n" +
+		"--outer--\r\n"
+
+	email, err = ParseWithKeys(strings.NewReader(message), Keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSecureEmail(t, "pgp encrypted", email)
+	if email.Encrypted == false || email.Signature == nil || email.Signature.Valid == false {
+		t.Errorf("[pgp encrypted] Wrong flags: %v %+v", email.Encrypted, email.Signature)
+	}
+}
+
+func TestParseNestedSMIME(t *testing.T) {
+	ca, caKey := newTestCertificate(t, "Test CA", nil, nil)
+	cert, key := newTestCertificate(t, "statements@bank.example", ca, caKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	Keys := &CryptoKeys{SMIMECertificate: cert, SMIMEPrivateKey: key, SMIMERoots: roots}
+
+	sd, err := pkcs7.NewSignedData([]byte(secureInnerPart))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.Detach()
+	sig, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedPart := "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=\"signed\"\r\n" +
+		"\r\n" +
+		"--signed\r\n" +
+		secureInnerPart +
+		"\r\n--signed\r\n" +
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64Lines(sig) +
+		"--signed--\r\n"
+
+	encrypted, err := pkcs7.Encrypt([]byte(secureInnerPart), []*x509.Certificate{cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedPart := "Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64Lines(encrypted)
+
+	footerPart := "Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Sent by mailing list\r\n"
+	unsignedPart := "Content-Type: application/pdf; name=\"fake.pdf\"\r\n" +
+		"Content-Disposition: attachment; filename=\"fake.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0xLjQK\r\n"
+
+	var testData = []struct {
+		Parts     []string
+		Signed    bool
+		Valid     bool
+		Encrypted bool
+	}{
+		{[]string{signedPart}, true, true, false},
+		//text added by mailing list does not change signature
+		{[]string{signedPart, footerPart}, true, true, false},
+		//attachment outside of signed part
+		{[]string{signedPart, unsignedPart}, true, false, false},
+		{[]string{unsignedPart, signedPart}, true, false, false},
+		{[]string{encryptedPart}, false, false, true},
+		{[]string{encryptedPart, signedPart}, true, true, true},
+	}
+
+	for i, Test := range testData {
+		message := secureHeader + "Content-Type: multipart/mixed; boundary=\"outer\"\r\n\r\n"
+		for _, Part := range Test.Parts {
+			message += "--outer\r\n" + Part + "\r\n"
+		}
+		message += "--outer--\r\n"
+
+		email, err := ParseWithKeys(strings.NewReader(message), Keys)
+		if err != nil {
+			t.Errorf("[Test Case %v] Error: %v", i+1, err)
+			continue
+		}
+		if (email.Signature != nil) != Test.Signed || (email.Signature != nil && email.Signature.Valid != Test.Valid) {
+			t.Errorf("[Test Case %v] Wrong signature: %+v", i+1, email.Signature)
+		}
+		if email.Encrypted != Test.Encrypted {
+			t.Errorf("[Test Case %v] Wrong encrypted flag: %v", i+1, email.Encrypted)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package parsemail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// TNEF (winmail.dat, application/ms-tnef) format is described in [MS-OXTNEF]
+
+const contentTypeMsTnef = "application/ms-tnef"
+
+const tnefSignature = 0x223E9F78
+
+const tnefLevelAttachment = 0x02
+
+// attribute ids, without attribute type in high word
+const (
+	tnefAttAttachData     = 0x800F
+	tnefAttAttachTitle    = 0x8010
+	tnefAttAttachRendData = 0x9002
+	tnefAttAttachment     = 0x9005
+	tnefAttOemCodepage    = 0x9007
+)
+
+// MAPI property ids and types used in attAttachment
+const (
+	mapiAttachDataObj      = 0x3701
+	mapiAttachLongFilename = 0x3707
+	mapiAttachMimeTag      = 0x370E
+	mapiDisplayName        = 0x3001
+
+	mapiTypeMultiple = 0x1000
+	mapiTypeString8  = 0x001E
+	mapiTypeUnicode  = 0x001F
+	mapiTypeBinary   = 0x0102
+	mapiTypeObject   = 0x000D
+)
+
+var ErrTnefSignature = errors.New("tnef: wrong signature")
+var ErrTnefTruncated = errors.New("tnef: data is truncated")
+
+// IsTnef returns true if attachment is TNEF encoded (winmail.dat)
+func IsTnef(at Attachment) bool {
+	return strings.ToLower(at.ContentType) == contentTypeMsTnef || strings.ToLower(at.Filename) == "winmail.dat"
+}
+
+// DecodeTnef returns files embedded in TNEF data as ordinary attachments
+func DecodeTnef(data []byte) (attachments []Attachment, err error) {
+	if len(data) < 6 || binary.LittleEndian.Uint32(data) != tnefSignature {
+		return nil, ErrTnefSignature
+	}
+
+	codepage := uint32(1252)
+	var files []*tnefFile
+	var file *tnefFile
+
+	pos := 6
+	for pos < len(data) {
+		if pos+9 > len(data) {
+			return nil, ErrTnefTruncated
+		}
+		level := data[pos]
+		id := binary.LittleEndian.Uint32(data[pos+1:]) & 0xFFFF
+		length := int(binary.LittleEndian.Uint32(data[pos+5:]))
+		pos += 9
+		if length < 0 || pos+length+2 > len(data) {
+			return nil, ErrTnefTruncated
+		}
+		value := data[pos : pos+length]
+		pos += length + 2 //checksum
+
+		switch {
+		case id == tnefAttOemCodepage && len(value) >= 4:
+			codepage = binary.LittleEndian.Uint32(value)
+		case level != tnefLevelAttachment:
+			continue
+		case id == tnefAttAttachRendData:
+			file = &tnefFile{}
+			files = append(files, file)
+		case file == nil:
+			continue
+		case id == tnefAttAttachTitle:
+			file.title = decodeTnefString8(value, codepage)
+		case id == tnefAttAttachData:
+			file.data = value
+		case id == tnefAttAttachment:
+			//MAPI properties are optional, attAttachTitle and attAttachData are enough
+			_ = file.readMapiProps(value, codepage)
+		}
+	}
+
+	for _, f := range files {
+		if f.data == nil {
+			continue
+		}
+
+		filename := f.longFilename
+		if filename == "" {
+			filename = f.title
+		}
+		if filename == "" {
+			filename = f.displayName
+		}
+
+		contentType := f.mimeTag
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		attachments = append(attachments, Attachment{
+			Filename:    filename,
+			ContentType: contentType,
+			Data:        bytes.NewReader(f.data),
+		})
+	}
+
+	return attachments, nil
+}
+
+type tnefFile struct {
+	title        string
+	longFilename string
+	displayName  string
+	mimeTag      string
+	data         []byte
+}
+
+// readMapiProps reads attachment properties from attAttachment attribute
+func (f *tnefFile) readMapiProps(b []byte, codepage uint32) error {
+	r := tnefReader{b: b}
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		propType := r.uint16()
+		propId := r.uint16()
+
+		if propId >= 0x8000 {
+			//named property: guid, kind, id or name
+			r.skip(16)
+			if r.uint32() == 0 {
+				r.skip(4)
+			} else {
+				r.skip(int(r.uint32()))
+				r.align()
+			}
+		}
+
+		values := r.values(propType)
+		if r.err != nil || len(values) == 0 {
+			continue
+		}
+		value := values[0]
+
+		switch propId {
+		case mapiAttachLongFilename:
+			f.longFilename = decodeMapiString(propType, value, codepage)
+		case mapiDisplayName:
+			f.displayName = decodeMapiString(propType, value, codepage)
+		case mapiAttachMimeTag:
+			f.mimeTag = decodeMapiString(propType, value, codepage)
+		case mapiAttachDataObj:
+			if propType == mapiTypeObject && len(value) > 16 {
+				//object data starts with interface identifier
+				value = value[16:]
+			}
+			if f.data == nil {
+				f.data = value
+			}
+		}
+	}
+
+	return r.err
+}
+
+type tnefReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *tnefReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.b) {
+		r.err = ErrTnefTruncated
+		return nil
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *tnefReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *tnefReader) align() {
+	if r.pos%4 != 0 {
+		r.skip(4 - r.pos%4)
+	}
+}
+
+func (r *tnefReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *tnefReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// values reads MAPI property value(s), variable length types always have count of values
+func (r *tnefReader) values(propType uint16) (values [][]byte) {
+	baseType := propType &^ mapiTypeMultiple
+
+	size := 0
+	switch baseType {
+	case 0x0002, 0x0003, 0x0004, 0x000A, 0x000B, 0x0001:
+		size = 4
+	case 0x0005, 0x0006, 0x0007, 0x0014, 0x0040:
+		size = 8
+	case 0x0048:
+		size = 16
+	case mapiTypeString8, mapiTypeUnicode, mapiTypeBinary, mapiTypeObject:
+		size = -1
+	default:
+		r.err = errors.New("tnef: unknown MAPI property type")
+		return nil
+	}
+
+	count := uint32(1)
+	if size < 0 || propType&mapiTypeMultiple != 0 {
+		count = r.uint32()
+	}
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		n := size
+		if n < 0 {
+			n = int(r.uint32())
+		}
+		values = append(values, r.bytes(n))
+		r.align()
+	}
+
+	return values
+}
+
+func decodeMapiString(propType uint16, b []byte, codepage uint32) string {
+	if propType&^mapiTypeMultiple == mapiTypeUnicode {
+		u := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			u = append(u, binary.LittleEndian.Uint16(b[i:]))
+		}
+		return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+	}
+
+	return decodeTnefString8(b, codepage)
+}
+
+// decodeTnefString8 decodes null terminated string in ANSI codepage of message
+func decodeTnefString8(b []byte, codepage uint32) string {
+	b = bytes.TrimRight(b, "\x00")
+
+	switch codepage {
+	case 1251:
+		return string(DecodeWindows1251(b))
+	case 866:
+		s, _ := charmap.CodePage866.NewDecoder().Bytes(b)
+		return string(s)
+	case 20866:
+		s, _ := charmap.KOI8R.NewDecoder().Bytes(b)
+		return string(s)
+	case 1252:
+		s, _ := charmap.Windows1252.NewDecoder().Bytes(b)
+		return string(s)
+	}
+
+	return string(b)
+}
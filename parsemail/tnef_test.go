@@ -0,0 +1,143 @@
+package parsemail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestDecodeTnef(t *testing.T) {
+	attachments, err := DecodeTnef(tnefExample())
+	if err != nil {
+		t.Fatalf("Error while decoding tnef: %v", err)
+	}
+
+	if len(attachments) != 2 {
+		t.Fatalf("Incorrect number of attachments! Expected: %v, Got: %v.", 2, len(attachments))
+	}
+
+	var testData = []struct {
+		filename    string
+		contentType string
+		data        string
+	}{
+		{"Отчёт за март.xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "xlsx data"},
+		{"NOTES.TXT", "application/octet-stream", "notes"},
+	}
+
+	for i, td := range testData {
+		at := attachments[i]
+		b, err := ioutil.ReadAll(at.Data)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if at.Filename != td.filename || at.ContentType != td.contentType || string(b) != td.data {
+			t.Errorf("[Attachment %v] Expected: %s %s '%s', Got: %s %s '%s'", i, td.filename, td.contentType, td.data, at.Filename, at.ContentType, b)
+		}
+	}
+}
+
+func TestDecodeTnefWrongSignature(t *testing.T) {
+	_, err := DecodeTnef([]byte("not a tnef file"))
+	if err != ErrTnefSignature {
+		t.Errorf("Expected: %v, Got: %v", ErrTnefSignature, err)
+	}
+}
+
+func TestParseEmailWithTnef(t *testing.T) {
+	data := strings.ReplaceAll(tnefEmail, "TNEFDATA", base64.StdEncoding.EncodeToString(tnefExample()))
+	e, err := Parse(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error while parsing email: %v", err)
+	}
+
+	if len(e.Attachments) != 2 {
+		t.Fatalf("Incorrect number of attachments! Expected: %v, Got: %v.", 2, len(e.Attachments))
+	}
+
+	if e.Attachments[0].Filename != "Отчёт за март.xlsx" {
+		t.Errorf("Wrong filename. Expected: %s, Got: %s", "Отчёт за март.xlsx", e.Attachments[0].Filename)
+	}
+}
+
+// tnefExample builds winmail.dat with two files:
+// first one has MAPI long filename and mime tag, second one only 8.3 title
+func tnefExample() []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(tnefSignature))
+	binary.Write(&b, binary.LittleEndian, uint16(1))
+
+	writeTnefAttribute(&b, 0x01, 0x00069007, []byte{0xE4, 0x04, 0, 0, 0, 0, 0, 0})
+
+	writeTnefAttribute(&b, tnefLevelAttachment, 0x00069002, make([]byte, 14))
+	writeTnefAttribute(&b, tnefLevelAttachment, 0x00018010, []byte("OTCHET~1.XLS\x00"))
+	writeTnefAttribute(&b, tnefLevelAttachment, 0x0006800F, []byte("xlsx data"))
+
+	var props bytes.Buffer
+	binary.Write(&props, binary.LittleEndian, uint32(2))
+	writeMapiVariable(&props, mapiTypeUnicode, mapiAttachLongFilename, utf16le("Отчёт за март.xlsx\x00"))
+	writeMapiVariable(&props, mapiTypeString8, mapiAttachMimeTag, []byte("application/vnd.openxmlformats-officedocument.spreadsheetml.sheet\x00"))
+	writeTnefAttribute(&b, tnefLevelAttachment, 0x00069005, props.Bytes())
+
+	writeTnefAttribute(&b, tnefLevelAttachment, 0x00069002, make([]byte, 14))
+	writeTnefAttribute(&b, tnefLevelAttachment, 0x00018010, []byte("NOTES.TXT\x00"))
+	writeTnefAttribute(&b, tnefLevelAttachment, 0x0006800F, []byte("notes"))
+
+	return b.Bytes()
+}
+
+func writeTnefAttribute(b *bytes.Buffer, level byte, id uint32, data []byte) {
+	b.WriteByte(level)
+	binary.Write(b, binary.LittleEndian, id)
+	binary.Write(b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+
+	checksum := uint16(0)
+	for _, c := range data {
+		checksum += uint16(c)
+	}
+	binary.Write(b, binary.LittleEndian, checksum)
+}
+
+func writeMapiVariable(b *bytes.Buffer, propType, propId uint16, data []byte) {
+	binary.Write(b, binary.LittleEndian, propType)
+	binary.Write(b, binary.LittleEndian, propId)
+	binary.Write(b, binary.LittleEndian, uint32(1))
+	binary.Write(b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+}
+
+func utf16le(s string) []byte {
+	var b bytes.Buffer
+	for _, c := range utf16.Encode([]rune(s)) {
+		binary.Write(&b, binary.LittleEndian, c)
+	}
+	return b.Bytes()
+}
+
+var tnefEmail = `From: Outlook User <user@example.com>
+Date: Tue, 2 Apr 2019 11:12:26 +0000
+Subject: Report
+To: buyer@example.org
+Content-Type: multipart/mixed; boundary=tnefboundary
+
+--tnefboundary
+Content-Type: text/plain; charset=UTF-8
+
+Report attached.
+--tnefboundary
+Content-Type: application/ms-tnef; name="winmail.dat"
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="winmail.dat"
+
+TNEFDATA
+--tnefboundary--
+`
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+	"DownloadEmailsAttachments/parsemail"
+)
+
+// ProcessOptions - settings of message processing, they are read from settings for every message
+type ProcessOptions struct {
+	DownloadFromDate time.Time
+	// Filter - attachments which are saved, the same filter is set in config of downloader
+	Filter         downloader.AttachmentFilter
+	ExpandArchives bool
+	SaveEml        string
+	// SaveEmlRules - SaveEml for some senders: price@supplier.ru:all,@bank.ru:instead
+	SaveEmlRules string
+	// Reprocess - message is processed again by request from admin API or from dead-letter list,
+	// DownloadFromDate is not checked
+	Reprocess bool
+}
+
+// NewProcessOptions reads processing settings
+func NewProcessOptions() (ProcessOptions, error) {
+	sDownloadFromDate := myEnv["DownloadFromDate"]
+	if sDownloadFromDate == "" {
+		sDownloadFromDate = "2000-01-01 00:00:00"
+	}
+	layout := "2006-01-02 15:04:05"
+	DownloadFromDate, err := time.Parse(layout, sDownloadFromDate)
+	if err != nil {
+		return ProcessOptions{}, errors.New("wrong DownloadFromDate: " + sDownloadFromDate)
+	}
+
+	return ProcessOptions{
+		DownloadFromDate: DownloadFromDate,
+		Filter:           NewAttachmentFilter(),
+		ExpandArchives:   myEnv["ExpandArchives"] == "true",
+		SaveEml:          myEnv["SaveEml"],
+		SaveEmlRules:     myEnv["SaveEmlRules"],
+	}, nil
+}
+
+// SaveEmlFor returns SaveEml value for sender, SaveEmlRules is preferred to SaveEml
+func (Options ProcessOptions) SaveEmlFor(EmailAddress string) string {
+	if SaveEml, ok := SenderSetting(Options.SaveEmlRules, EmailAddress); ok == true {
+		return strings.TrimSpace(SaveEml)
+	}
+
+	return Options.SaveEml
+}
+
+// NewAttachmentFilter creates filter of attachments from FileExtensions setting
+func NewAttachmentFilter() downloader.AttachmentFilter {
+	return downloader.NewExtensionFilter(myEnv["FileExtensions"])
+}
+
+// HandleMessage - message handler of downloader, settings are read again for every message
+func HandleMessage(ctx context.Context, m *downloader.Message) error {
+	Options, err := NewProcessOptions()
+	if err != nil {
+		return err
+	}
+	Options.Reprocess = m.Reprocessed
+
+	return ProcessMessage(m, Options)
+}
+
+// ProcessMessage saves attachments of one fetched message.
+// Failed message is added to dead-letter list and retried later, processed message is removed from it.
+// Error of failed message is returned, so downloader sends EventMessageFailed
+func ProcessMessage(m *downloader.Message, Options ProcessOptions) error {
+	err := processMessage(m, Options)
+	Metadata := NewMessageMetadata(m, parsemail.Email{})
+	if DryRun == true {
+		if err != nil {
+			ReportMessage(Metadata, "fail", err.Error())
+		}
+		return err
+	}
+	if err == nil {
+		DeadLetters.Remove(Metadata.Account, Metadata.Folder, Metadata.UID)
+		return nil
+	}
+
+	Stage := StageAttachment
+	var Hooks []FailedHook
+	var MsgError *MessageError
+	if errors.As(err, &MsgError) {
+		Stage = MsgError.Stage
+		Hooks = MsgError.Hooks
+	}
+
+	Failed := DeadLetters.Add(Metadata, m.SeqNum, Stage, err, Hooks)
+	Logger := MessageLogger(Metadata)
+	if Failed.Attempts >= RetryMaxAttempts() {
+		Logger.Error("Message is not processed, retry budget is exhausted", "stage", Stage, "attempts", Failed.Attempts, "error", err)
+	} else {
+		Logger.Error("Message is not processed, it will be retried", "stage", Stage, "attempts", Failed.Attempts, "next_retry", Failed.NextRetry, "error", err)
+	}
+	Status.SetError(err)
+
+	if Stage == StageParse {
+		MetricParseErrors.Inc()
+		CatalogAddMessage(Metadata, m.SeqNum, MessageStatusParseError, err)
+		PostWebhookEvent(WebhookEvent{Type: EventParseError, Message: &Metadata, Error: err.Error()})
+	} else if Stage != StageHook {
+		CatalogAddMessage(Metadata, m.SeqNum, MessageStatusFailed, err)
+	}
+
+	return err
+}
+
+func processMessage(m *downloader.Message, Options ProcessOptions) error {
+	ExpandArchives := Options.ExpandArchives
+	//UID does not change when other messages are deleted, so it is used in names of files
+	sMessageId := strconv.FormatUint(uint64(m.UID), 10)
+	MetricMessagesScanned.Inc()
+	Logger := slog.With("account", m.Account, "folder", m.Folder, "uid", m.UID, "seq", m.SeqNum)
+
+	if m.Raw == nil {
+		return &MessageError{Stage: StageFetch, Err: errors.New("server didn't return message body")}
+	}
+	RawBytes := m.Raw
+	MetricBytesDownloaded.Add(float64(len(RawBytes)))
+
+	email, err := parsemail.ParseWithKeys(bytes.NewReader(RawBytes), Keys)
+	if err != nil {
+		return &MessageError{Stage: StageParse, Err: err}
+	}
+
+	MessageMetadata := NewMessageMetadata(m, email)
+	Logger = MessageLogger(MessageMetadata)
+
+	if Options.Reprocess == false && MessageMetadata.Date.Before(Options.DownloadFromDate) {
+		CatalogAddMessage(MessageMetadata, m.SeqNum, MessageStatusSkipped, nil)
+		ReportMessage(MessageMetadata, "skip", "before DownloadFromDate")
+		return nil
+	}
+
+	EmailFrom, EmailAddress := downloader.MessageSender(email)
+
+	err = CheckSignature(email, EmailAddress)
+	if err != nil {
+		Logger.Warn("Message is skipped", "from", EmailAddress, "error", err)
+		CatalogAddMessage(MessageMetadata, m.SeqNum, MessageStatusSignatureInvalid, err)
+		ReportMessage(MessageMetadata, "skip", MessageStatusSignatureInvalid+": "+err.Error())
+		MetricMessagesSkipped.WithLabelValues(MessageStatusSignatureInvalid).Inc()
+		return nil
+	}
+
+	err = CheckSenderAuth(RawBytes, EmailAddress)
+	if errors.Is(err, ErrAuthTemporary) {
+		//DNS is not available, message is checked again on retry
+		return &MessageError{Stage: StageAuth, Err: err}
+	} else if err != nil {
+		Logger.Warn("Message is skipped", "from", EmailAddress, "error", err)
+		CatalogAddMessage(MessageMetadata, m.SeqNum, MessageStatusAuthFailed, err)
+		ReportMessage(MessageMetadata, "skip", MessageStatusAuthFailed+": "+err.Error())
+		MetricMessagesSkipped.WithLabelValues(MessageStatusAuthFailed).Inc()
+		return nil
+	}
+
+	SaveEml := Options.SaveEmlFor(EmailAddress)
+	SaveAttachments := SaveEml != SaveEmlInstead
+
+	ReportMessage(MessageMetadata, "process", "")
+	MatchedCount := 0
+	var SavedFiles []string
+	var SaveErrors, HookErrors []error
+	for _, Attachment1 := range downloader.CollectAttachments(email, EmailFrom, EmailAddress) {
+		file1 := Attachment1.Attachment
+		Metadata := MessageMetadata
+		Metadata.From = Attachment1.EmailAddress
+		Metadata.ForwardedFrom = Attachment1.ForwardedFrom
+		Metadata.OriginalFilename = file1.Filename
+		Metadata.ContentType = file1.ContentType
+		Filename := file1.Filename
+
+		if Filename == "" {
+			Logger.Warn("Empty filename of attachment")
+		}
+
+		NeedSave, Reason := Options.Filter.Accept(m, Attachment1)
+		NeedExpand := ExpandArchives && IsArchive(Filename)
+		if NeedSave == false && NeedExpand == false {
+			MetricAttachmentsSkipped.WithLabelValues(Reason).Inc()
+			ReportSkippedFile(Filename, Reason)
+			continue
+		}
+
+		Logger.Debug("Attachment matched", "file", file1.Filename)
+		massBytes, err := ioutil.ReadAll(file1.Data)
+		if err != nil {
+			return &MessageError{Stage: StageAttachment, Err: fmt.Errorf("can not read attachment %s: %w", file1.Filename, err)}
+		}
+
+		if NeedSave == true {
+			MatchedCount++
+		}
+		if NeedSave == true && SaveAttachments == true {
+			FilenameNew := Attachment1.EmailFrom + "_" + Filename
+			Locations, err := SaveFileConverted(FilenameNew, massBytes, Metadata)
+			SavedFiles = append(SavedFiles, Locations...)
+			if hookFailed(err) {
+				HookErrors = append(HookErrors, err)
+			} else if err != nil {
+				SaveErrors = append(SaveErrors, err)
+			}
+		}
+
+		if NeedExpand == false {
+			continue
+		}
+
+		Files, err := ExpandArchive(Filename, massBytes, ArchivePassword(Attachment1.EmailAddress), 0, NewArchiveLimits())
+		if err != nil {
+			Logger.Warn("Can not expand archive", "file", Filename, "error", err)
+			ReportSkippedFile(Filename, "can not expand archive: "+err.Error())
+			continue
+		}
+
+		for _, File1 := range Files {
+			ArchiveFile := Attachment1
+			ArchiveFile.Attachment = parsemail.Attachment{Filename: File1.Filename, Data: bytes.NewReader(File1.Data)}
+			if ok, Reason := Options.Filter.Accept(m, ArchiveFile); ok == false {
+				MetricAttachmentsSkipped.WithLabelValues(Reason).Inc()
+				ReportSkippedFile(Filename+"/"+File1.Filename, Reason)
+				continue
+			}
+
+			MatchedCount++
+			if SaveAttachments == false {
+				continue
+			}
+
+			Logger.Debug("Archive file matched", "archive", Filename, "file", File1.Filename)
+			FilenameNew := Attachment1.EmailFrom + "_" + File1.Filename
+			Metadata1 := Metadata
+			Metadata1.OriginalFilename = Filename + "/" + File1.Filename
+			Metadata1.ContentType = mime.TypeByExtension(strings.ToLower(filepath.Ext(File1.Filename)))
+			Locations, err := SaveFileConverted(FilenameNew, File1.Data, Metadata1)
+			SavedFiles = append(SavedFiles, Locations...)
+			if hookFailed(err) {
+				HookErrors = append(HookErrors, err)
+			} else if err != nil {
+				SaveErrors = append(SaveErrors, err)
+			}
+		}
+	}
+
+	if myEnv["SaveBody"] != "" {
+		err = SaveBodyFiles(EmailFrom, sMessageId, email, MessageMetadata.FileTime())
+		if err != nil {
+			SaveErrors = append(SaveErrors, err)
+		}
+	}
+
+	if SaveEml == SaveEmlAll || (SaveEml != SaveEmlOff && MatchedCount > 0) {
+		err = SaveEmlFile(EmailFrom, email.Subject, sMessageId, RawBytes, MessageMetadata.FileTime())
+		if err != nil {
+			SaveErrors = append(SaveErrors, err)
+		}
+	}
+
+	//message is retried, files saved before are handled by DuplicateFiles setting, failed hooks are run again
+	if len(SaveErrors) > 0 {
+		Hooks := failedHooks(errors.Join(HookErrors...))
+		SaveErrors = append(SaveErrors, HookErrors...)
+		return &MessageError{Stage: StageAttachment, Err: errors.Join(SaveErrors...), Hooks: Hooks}
+	}
+
+	err = RunMessageHook(MessageMetadata, SavedFiles)
+	if err != nil {
+		HookErrors = append(HookErrors, err)
+	}
+	PostWebhookEvent(WebhookEvent{Type: EventMessageProcessed, Message: &MessageMetadata})
+
+	//files are saved, with HookFailurePolicy retry only failed hooks are run again later, with fail message stays hook_failed
+	if len(HookErrors) > 0 {
+		err = errors.Join(HookErrors...)
+		CatalogAddMessage(MessageMetadata, m.SeqNum, MessageStatusHookFailed, err)
+		Hooks := failedHooks(err)
+		if len(Hooks) == 0 {
+			Logger.Warn("Hook failed, message is marked hook_failed", "error", err)
+			return nil
+		}
+		return &MessageError{Stage: StageHook, Err: err, Hooks: Hooks}
+	}
+	CatalogAddMessage(MessageMetadata, m.SeqNum, MessageStatusProcessed, nil)
+
+	return nil
+}
+
+// hookFailed returns true if err contains only hook errors, so files are saved
+func hookFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	if Joined, ok := err.(interface{ Unwrap() []error }); ok == true {
+		for _, err1 := range Joined.Unwrap() {
+			if hookFailed(err1) == false {
+				return false
+			}
+		}
+		return true
+	}
+
+	var HookErr *HookError
+	return errors.As(err, &HookErr)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+	"github.com/joho/godotenv"
+)
+
+// MailDownloader - downloader of account from settings, created by NewDownloader
+var MailDownloader *downloader.Downloader
+
+func LoadEnv() {
+	var err error
+	myEnv, err = godotenv.Read(Filename_Settings)
+	if err != nil {
+		Fatal("Can not parse settings file", "file", Filename_Settings, "error", err)
+	}
+}
+
+// NewMailSource creates source from MailSource setting: imap (default) or dir - directory MailDirectory with .eml files.
+// ReadOnly - IMAP folder is selected read-only and messages are not marked as seen
+func NewMailSource(ReadOnly bool) (downloader.MailSource, error) {
+	switch myEnv["MailSource"] {
+	case "", "imap":
+		return &downloader.IMAPSource{
+			Address:   myEnv["IMAP_SERVER"],
+			Username:  myEnv["EMAIL"],
+			Password:  myEnv["PASSWORD"],
+			Folder:    MailboxName,
+			TLSConfig: &tls.Config{},
+			ReadOnly:  ReadOnly,
+		}, nil
+	case "dir":
+		if myEnv["MailDirectory"] == "" {
+			return nil, errors.New("MailDirectory is not set")
+		}
+		return &downloader.DirSource{Directory: myEnv["MailDirectory"], Account: myEnv["EMAIL"]}, nil
+	}
+
+	return nil, fmt.Errorf("unknown MailSource: %s", myEnv["MailSource"])
+}
+
+// NewCheckpointStore creates store from CheckpointStore setting: file (default), sqlite or redis.
+// Writes are batched: checkpoint is written after CheckpointBatchSize messages (default 10)
+// or CheckpointBatchSeconds (default 5) and at the end of every sync
+func NewCheckpointStore(Source downloader.MailSource) (*AccountCheckpointStore, error) {
+	var Store downloader.CheckpointStore
+	var err error
+	switch myEnv["CheckpointStore"] {
+	case "", "file":
+		Filename := myEnv["CheckpointFile"]
+		if Filename == "" {
+			Filename = "Checkpoints.json"
+		}
+		Store, err = downloader.NewFileCheckpointStore(Filename)
+	case "sqlite":
+		Filename := myEnv["CheckpointFile"]
+		if Filename == "" {
+			Filename = "Checkpoints.db"
+		}
+		Store, err = downloader.NewSQLiteCheckpointStore(Filename)
+	case "redis":
+		Store, err = downloader.NewRedisCheckpointStore(context.Background(), myEnv["CheckpointRedisAddress"],
+			myEnv["CheckpointRedisPassword"], settingInt("CheckpointRedisDB", 0))
+	default:
+		return nil, fmt.Errorf("unknown CheckpointStore: %s", myEnv["CheckpointStore"])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	Batch := downloader.NewBatchCheckpointStore(Store, settingInt("CheckpointBatchSize", 10),
+		time.Duration(settingInt("CheckpointBatchSeconds", 5))*time.Second)
+	IMAPSource, _ := Source.(*downloader.IMAPSource)
+
+	return &AccountCheckpointStore{Store: Batch, Source: IMAPSource}, nil
+}
+
+// AccountCheckpointStore - checkpoint store of account from settings. Until the first checkpoint is saved
+// old LastEmailUID and UIDValidity settings are used, old LastEmailID (number of message) is converted to UID by Source.
+// Saved checkpoint is shown on status page, nothing is saved in dry-run
+type AccountCheckpointStore struct {
+	Store  *downloader.BatchCheckpointStore
+	Source *downloader.IMAPSource
+}
+
+func (s *AccountCheckpointStore) Load(ctx context.Context, Key downloader.CheckpointKey) (uint32, error) {
+	UID, err := s.Store.Load(ctx, Key)
+	if err != nil || UID > 0 {
+		Status.SetCheckpoint(strconv.FormatUint(uint64(UID), 10))
+		return UID, err
+	}
+
+	UID, err = s.loadSettings(ctx, Key)
+	if err == nil {
+		Status.SetCheckpoint(strconv.FormatUint(uint64(UID), 10))
+	}
+
+	return UID, err
+}
+
+// loadSettings returns checkpoint from settings of old versions
+func (s *AccountCheckpointStore) loadSettings(ctx context.Context, Key downloader.CheckpointKey) (uint32, error) {
+	sUIDValidity := strconv.FormatUint(uint64(Key.UIDValidity), 10)
+	if myEnv["UIDValidity"] != "" && myEnv["UIDValidity"] != sUIDValidity {
+		slog.Warn("UIDValidity of folder is changed, folder is downloaded again", "account", Key.Account, "folder", Key.Folder,
+			"old", myEnv["UIDValidity"], "new", sUIDValidity)
+		return 0, nil
+	}
+
+	if myEnv["LastEmailUID"] != "" {
+		UID, err := strconv.ParseUint(myEnv["LastEmailUID"], 10, 32)
+		if err != nil {
+			return 0, errors.New("wrong LastEmailUID: " + myEnv["LastEmailUID"])
+		}
+		return uint32(UID), nil
+	}
+
+	if myEnv["LastEmailID"] == "" || s.Source == nil {
+		return 0, nil
+	}
+	LastEmailID, err := strconv.Atoi(myEnv["LastEmailID"])
+	if err != nil {
+		return 0, errors.New("wrong LastEmailID: " + myEnv["LastEmailID"])
+	}
+	if LastEmailID <= 0 {
+		return 0, nil
+	}
+
+	UID, err := s.Source.UID(ctx, uint32(LastEmailID))
+	if err != nil {
+		return 0, fmt.Errorf("can not convert LastEmailID to UID: %w", err)
+	}
+	slog.Info("LastEmailID is converted to UID", "last_email_id", LastEmailID, "uid", UID)
+
+	return UID, nil
+}
+
+func (s *AccountCheckpointStore) Save(ctx context.Context, Key downloader.CheckpointKey, UID uint32) error {
+	if DryRun == true {
+		return nil
+	}
+
+	Status.SetCheckpoint(strconv.FormatUint(uint64(UID), 10))
+	return s.Store.Save(ctx, Key, UID)
+}
+
+func (s *AccountCheckpointStore) Flush(ctx context.Context) error {
+	if DryRun == true {
+		return nil
+	}
+
+	return s.Store.Flush(ctx)
+}
+
+// Close writes pending checkpoints and closes database or Redis connection
+func (s *AccountCheckpointStore) Close() error {
+	err := s.Flush(context.Background())
+	if Closer, ok := s.Store.Store.(io.Closer); ok == true {
+		if err1 := Closer.Close(); err == nil {
+			err = err1
+		}
+	}
+
+	return err
+}
+
+// HandleEvent updates metrics, status page and webhooks by events of downloader
+func HandleEvent(e downloader.Event) {
+	switch e.Type {
+	case downloader.EventConnectFailed:
+		MetricLoginFailures.Inc()
+		Status.SetError(e.Err)
+		PostWebhookEvent(WebhookEvent{Type: EventLoginFailure, Error: e.Err.Error()})
+	case downloader.EventConnected:
+		if connectedOnce == true {
+			MetricReconnects.Inc()
+		}
+		connectedOnce = true
+	case downloader.EventBatchFetched:
+		MetricFetchDuration.Observe(e.Duration.Seconds())
+		MetricLastSync.WithLabelValues(e.Key.Account, e.Key.Folder).SetToCurrentTime()
+	case downloader.EventCheckpointFailed:
+		Status.SetError(e.Err)
+	}
+}
+
+var connectedOnce bool
+
+// NewDownloaderConfig creates config of downloader from settings: Sink, Filter and Keys are the same as used by HandleMessage,
+// messages are processed by HandleMessage
+func NewDownloaderConfig(Source downloader.MailSource, Checkpoints downloader.CheckpointStore) (downloader.Config, error) {
+	Options, err := NewProcessOptions()
+	if err != nil {
+		return downloader.Config{}, err
+	}
+
+	return downloader.Config{
+		Source:           Source,
+		Checkpoints:      Checkpoints,
+		Sink:             Sink,
+		Filter:           Options.Filter,
+		Handler:          downloader.HandlerFunc(HandleMessage),
+		OnEvent:          HandleEvent,
+		BatchSize:        EmailsCount,
+		DownloadFromDate: Options.DownloadFromDate,
+		Keys:             Keys,
+		Logger:           slog.Default(),
+	}, nil
+}
+
+// NewDownloader creates downloader of account from settings
+func NewDownloader(Source downloader.MailSource, Checkpoints downloader.CheckpointStore) (*downloader.Downloader, error) {
+	Config, err := NewDownloaderConfig(Source, Checkpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	return downloader.New(Config)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+	"DownloadEmailsAttachments/parsemail"
+)
+
+func TestAccountCheckpointStore(t *testing.T) {
+	ctx := context.Background()
+	Store := &AccountCheckpointStore{Store: downloader.NewBatchCheckpointStore(downloader.NewMemoryCheckpointStore(), 1, time.Hour)}
+	Key := downloader.CheckpointKey{Account: "buh@example.com", Folder: MailboxName, UIDValidity: 5}
+
+	//checkpoint of old version is read from settings
+	myEnv = map[string]string{"LastEmailUID": "42", "UIDValidity": "5"}
+	if UID, err := Store.Load(ctx, Key); err != nil || UID != 42 {
+		t.Errorf("Expected 42, Got: %d %v", UID, err)
+	}
+
+	//folder was recreated, old UIDs are not valid
+	myEnv = map[string]string{"LastEmailUID": "42", "UIDValidity": "4"}
+	if UID, err := Store.Load(ctx, Key); err != nil || UID != 0 {
+		t.Errorf("Checkpoint of other UIDValidity is used: %d %v", UID, err)
+	}
+
+	myEnv = map[string]string{"LastEmailUID": "abc"}
+	if _, err := Store.Load(ctx, Key); err == nil {
+		t.Errorf("Wrong LastEmailUID is accepted")
+	}
+
+	//saved checkpoint is used instead of settings
+	myEnv = map[string]string{"LastEmailUID": "42", "UIDValidity": "5"}
+	err := Store.Save(ctx, Key, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if UID, err := Store.Load(ctx, Key); err != nil || UID != 50 {
+		t.Errorf("Expected 50, Got: %d %v", UID, err)
+	}
+	if myEnv["LastEmailUID"] != "42" {
+		t.Errorf("Settings are changed: %v", myEnv)
+	}
+}
+
+func TestNewDownloaderConfig(t *testing.T) {
+	defer func(s OutputSink, k *parsemail.CryptoKeys) { Sink, Keys = s, k }(Sink, Keys)
+	myEnv = map[string]string{"FileExtensions": ".xls,.xlsx", "DownloadFromDate": "2021-03-01 00:00:00"}
+	Sink = failingSink{}
+	Keys = &parsemail.CryptoKeys{}
+
+	Config, err := NewDownloaderConfig(&downloader.DirSource{Directory: t.TempDir()}, downloader.NewMemoryCheckpointStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Config.Sink != Sink || Config.Keys != Keys || Config.Handler == nil || Config.DownloadFromDate.Format("2006-01-02") != "2021-03-01" {
+		t.Errorf("Wrong config: %+v", Config)
+	}
+
+	m := &downloader.Message{}
+	for _, Test := range []struct {
+		Filename string
+		Accept   bool
+	}{{"price.XLSX", true}, {"price.pdf", false}} {
+		a := downloader.Attachment{Attachment: parsemail.Attachment{Filename: Test.Filename}}
+		if ok, _ := Config.Filter.Accept(m, a); ok != Test.Accept {
+			t.Errorf("Wrong filter result for %s: %v", Test.Filename, ok)
+		}
+	}
+
+	myEnv["DownloadFromDate"] = "01.03.2021"
+	if _, err = NewDownloaderConfig(&downloader.DirSource{}, downloader.NewMemoryCheckpointStore()); err == nil {
+		t.Errorf("Wrong DownloadFromDate is accepted")
+	}
+}
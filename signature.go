@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"DownloadEmailsAttachments/parsemail"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Keys - keys for S/MIME and PGP/MIME messages, loaded by LoadCryptoKeys and passed to parser
+var Keys *parsemail.CryptoKeys
+
+// LoadCryptoKeys loads keys for S/MIME and PGP/MIME messages:
+// SMIMECertificateFile and SMIMEKeyFile - own certificate and private key in PEM,
+// SMIMERootsFile - trusted root certificates in PEM, system roots are used if empty,
+// PGPKeyringFiles - comma separated armored key files, private keys are decrypted with PGPPassphrase
+func LoadCryptoKeys() (*parsemail.CryptoKeys, error) {
+	Keys := &parsemail.CryptoKeys{}
+
+	if myEnv["SMIMECertificateFile"] != "" {
+		Data, err := ioutil.ReadFile(myEnv["SMIMECertificateFile"])
+		if err != nil {
+			return nil, err
+		}
+		Block, _ := pem.Decode(Data)
+		if Block == nil {
+			return nil, errors.New("certificate is not found in " + myEnv["SMIMECertificateFile"])
+		}
+		Keys.SMIMECertificate, err = x509.ParseCertificate(Block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		Keys.SMIMEPrivateKey, err = readPrivateKey(myEnv["SMIMEKeyFile"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if myEnv["SMIMERootsFile"] != "" {
+		Data, err := ioutil.ReadFile(myEnv["SMIMERootsFile"])
+		if err != nil {
+			return nil, err
+		}
+		Keys.SMIMERoots = x509.NewCertPool()
+		if Keys.SMIMERoots.AppendCertsFromPEM(Data) == false {
+			return nil, errors.New("certificates are not found in " + myEnv["SMIMERootsFile"])
+		}
+	}
+
+	for _, Filename := range strings.Split(myEnv["PGPKeyringFiles"], ",") {
+		Filename = strings.TrimSpace(Filename)
+		if Filename == "" {
+			continue
+		}
+
+		f, err := os.Open(Filename)
+		if err != nil {
+			return nil, err
+		}
+		Entities, err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.New("can not read " + Filename + ": " + err.Error())
+		}
+
+		for _, Entity := range Entities {
+			if Entity.PrivateKey != nil && Entity.PrivateKey.Encrypted == true {
+				err = Entity.DecryptPrivateKeys([]byte(myEnv["PGPPassphrase"]))
+				if err != nil {
+					return nil, errors.New("can not decrypt private key from " + Filename + ": " + err.Error())
+				}
+			}
+		}
+		Keys.PGPKeyring = append(Keys.PGPKeyring, Entities...)
+	}
+
+	return Keys, nil
+}
+
+// readPrivateKey reads PKCS#1, PKCS#8 or EC private key from PEM file
+func readPrivateKey(Filename string) (crypto.PrivateKey, error) {
+	Data, err := ioutil.ReadFile(Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	Block, _ := pem.Decode(Data)
+	if Block == nil {
+		return nil, errors.New("private key is not found in " + Filename)
+	}
+
+	if Key, err := x509.ParsePKCS1PrivateKey(Block.Bytes); err == nil {
+		return Key, nil
+	}
+	if Key, err := x509.ParseECPrivateKey(Block.Bytes); err == nil {
+		return Key, nil
+	}
+
+	return x509.ParsePKCS8PrivateKey(Block.Bytes)
+}
+
+// CheckSignature returns error if sender is in RequireSignatureFrom list and message is not signed by this sender.
+// Setting format: RequireSignatureFrom=statements@bank.ru,@bank2.ru
+func CheckSignature(email parsemail.Email, EmailAddress string) error {
+	if SenderInList(EmailAddress, myEnv["RequireSignatureFrom"]) == false {
+		return nil
+	}
+
+	Signature := email.Signature
+	if Signature == nil {
+		return errors.New("message is not signed")
+	}
+	if Signature.Valid == false {
+		return errors.New("signature is not valid: " + Signature.Error)
+	}
+	if strings.EqualFold(Signature.Signer, EmailAddress) == false {
+		return errors.New("message is signed by other sender: " + Signature.Signer)
+	}
+
+	return nil
+}
+
+// SenderInList returns true if address or its @domain is in comma separated list, * means all senders
+func SenderInList(EmailAddress string, List string) bool {
+	EmailAddress = strings.ToLower(EmailAddress)
+	Domain := ""
+	pos1 := strings.Index(EmailAddress, "@")
+	if pos1 >= 0 {
+		Domain = EmailAddress[pos1:]
+	}
+
+	for _, Sender := range strings.Split(List, ",") {
+		Sender = strings.ToLower(strings.TrimSpace(Sender))
+		if Sender != "" && (Sender == "*" || Sender == EmailAddress || Sender == Domain) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+)
+
+// OutputSink - storage where files are saved: local directory, S3, SFTP or WebDAV
+type OutputSink = downloader.OutputSink
+
+// Sink - current output sink, created by NewOutputSink from OutputSink setting
+var Sink OutputSink
+
+// DuplicateFiles setting values, what to do when file with the same name already exists
+const (
+	DuplicateOverwrite = "overwrite" //replace old file (default)
+	DuplicateSkip      = "skip"      //do not save new file
+	DuplicateRename    = "rename"    //save as "name (1).ext"
+)
+
+var ErrDuplicateFile = errors.New("file already exists")
+
+// NewOutputSink creates sink from OutputSink setting: local (default), s3, sftp, webdav
+func NewOutputSink() (OutputSink, error) {
+	switch myEnv["OutputSink"] {
+	case "", "local":
+		return NewLocalSink(myEnv["OutputDirectory"])
+	case "s3":
+		return NewS3SinkFromSettings()
+	case "sftp":
+		return NewSFTPSinkFromSettings()
+	case "webdav":
+		return NewWebDAVSinkFromSettings()
+	}
+
+	return nil, fmt.Errorf("unknown OutputSink: %s", myEnv["OutputSink"])
+}
+
+// SaveFile saves file to Sink with DuplicateFiles policy, returns name of saved file
+func SaveFile(Name string, massBytes []byte) (string, error) {
+	return SaveFileWithTime(Name, massBytes, time.Time{})
+}
+
+// SaveFileWithTime saves file to Sink with DuplicateFiles policy and sets its modification time, zero time is not set.
+// Returns name of saved file, it differs from Name if file was cleaned or renamed
+func SaveFileWithTime(Name string, massBytes []byte, ModTime time.Time) (string, error) {
+	Name, err := downloader.CleanName(Name)
+	if err != nil {
+		slog.Error("Can not save file", "file", Name, "error", err)
+		return Name, err
+	}
+
+	Policy := myEnv["DuplicateFiles"]
+	if Policy == DuplicateSkip || Policy == DuplicateRename {
+		NameNew, err := uniqueName(Name, Policy)
+		if err == ErrDuplicateFile {
+			slog.Info("File already exists", "path", Sink.Location(Name))
+			return Name, err
+		} else if err != nil {
+			slog.Error("Can not check file", "path", Sink.Location(Name), "error", err)
+			return Name, err
+		}
+		Name = NameNew
+	}
+
+	err = Sink.Put(Name, massBytes, ModTime)
+	if err != nil {
+		slog.Error("Can not save file", "path", Sink.Location(Name), "error", err)
+	}
+
+	return Name, err
+}
+
+// uniqueName returns Name if file does not exist, otherwise ErrDuplicateFile or new name "name (1).ext"
+func uniqueName(Name, Policy string) (string, error) {
+	ext := filepath.Ext(Name)
+	NameBase := strings.TrimSuffix(Name, ext)
+
+	NameNew := Name
+	for i := 1; ; i++ {
+		Exists, err := Sink.Exists(NameNew)
+		if err != nil {
+			return Name, err
+		}
+		if Exists == false {
+			return NameNew, nil
+		}
+		if Policy == DuplicateSkip {
+			return Name, ErrDuplicateFile
+		}
+
+		NameNew = NameBase + " (" + strconv.Itoa(i) + ")" + ext
+	}
+}
+
+// LocalSink - files are saved in local directory
+type LocalSink = downloader.LocalSink
+
+// NewLocalSink creates sink for directory, "Files" directory is used if it is empty
+func NewLocalSink(Directory string) (*LocalSink, error) {
+	if Directory == "" {
+		Directory = "Files"
+	}
+
+	//directory is not created in dry-run
+	if DryRun == true {
+		return &LocalSink{Directory: Directory}, nil
+	}
+
+	return downloader.NewLocalSink(Directory)
+}
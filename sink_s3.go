@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Sink - files are saved in S3 compatible storage (MinIO, AWS, Yandex Object Storage).
+// PutObject is atomic, object is visible only after upload is finished
+type S3Sink struct {
+	Client *minio.Client
+	Bucket string
+	Prefix string
+}
+
+// NewS3SinkFromSettings creates sink from S3_ENDPOINT, S3_ACCESS_KEY, S3_SECRET_KEY, S3_BUCKET, S3_PREFIX, S3_REGION, S3_USE_SSL settings
+func NewS3SinkFromSettings() (*S3Sink, error) {
+	Client, err := minio.New(myEnv["S3_ENDPOINT"], &minio.Options{
+		Creds:        credentials.NewStaticV4(myEnv["S3_ACCESS_KEY"], myEnv["S3_SECRET_KEY"], ""),
+		Secure:       myEnv["S3_USE_SSL"] != "false",
+		Region:       myEnv["S3_REGION"],
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewS3Sink(Client, myEnv["S3_BUCKET"], myEnv["S3_PREFIX"]), nil
+}
+
+// NewS3Sink creates sink for bucket, object names are Prefix + file name
+func NewS3Sink(Client *minio.Client, Bucket, Prefix string) *S3Sink {
+	Prefix = strings.Trim(Prefix, "/")
+	if Prefix != "" {
+		Prefix = Prefix + "/"
+	}
+
+	return &S3Sink{Client: Client, Bucket: Bucket, Prefix: Prefix}
+}
+
+func (s *S3Sink) Location(Name string) string {
+	return "s3://" + path.Join(s.Bucket, s.Prefix+Name)
+}
+
+func (s *S3Sink) Exists(Name string) (bool, error) {
+	_, err := s.Client.StatObject(context.Background(), s.Bucket, s.Prefix+Name, minio.StatObjectOptions{})
+	if err == nil {
+		return true, nil
+	}
+
+	Response := minio.ToErrorResponse(err)
+	if Response.Code == "NoSuchKey" || Response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// Put uploads object, ModTime is saved in x-amz-meta-mtime because S3 can not change object time
+func (s *S3Sink) Put(Name string, Data []byte, ModTime time.Time) error {
+	Options := minio.PutObjectOptions{
+		ContentType: mime.TypeByExtension(strings.ToLower(filepath.Ext(Name))),
+	}
+	if ModTime.IsZero() == false {
+		Options.UserMetadata = map[string]string{"mtime": ModTime.UTC().Format(time.RFC3339)}
+	}
+
+	_, err := s.Client.PutObject(context.Background(), s.Bucket, s.Prefix+Name, bytes.NewReader(Data), int64(len(Data)), Options)
+
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPSink - files are saved in directory on SFTP server.
+// File is uploaded with temporary name and renamed after upload, so partner never reads partial file.
+// Connection is opened by Dial on first use and opened again after server closed it
+type SFTPSink struct {
+	Directory string
+	Dial      func() (*sftp.Client, error)
+
+	mu     sync.Mutex
+	client *sftp.Client
+}
+
+// NewSFTPSinkFromSettings connects to SFTP_SERVER (host:port) with SFTP_USER and SFTP_PASSWORD.
+// Server key is checked with SFTP_HOST_KEY fingerprint (SHA256:...),
+// check is turned off only if SFTP_INSECURE_IGNORE_HOST_KEY=true
+func NewSFTPSinkFromSettings() (*SFTPSink, error) {
+	HostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if myEnv["SFTP_INSECURE_IGNORE_HOST_KEY"] != "true" {
+		Fingerprint := myEnv["SFTP_HOST_KEY"]
+		if Fingerprint == "" {
+			return nil, errors.New("SFTP_HOST_KEY is not set")
+		}
+		HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if ssh.FingerprintSHA256(key) != Fingerprint {
+				return errors.New("wrong SFTP host key: " + ssh.FingerprintSHA256(key))
+			}
+			return nil
+		}
+	}
+
+	Config := &ssh.ClientConfig{
+		User:            myEnv["SFTP_USER"],
+		Auth:            []ssh.AuthMethod{ssh.Password(myEnv["SFTP_PASSWORD"])},
+		HostKeyCallback: HostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+
+	Address := myEnv["SFTP_SERVER"]
+	Dial := func() (*sftp.Client, error) {
+		Conn, err := ssh.Dial("tcp", Address, Config)
+		if err != nil {
+			return nil, err
+		}
+
+		Client, err := sftp.NewClient(Conn)
+		if err != nil {
+			Conn.Close()
+			return nil, err
+		}
+		//ssh connection is closed with sftp session
+		go func() {
+			_ = Client.Wait()
+			Conn.Close()
+		}()
+
+		return Client, nil
+	}
+
+	//settings are checked at start
+	s := NewSFTPSink(Dial, myEnv["SFTP_DIRECTORY"])
+	_, err := s.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewSFTPSink creates sink for directory on server, "." is used if it is empty
+func NewSFTPSink(Dial func() (*sftp.Client, error), Directory string) *SFTPSink {
+	if Directory == "" {
+		Directory = "."
+	}
+
+	return &SFTPSink{Dial: Dial, Directory: Directory}
+}
+
+// connection returns opened client, it is dialed if there is no connection
+func (s *SFTPSink) connection() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	Client, err := s.Dial()
+	if err != nil {
+		return nil, err
+	}
+	s.client = Client
+
+	//server closed idle connection
+	go func() {
+		_ = Client.Wait()
+		s.drop(Client)
+	}()
+
+	return Client, nil
+}
+
+// drop forgets closed client, the next operation dials again
+func (s *SFTPSink) drop(Client *sftp.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == Client {
+		s.client = nil
+	}
+}
+
+// do runs fn with client, fn is run once more with new connection if connection was lost
+func (s *SFTPSink) do(fn func(Client *sftp.Client) error) error {
+	for i := 0; ; i++ {
+		Client, err := s.connection()
+		if err != nil {
+			return err
+		}
+
+		err = fn(Client)
+		if i > 0 || connectionLost(err) == false {
+			return err
+		}
+		Client.Close()
+		s.drop(Client)
+	}
+}
+
+func connectionLost(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+func (s *SFTPSink) Location(Name string) string {
+	return "sftp://" + myEnv["SFTP_SERVER"] + "/" + path.Join(s.Directory, Name)
+}
+
+func (s *SFTPSink) Exists(Name string) (bool, error) {
+	Exists := false
+	err := s.do(func(Client *sftp.Client) error {
+		_, err := Client.Stat(path.Join(s.Directory, Name))
+		Exists = err == nil
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	return Exists, err
+}
+
+func (s *SFTPSink) Put(Name string, Data []byte, ModTime time.Time) error {
+	FullName := path.Join(s.Directory, Name)
+
+	return s.do(func(Client *sftp.Client) error {
+		TempName := path.Join(s.Directory, ".tmp_"+strconv.FormatInt(time.Now().UnixNano(), 10))
+
+		f, err := Client.Create(TempName)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write(Data)
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err == nil && ModTime.IsZero() == false {
+			err = Client.Chtimes(TempName, ModTime, ModTime)
+		}
+		if err == nil {
+			err = rename(Client, TempName, FullName)
+		}
+		if err != nil {
+			_ = Client.Remove(TempName)
+		}
+
+		return err
+	})
+}
+
+// rename replaces existing file, old servers without posix-rename extension can not rename over existing file
+func rename(Client *sftp.Client, OldName, NewName string) error {
+	err := Client.PosixRename(OldName, NewName)
+	if err == nil {
+		return nil
+	}
+
+	if _, err = Client.Stat(NewName); err == nil {
+		_ = Client.Remove(NewName)
+	}
+
+	return Client.Rename(OldName, NewName)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"DownloadEmailsAttachments/downloader"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/sftp"
+	"golang.org/x/net/webdav"
+)
+
+// testSink checks the same naming, dedup and overwrite behaviour for every sink
+func testSink(t *testing.T, s OutputSink, Read func(Name string) string) {
+	Sink = s
+
+	myEnv = map[string]string{"DuplicateFiles": DuplicateRename}
+	Name, err := SaveFile("From(Supplier)_report.xlsx", []byte("first"))
+	if err != nil || Name != "From(Supplier)_report.xlsx" {
+		t.Fatalf("Error while saving file: %s %v", Name, err)
+	}
+
+	Name, err = SaveFile("From(Supplier)_report.xlsx", []byte("second"))
+	if err != nil || Name != "From(Supplier)_report (1).xlsx" {
+		t.Fatalf("Wrong renamed file. Expected: %s, Got: %s %v", "From(Supplier)_report (1).xlsx", Name, err)
+	}
+
+	myEnv["DuplicateFiles"] = DuplicateSkip
+	_, err = SaveFile("From(Supplier)_report.xlsx", []byte("third"))
+	if err != ErrDuplicateFile {
+		t.Errorf("Expected: %v, Got: %v", ErrDuplicateFile, err)
+	}
+
+	myEnv["DuplicateFiles"] = DuplicateOverwrite
+	_, err = SaveFile("From(Supplier)_report (1).xlsx", []byte("fourth"))
+	if err != nil {
+		t.Fatalf("Error while saving file: %v", err)
+	}
+
+	if Data := Read("From(Supplier)_report.xlsx"); Data != "first" {
+		t.Errorf("Wrong file data. Expected: %s, Got: %s", "first", Data)
+	}
+	if Data := Read("From(Supplier)_report (1).xlsx"); Data != "fourth" {
+		t.Errorf("Wrong file data. Expected: %s, Got: %s", "fourth", Data)
+	}
+}
+
+func TestLocalSink(t *testing.T) {
+	Directory := t.TempDir()
+	s, err := NewLocalSink(Directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSink(t, s, func(Name string) string {
+		Data, _ := ioutil.ReadFile(filepath.Join(Directory, Name))
+		return string(Data)
+	})
+
+	ModTime := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	err = s.Put("dated.xlsx", []byte("x"), ModTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Info, err := os.Stat(filepath.Join(Directory, "dated.xlsx"))
+	if err != nil || Info.ModTime().Equal(ModTime) == false {
+		t.Errorf("Wrong file time. Expected: %v, Got: %v %v", ModTime, Info.ModTime(), err)
+	}
+
+	Files, _ := ioutil.ReadDir(Directory)
+	if len(Files) != 3 {
+		t.Errorf("Temporary files are not removed, files count: %v", len(Files))
+	}
+}
+
+func TestS3Sink(t *testing.T) {
+	Backend := s3mem.New()
+	_ = Backend.CreateBucket("reports")
+	Server := httptest.NewServer(gofakes3.New(Backend).Server())
+	defer Server.Close()
+
+	ServerURL, _ := url.Parse(Server.URL)
+	Client, err := minio.New(ServerURL.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4("key", "secret", ""),
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewS3Sink(Client, "reports", "/incoming/")
+	if s.Location("a.xlsx") != "s3://reports/incoming/a.xlsx" {
+		t.Errorf("Wrong location: %s", s.Location("a.xlsx"))
+	}
+
+	testSink(t, s, func(Name string) string {
+		Object, err := Client.GetObject(t.Context(), "reports", "incoming/"+Name, minio.GetObjectOptions{})
+		if err != nil {
+			return ""
+		}
+		Data, _ := ioutil.ReadAll(Object)
+		return string(Data)
+	})
+}
+
+func TestSFTPSink(t *testing.T) {
+	ClientConn, ServerConn := net.Pipe()
+	Server := sftp.NewRequestServer(ServerConn, sftp.InMemHandler())
+	go Server.Serve()
+	defer Server.Close()
+
+	Client, err := sftp.NewClientPipe(ClientConn, ClientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Client.Close()
+
+	_ = Client.Mkdir("/upload")
+	s := NewSFTPSink(func() (*sftp.Client, error) { return Client, nil }, "/upload")
+
+	testSink(t, s, func(Name string) string {
+		f, err := Client.Open("/upload/" + Name)
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		Data, _ := ioutil.ReadAll(f)
+		return string(Data)
+	})
+}
+
+// dialSFTP starts in-memory server with shared files, server is stopped by closing returned client
+func dialSFTP(Handlers sftp.Handlers) (*sftp.Client, *sftp.RequestServer, error) {
+	ClientConn, ServerConn := net.Pipe()
+	Server := sftp.NewRequestServer(ServerConn, Handlers)
+	go Server.Serve()
+
+	Client, err := sftp.NewClientPipe(ClientConn, ClientConn)
+	if err != nil {
+		Server.Close()
+		return nil, nil, err
+	}
+
+	return Client, Server, nil
+}
+
+func TestSFTPSinkReconnect(t *testing.T) {
+	Handlers := sftp.InMemHandler()
+	Servers := []*sftp.RequestServer{}
+	defer func() {
+		for _, Server := range Servers {
+			Server.Close()
+		}
+	}()
+
+	s := NewSFTPSink(func() (*sftp.Client, error) {
+		Client, Server, err := dialSFTP(Handlers)
+		if err == nil {
+			Servers = append(Servers, Server)
+		}
+		return Client, err
+	}, "/")
+
+	err := s.Put("1.xlsx", []byte("1"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//server closed connection
+	Servers[0].Close()
+
+	err = s.Put("2.xlsx", []byte("2"), time.Time{})
+	if err != nil {
+		t.Fatalf("[Test Case 1] Put after connection was lost: %v", err)
+	}
+	if len(Servers) != 2 {
+		t.Errorf("[Test Case 1] Dials: got %d, expected 2", len(Servers))
+	}
+
+	Exists, err := s.Exists("1.xlsx")
+	if err != nil || Exists == false {
+		t.Errorf("[Test Case 2] Exists: got %v, %v, expected true", Exists, err)
+	}
+}
+
+func TestWebDAVSink(t *testing.T) {
+	FileSystem := webdav.NewMemFS()
+	_ = FileSystem.Mkdir(t.Context(), "/upload", os.ModePerm)
+	Server := httptest.NewServer(&webdav.Handler{FileSystem: FileSystem, LockSystem: webdav.NewMemLS()})
+	defer Server.Close()
+
+	s := NewWebDAVSink(Server.URL+"/upload", "", "")
+
+	testSink(t, s, func(Name string) string {
+		f, err := FileSystem.OpenFile(t.Context(), "/upload/"+Name, os.O_RDONLY, 0)
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		Data, _ := ioutil.ReadAll(f)
+		return string(Data)
+	})
+}
+
+func TestSaveFileTraversal(t *testing.T) {
+	Root := t.TempDir()
+	Directory := filepath.Join(Root, "a", "b", "Files")
+	myEnv = map[string]string{"EMAIL": "buh@example.com", "FileExtensions": ".xlsx", "DeadLetterFile": filepath.Join(Root, "DeadLetters.json")}
+	err := LoadDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Sink, err = NewLocalSink(Directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//filename is "../../../evil.xlsx"
+	Raw := "From: Supplier <price@supplier.ru>\r\n" +
+		"Subject: Price\r\n" +
+		"Date: Mon, 1 Mar 2021 10:00:00 +0300\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream; name=\"=?utf-8?B?Li4vLi4vLi4vZXZpbC54bHN4?=\"\r\n" +
+		"Content-Disposition: attachment; filename=\"=?utf-8?B?Li4vLi4vLi4vZXZpbC54bHN4?=\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aXRlbTtwcmljZQ==\r\n" +
+		"--b1--\r\n"
+	Options, err := NewProcessOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ProcessMessage(&downloader.Message{Account: "buh@example.com", Folder: MailboxName, SeqNum: 1, UID: 1, Raw: []byte(Raw)}, Options)
+
+	Files, _ := filepath.Glob(filepath.Join(Root, "*.xlsx"))
+	Files2, _ := filepath.Glob(filepath.Join(Root, "a", "*.xlsx"))
+	if len(Files) != 0 || len(Files2) != 0 {
+		t.Errorf("File is saved outside OutputDirectory: %v %v", Files, Files2)
+	}
+	Files, _ = filepath.Glob(filepath.Join(Directory, "*evil.xlsx"))
+	if len(Files) != 1 {
+		t.Errorf("File is not saved in OutputDirectory: %v", Files)
+	}
+
+	Name, err := SaveFile("../../evil.xlsx", []byte("x"))
+	if err != nil || Name != ".._.._evil.xlsx" {
+		t.Errorf("Wrong cleaned name: %s %v", Name, err)
+	}
+	if _, err = os.Stat(filepath.Join(Root, "a", "evil.xlsx")); err == nil {
+		t.Errorf("File is saved outside OutputDirectory")
+	}
+
+	for _, Name := range []string{"..", ".", " "} {
+		_, err = SaveFile(Name, []byte("x"))
+		if err == nil {
+			t.Errorf("Name %q is accepted", Name)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebDAVSink - files are saved in WebDAV folder (Nextcloud, Yandex Disk, IIS).
+// File is uploaded with PUT to temporary name and moved with MOVE after upload
+type WebDAVSink struct {
+	URL      string
+	User     string
+	Password string
+	Client   *http.Client
+}
+
+// NewWebDAVSinkFromSettings creates sink from WEBDAV_URL, WEBDAV_USER, WEBDAV_PASSWORD settings
+func NewWebDAVSinkFromSettings() (*WebDAVSink, error) {
+	if myEnv["WEBDAV_URL"] == "" {
+		return nil, fmt.Errorf("WEBDAV_URL is not set")
+	}
+
+	return NewWebDAVSink(myEnv["WEBDAV_URL"], myEnv["WEBDAV_USER"], myEnv["WEBDAV_PASSWORD"]), nil
+}
+
+// NewWebDAVSink creates sink for folder URL
+func NewWebDAVSink(URL, User, Password string) *WebDAVSink {
+	if strings.HasSuffix(URL, "/") == false {
+		URL = URL + "/"
+	}
+
+	return &WebDAVSink{URL: URL, User: User, Password: Password, Client: &http.Client{Timeout: 5 * time.Minute}}
+}
+
+func (s *WebDAVSink) Location(Name string) string {
+	return s.URL + url.PathEscape(Name)
+}
+
+func (s *WebDAVSink) Exists(Name string) (bool, error) {
+	resp, err := s.do(http.MethodHead, s.Location(Name), nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("webdav HEAD status %d", resp.StatusCode)
+}
+
+// Put uploads file, ModTime is not set because WebDAV servers do not support it in the same way
+func (s *WebDAVSink) Put(Name string, Data []byte, ModTime time.Time) error {
+	TempURL := s.Location(".tmp_" + strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	resp, err := s.do(http.MethodPut, TempURL, bytes.NewReader(Data), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webdav PUT status %d", resp.StatusCode)
+	}
+
+	Headers := map[string]string{"Destination": s.Location(Name), "Overwrite": "T"}
+	resp, err = s.do("MOVE", TempURL, nil, Headers)
+	if err == nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		err = fmt.Errorf("webdav MOVE status %d", resp.StatusCode)
+	}
+	if err != nil {
+		_, _ = s.do(http.MethodDelete, TempURL, nil, nil)
+	}
+
+	return err
+}
+
+func (s *WebDAVSink) do(Method, URL string, Body io.Reader, Headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(Method, URL, Body)
+	if err != nil {
+		return nil, err
+	}
+	if s.User != "" {
+		req.SetBasicAuth(s.User, s.Password)
+	}
+	for Key, Value := range Headers {
+		req.Header.Set(Key, Value)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp, nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"DownloadEmailsAttachments/downloader"
+)
+
+// file types found by SniffFileType
+const (
+	FileTypeUnknown = ""
+	FileTypeXlsx    = "xlsx" //OOXML zip with xl/ folder
+	FileTypeDocx    = "docx"
+	FileTypePptx    = "pptx"
+	FileTypeZip     = "zip"
+	FileTypeOLE2    = "ole2" //compound document: xls, doc, ppt, msg
+	FileTypePDF     = "pdf"
+	FileTypeRar     = "rar"
+	FileType7z      = "7z"
+	FileTypeGzip    = "gzip"
+	FileTypePNG     = "png"
+	FileTypeJPEG    = "jpeg"
+	FileTypeGIF     = "gif"
+	FileTypeTIFF    = "tiff"
+	FileTypeHTML    = "html"
+	FileTypeXML     = "xml"
+	FileTypeText    = "text"
+)
+
+// ValidateFile results
+const (
+	ValidationOK       = "ok"
+	ValidationMismatch = "mismatch" //content does not match extension or content type
+	ValidationCorrupt  = "corrupt"  //content type is right, but file is truncated or broken
+)
+
+// ContentMismatchPolicy and CorruptFilePolicy setting values
+const (
+	InvalidQuarantine = "quarantine" //save in QuarantineDirectory (default)
+	InvalidSave       = "save"       //save as usual, write to log only
+	InvalidSkip       = "skip"       //do not save
+)
+
+// extensionFileTypes - allowed sniffed types for extension, files with other extensions are not checked
+var extensionFileTypes = map[string][]string{
+	".xlsx": {FileTypeXlsx},
+	".xlsm": {FileTypeXlsx},
+	".docx": {FileTypeDocx},
+	".pptx": {FileTypePptx},
+	".xls":  {FileTypeOLE2},
+	".doc":  {FileTypeOLE2},
+	".ppt":  {FileTypeOLE2},
+	".msg":  {FileTypeOLE2},
+	".pdf":  {FileTypePDF},
+	".zip":  {FileTypeZip, FileTypeXlsx, FileTypeDocx, FileTypePptx},
+	".rar":  {FileTypeRar},
+	".7z":   {FileType7z},
+	".gz":   {FileTypeGzip},
+	".png":  {FileTypePNG},
+	".jpg":  {FileTypeJPEG},
+	".jpeg": {FileTypeJPEG},
+	".gif":  {FileTypeGIF},
+	".tif":  {FileTypeTIFF},
+	".tiff": {FileTypeTIFF},
+	".htm":  {FileTypeHTML},
+	".html": {FileTypeHTML},
+	".xml":  {FileTypeXML},
+	".csv":  {FileTypeText},
+	".txt":  {FileTypeText},
+}
+
+// contentTypeFileTypes - allowed sniffed types for declared content type.
+// application/octet-stream and unknown types are not checked.
+// application/vnd.ms-excel is often sent for csv files, so text is allowed too
+var contentTypeFileTypes = map[string][]string{
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         {FileTypeXlsx},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   {FileTypeDocx},
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": {FileTypePptx},
+	"application/vnd.ms-excel":      {FileTypeOLE2, FileTypeText},
+	"application/msword":            {FileTypeOLE2},
+	"application/vnd.ms-powerpoint": {FileTypeOLE2},
+	"application/pdf":               {FileTypePDF},
+	"application/zip":               {FileTypeZip, FileTypeXlsx, FileTypeDocx, FileTypePptx},
+	"application/x-zip-compressed":  {FileTypeZip, FileTypeXlsx, FileTypeDocx, FileTypePptx},
+	"application/x-rar-compressed":  {FileTypeRar},
+	"application/vnd.rar":           {FileTypeRar},
+	"application/x-7z-compressed":   {FileType7z},
+	"application/gzip":              {FileTypeGzip},
+	"image/png":                     {FileTypePNG},
+	"image/jpeg":                    {FileTypeJPEG},
+	"image/gif":                     {FileTypeGIF},
+	"image/tiff":                    {FileTypeTIFF},
+	"text/html":                     {FileTypeHTML},
+	"text/csv":                      {FileTypeText},
+}
+
+// SniffFileType finds file type by magic bytes, zip files are opened to find OOXML documents
+func SniffFileType(Data []byte) string {
+	switch {
+	case bytes.HasPrefix(Data, []byte("PK\x03\x04")), bytes.HasPrefix(Data, []byte("PK\x05\x06")):
+		return sniffZip(Data)
+	case bytes.HasPrefix(Data, []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")):
+		return FileTypeOLE2
+	case bytes.HasPrefix(Data, []byte("%PDF-")):
+		return FileTypePDF
+	case bytes.HasPrefix(Data, []byte("Rar!\x1A\x07")):
+		return FileTypeRar
+	case bytes.HasPrefix(Data, []byte("7z\xBC\xAF\x27\x1C")):
+		return FileType7z
+	case bytes.HasPrefix(Data, []byte("\x1F\x8B")):
+		return FileTypeGzip
+	case bytes.HasPrefix(Data, []byte("\x89PNG\r\n\x1A\n")):
+		return FileTypePNG
+	case bytes.HasPrefix(Data, []byte("\xFF\xD8\xFF")):
+		return FileTypeJPEG
+	case bytes.HasPrefix(Data, []byte("GIF87a")), bytes.HasPrefix(Data, []byte("GIF89a")):
+		return FileTypeGIF
+	case bytes.HasPrefix(Data, []byte("II*\x00")), bytes.HasPrefix(Data, []byte("MM\x00*")):
+		return FileTypeTIFF
+	}
+
+	return sniffText(Data)
+}
+
+// sniffZip returns OOXML type by folders in archive, broken zip is still zip
+func sniffZip(Data []byte) string {
+	r, err := zip.NewReader(bytes.NewReader(Data), int64(len(Data)))
+	if err != nil {
+		return FileTypeZip
+	}
+
+	ContentTypes := false
+	Folder := ""
+	for _, f := range r.File {
+		switch {
+		case f.Name == "[Content_Types].xml":
+			ContentTypes = true
+		case strings.HasPrefix(f.Name, "xl/"):
+			Folder = FileTypeXlsx
+		case strings.HasPrefix(f.Name, "word/"):
+			Folder = FileTypeDocx
+		case strings.HasPrefix(f.Name, "ppt/"):
+			Folder = FileTypePptx
+		}
+	}
+	if ContentTypes == true && Folder != "" {
+		return Folder
+	}
+
+	return FileTypeZip
+}
+
+// sniffText finds html and xml by first tag, other valid utf-8 or single byte text without zero bytes is text
+func sniffText(Data []byte) string {
+	Head := Data
+	if len(Head) > 1024 {
+		Head = Head[:1024]
+	}
+	if bytes.IndexByte(Head, 0) >= 0 || len(Head) == 0 {
+		return FileTypeUnknown
+	}
+
+	Head = bytes.TrimPrefix(Head, []byte("\xEF\xBB\xBF"))
+	Start := strings.ToLower(strings.TrimSpace(string(Head)))
+	switch {
+	case strings.HasPrefix(Start, "<!doctype html"), strings.HasPrefix(Start, "<html"),
+		strings.HasPrefix(Start, "<head"), strings.HasPrefix(Start, "<body"):
+		return FileTypeHTML
+	case strings.HasPrefix(Start, "<?xml"):
+		if strings.Contains(Start, "<html") {
+			return FileTypeHTML
+		}
+		return FileTypeXML
+	}
+
+	//windows-1251 text is not valid utf-8, control characters are checked only
+	if utf8.Valid(Head) == false {
+		for _, c := range Head {
+			if c < 0x20 && c != '\t' && c != '\r' && c != '\n' {
+				return FileTypeUnknown
+			}
+		}
+	}
+
+	return FileTypeText
+}
+
+// ValidateFile compares sniffed type with extension and declared content type and checks that file is not truncated.
+// Returns ValidationOK, ValidationMismatch or ValidationCorrupt and reason for log
+func ValidateFile(Filename, ContentType string, Data []byte) (string, string) {
+	FileType := SniffFileType(Data)
+	FileTypeName := FileType
+	if FileTypeName == FileTypeUnknown {
+		FileTypeName = "unknown"
+	}
+
+	//type of broken zip can not be found, so it is corrupt and not mismatch
+	if FileType == FileTypeZip {
+		if Reason := checkCorrupt(FileType, Data); Reason != "" {
+			return ValidationCorrupt, Reason
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(Filename))
+	if Allowed, ok := extensionFileTypes[ext]; ok == true && contains(Allowed, FileType) == false {
+		return ValidationMismatch, "extension " + ext + " does not match content: " + FileTypeName
+	}
+
+	MediaType, _, _ := mime.ParseMediaType(ContentType)
+	if Allowed, ok := contentTypeFileTypes[MediaType]; ok == true && contains(Allowed, FileType) == false {
+		return ValidationMismatch, "content type " + MediaType + " does not match content: " + FileTypeName
+	}
+
+	if Reason := checkCorrupt(FileType, Data); Reason != "" {
+		return ValidationCorrupt, Reason
+	}
+
+	return ValidationOK, ""
+}
+
+// checkCorrupt returns reason if file of known type is truncated or broken.
+// Zip and gzip are unpacked with archive limits, so zip bomb is reported instead of being unpacked
+func checkCorrupt(FileType string, Data []byte) string {
+	Limits := NewArchiveLimits()
+	switch FileType {
+	case FileTypeZip, FileTypeXlsx, FileTypeDocx, FileTypePptx:
+		r, err := zip.NewReader(bytes.NewReader(Data), int64(len(Data)))
+		if err != nil {
+			return "broken zip: " + err.Error()
+		}
+		for _, f := range r.File {
+			//encrypted files can not be checked without password
+			if f.Flags&0x1 != 0 {
+				continue
+			}
+			rc, err := f.Open()
+			if err == nil {
+				err = discardArchiveEntry(rc, Limits)
+				rc.Close()
+			}
+			if err == ErrArchiveTooBig || err == ErrArchiveTooManyEntries {
+				return "zip can not be checked: " + err.Error()
+			}
+			if err != nil {
+				return "broken zip file " + f.Name + ": " + err.Error()
+			}
+		}
+	case FileTypeOLE2:
+		//header is 512 bytes and file consists of 512 or 4096 byte sectors
+		if len(Data) < 1024 || len(Data)%512 != 0 {
+			return "truncated compound document"
+		}
+	case FileTypePDF:
+		Tail := Data
+		if len(Tail) > 2048 {
+			Tail = Tail[len(Tail)-2048:]
+		}
+		if bytes.Contains(Tail, []byte("%%EOF")) == false {
+			return "truncated pdf: %%EOF not found"
+		}
+	case FileTypeGzip:
+		r, err := gzip.NewReader(bytes.NewReader(Data))
+		if err == nil {
+			err = discardArchiveEntry(r, Limits)
+		}
+		if err == ErrArchiveTooBig {
+			return "gzip can not be checked: " + err.Error()
+		}
+		if err != nil {
+			return "broken gzip: " + err.Error()
+		}
+	}
+
+	return ""
+}
+
+// CheckFileContent validates file if ValidateContent=true and applies ContentMismatchPolicy or CorruptFilePolicy.
+// Returns true if file should be saved as usual
+func CheckFileContent(FilenameNew string, massBytes []byte, Metadata FileMetadata) bool {
+	if myEnv["ValidateContent"] != "true" {
+		return true
+	}
+
+	Result, Reason := ValidateFile(FilenameNew, Metadata.ContentType, massBytes)
+	Policy := ""
+	switch Result {
+	case ValidationOK:
+		return true
+	case ValidationMismatch:
+		Policy = myEnv["ContentMismatchPolicy"]
+	case ValidationCorrupt:
+		Policy = myEnv["CorruptFilePolicy"]
+	}
+
+	MessageLogger(Metadata).Warn("Invalid file", "file", FilenameNew, "result", Result, "reason", Reason)
+	switch Policy {
+	case InvalidSave:
+		return true
+	case InvalidSkip:
+		CatalogAddFile(FillFileMetadata(Metadata, massBytes), "", FileStatusInvalid, errors.New(Result+": "+Reason))
+		MetricAttachmentsSkipped.WithLabelValues(SkipReasonInvalid).Inc()
+		ReportSkippedFile(Metadata.OriginalFilename, SkipReasonInvalid+": "+Result+": "+Reason)
+		return false
+	}
+
+	MetricAttachmentsSkipped.WithLabelValues(SkipReasonQuarantined).Inc()
+	QuarantineFile(FilenameNew, massBytes, Metadata, FileStatusQuarantined, Result+": "+Reason)
+	return false
+}
+
+// QuarantineFile saves file in local QuarantineDirectory (default "Quarantine") with .reason.txt file near it,
+// Status is saved in catalog. Returns location of file in quarantine, empty if it is not saved
+func QuarantineFile(FilenameNew string, massBytes []byte, Metadata FileMetadata, Status string, Reason string) string {
+	Metadata = FillFileMetadata(Metadata, massBytes)
+
+	Directory := myEnv["QuarantineDirectory"]
+	if Directory == "" {
+		Directory = "Quarantine"
+	}
+
+	FilenameNew, err := downloader.CleanName(FilenameNew)
+	var Quarantine OutputSink
+	if err == nil {
+		Quarantine, err = NewLocalSink(Directory)
+	}
+	if err == nil && DryRun == true {
+		Quarantine = &DryRunSink{Sink: Quarantine}
+	}
+	ReportSkippedFile(Metadata.OriginalFilename, Status+": "+Reason)
+	if err == nil {
+		err = Quarantine.Put(FilenameNew, massBytes, Metadata.FileTime())
+	}
+	if err == nil {
+		err = Quarantine.Put(FilenameNew+".reason.txt", []byte(Reason+"\r\n"), time.Time{})
+	}
+	if err != nil {
+		MessageLogger(Metadata).Error("Can not save file in quarantine", "file", FilenameNew, "error", err)
+		CatalogAddFile(Metadata, "", FileStatusError, err)
+		return ""
+	}
+
+	MessageLogger(Metadata).Info("File is saved in quarantine", "path", Quarantine.Location(FilenameNew))
+	CatalogAddFile(Metadata, Quarantine.Location(FilenameNew), Status, errors.New(Reason))
+
+	return Quarantine.Location(FilenameNew)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func makeZip(t *testing.T, Names ...string) []byte {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for _, Name := range Names {
+		f, err := w.Create(Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.Write([]byte("<xml>" + Name + "</xml>"))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func TestValidateFile(t *testing.T) {
+	Xlsx := makeZip(t, "[Content_Types].xml", "xl/workbook.xml")
+	Xls := append([]byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"), make([]byte, 1528)...)
+	Pdf := []byte("%PDF-1.4\n1 0 obj\n<<>>\nendobj\ntrailer\n<<>>\n%%EOF\n")
+
+	var testData = []struct {
+		Filename    string
+		ContentType string
+		Data        []byte
+		Result      string
+	}{
+		{"report.xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Xlsx, ValidationOK},
+		{"report.xlsx", "application/octet-stream", []byte("<!DOCTYPE html><html><body>Error 500</body></html>"), ValidationMismatch},
+		{"report.xlsx", "", Xlsx[:len(Xlsx)-30], ValidationCorrupt},
+		{"report.xlsx", "", makeZip(t, "report.csv"), ValidationMismatch},
+		{"report.zip", "application/zip", Xlsx, ValidationOK},
+		{"report.xls", "application/vnd.ms-excel", Xls, ValidationOK},
+		{"report.xls", "", Xls[:700], ValidationCorrupt},
+		{"report.csv", "application/vnd.ms-excel", []byte("date;sum\r\n2021-03-01;12,5\r\n"), ValidationOK},
+		{"report.csv", "text/csv", []byte("\xC4\xE0\xF2\xE0;\xD1\xF3\xEC\xEC\xE0\r\n"), ValidationOK},
+		{"report.dat", "application/pdf", Xls, ValidationMismatch},
+		{"report.pdf", "application/pdf", Pdf, ValidationOK},
+		{"report.pdf", "application/pdf", Pdf[:20], ValidationCorrupt},
+		{"report.dat", "application/octet-stream", []byte{0, 1, 2}, ValidationOK},
+	}
+
+	for i, Test := range testData {
+		Result, Reason := ValidateFile(Test.Filename, Test.ContentType, Test.Data)
+		if Result != Test.Result {
+			t.Errorf("[Test Case %v] Wrong result. Expected: %s, Got: %s %s", i+1, Test.Result, Result, Reason)
+		}
+	}
+}
+
+func TestValidateFileLimits(t *testing.T) {
+	defer func(Env map[string]string) { myEnv = Env }(myEnv)
+	Xlsx := makeZip(t, "[Content_Types].xml", "xl/workbook.xml", "xl/sheet1.xml")
+
+	var testData = []struct {
+		Env    map[string]string
+		Result string
+	}{
+		{map[string]string{}, ValidationOK},
+		{map[string]string{"ArchiveMaxEntries": "2"}, ValidationCorrupt},
+		{map[string]string{"ArchiveMaxTotalSize": "30"}, ValidationCorrupt},
+		{map[string]string{"ArchiveMaxEntries": "3", "ArchiveMaxTotalSize": "1000"}, ValidationOK},
+	}
+
+	for i, Test := range testData {
+		myEnv = Test.Env
+		Result, Reason := ValidateFile("report.xlsx", "", Xlsx)
+		if Result != Test.Result {
+			t.Errorf("[Test Case %v] Wrong result. Expected: %s, Got: %s %s", i+1, Test.Result, Result, Reason)
+		}
+	}
+}
+
+func TestQuarantineFile(t *testing.T) {
+	Directory := t.TempDir()
+	s, err := NewLocalSink(filepath.Join(Directory, "Files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Sink = s
+	myEnv = map[string]string{"ValidateContent": "true", "QuarantineDirectory": filepath.Join(Directory, "Quarantine")}
+
+	Locations, err := SaveFileConverted("report.xlsx", []byte("<html>Error</html>"), FileMetadata{})
+	if len(Locations) != 0 || err != nil {
+		t.Errorf("Invalid file is saved: %v %v", Locations, err)
+	}
+
+	Data, err := ioutil.ReadFile(filepath.Join(Directory, "Quarantine", "report.xlsx.reason.txt"))
+	if err != nil || bytes.HasPrefix(Data, []byte(ValidationMismatch)) == false {
+		t.Errorf("Wrong reason file: %s %v", Data, err)
+	}
+	if _, err = os.Stat(filepath.Join(Directory, "Files", "report.xlsx")); os.IsNotExist(err) == false {
+		t.Errorf("Invalid file is saved in output directory")
+	}
+}
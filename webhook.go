@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhook event types
+const (
+	EventMessageProcessed = "message_processed"
+	EventFileSaved        = "file_saved"
+	EventParseError       = "parse_error"
+	EventLoginFailure     = "login_failure"
+	EventHeartbeat        = "heartbeat"
+	EventVirusFound       = "virus_found"
+)
+
+// WebhookEvent - JSON body of webhook request
+type WebhookEvent struct {
+	Type    string        `json:"type"`
+	Time    time.Time     `json:"time"`
+	Account string        `json:"account"`
+	Folder  string        `json:"folder"`
+	Message *FileMetadata `json:"message,omitempty"`
+	File    *FileHookData `json:"file,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// WebhookBackoff - pause before first retry, doubled for every next retry
+var WebhookBackoff = time.Second
+
+// WebhookSettings - copy of webhook settings, it is made at start because myEnv is changed by main goroutine
+// while events are sent
+type WebhookSettings struct {
+	URLs             []string
+	Secret           string
+	Retries          int
+	Timeout          time.Duration
+	HeartbeatSeconds int
+	Account          string
+	Folder           string
+}
+
+// NewWebhookSettings reads webhook settings
+func NewWebhookSettings() WebhookSettings {
+	Settings := WebhookSettings{
+		Secret:           myEnv["WebhookSecret"],
+		Retries:          3,
+		Timeout:          10 * time.Second,
+		HeartbeatSeconds: 60,
+		Account:          myEnv["EMAIL"],
+		Folder:           MailboxName,
+	}
+	for _, URL := range strings.Split(myEnv["WebhookURLs"], ",") {
+		URL = strings.TrimSpace(URL)
+		if URL != "" {
+			Settings.URLs = append(Settings.URLs, URL)
+		}
+	}
+	if n, err := strconv.Atoi(myEnv["WebhookRetries"]); err == nil {
+		Settings.Retries = n
+	}
+	if n, err := strconv.Atoi(myEnv["WebhookTimeoutSeconds"]); err == nil {
+		Settings.Timeout = time.Second * time.Duration(n)
+	}
+	if n, err := strconv.Atoi(myEnv["WebhookHeartbeatSeconds"]); err == nil {
+		Settings.HeartbeatSeconds = n
+	}
+
+	return Settings
+}
+
+var webhookChan chan WebhookEvent
+
+// webhookSettings - settings copy made by StartWebhooks, it is not changed after start
+var webhookSettings WebhookSettings
+
+// StartWebhooks starts sending of events to WebhookURLs and heartbeat every WebhookHeartbeatSeconds.
+// Settings are read once, changes of webhook settings are used after restart
+func StartWebhooks() {
+	webhookSettings = NewWebhookSettings()
+	if len(webhookSettings.URLs) == 0 {
+		return
+	}
+
+	Settings := webhookSettings
+	webhookChan = make(chan WebhookEvent, 1000)
+	go func() {
+		for Event := range webhookChan {
+			SendWebhookEvent(Settings, Event)
+		}
+	}()
+
+	if Settings.HeartbeatSeconds <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(time.Second * time.Duration(Settings.HeartbeatSeconds)) {
+			PostWebhookEvent(WebhookEvent{Type: EventHeartbeat})
+		}
+	}()
+}
+
+// PostWebhookEvent queues event for sending, does not wait for delivery
+func PostWebhookEvent(Event WebhookEvent) {
+	if webhookChan == nil {
+		return
+	}
+
+	Event.Time = time.Now()
+	Event.Account = webhookSettings.Account
+	Event.Folder = webhookSettings.Folder
+
+	select {
+	case webhookChan <- Event:
+	default:
+		slog.Warn("Webhook queue is full, event is lost", "event", Event.Type)
+	}
+}
+
+// SendWebhookEvent sends event to all URLs of settings
+func SendWebhookEvent(Settings WebhookSettings, Event WebhookEvent) {
+	Body, err := json.Marshal(Event)
+	if err != nil {
+		slog.Error("Can not create webhook event", "event", Event.Type, "error", err)
+		return
+	}
+
+	for _, URL := range Settings.URLs {
+		err = DeliverWebhook(Settings, URL, Event.Type, Body)
+		if err != nil {
+			slog.Warn("Can not send webhook", "url", URL, "event", Event.Type, "error", err)
+		}
+	}
+}
+
+// webhookStatusError - receiver answered with not 2xx status
+type webhookStatusError struct {
+	StatusCode int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("http status %d", e.StatusCode)
+}
+
+// DeliverWebhook posts body signed with Secret, retries Retries times with backoff.
+// Only network errors and 5xx statuses are retried, 4xx means request is rejected and will be rejected again
+func DeliverWebhook(Settings WebhookSettings, URL, EventType string, Body []byte) error {
+	Client := &http.Client{Timeout: Settings.Timeout}
+
+	var err error
+	Pause := WebhookBackoff
+	for i := 0; ; i++ {
+		err = postWebhook(Client, Settings.Secret, URL, EventType, Body)
+		if err == nil || i >= Settings.Retries {
+			return err
+		}
+		var StatusError *webhookStatusError
+		if errors.As(err, &StatusError) && StatusError.StatusCode < 500 {
+			return err
+		}
+
+		time.Sleep(Pause)
+		Pause = Pause * 2
+	}
+}
+
+func postWebhook(Client *http.Client, Secret, URL, EventType string, Body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, URL, bytes.NewReader(Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", EventType)
+	if Secret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+WebhookSignature(Secret, Body))
+	}
+
+	resp, err := Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &webhookStatusError{StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
+
+// WebhookSignature returns hex encoded HMAC-SHA256 of body, receiver checks X-Webhook-Signature header with it
+func WebhookSignature(Secret string, Body []byte) string {
+	mac := hmac.New(sha256.New, []byte(Secret))
+	mac.Write(Body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeliverWebhook(t *testing.T) {
+	myEnv = map[string]string{"WebhookSecret": "secret", "WebhookRetries": "2"}
+	WebhookBackoff = time.Millisecond
+
+	Requests := 0
+	var Received WebhookEvent
+	Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Requests++
+		if Requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		Body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+WebhookSignature("secret", Body) {
+			t.Errorf("Wrong signature: %s", r.Header.Get("X-Webhook-Signature"))
+		}
+		if r.Header.Get("X-Webhook-Event") != EventFileSaved {
+			t.Errorf("Wrong event header: %s", r.Header.Get("X-Webhook-Event"))
+		}
+		_ = json.Unmarshal(Body, &Received)
+	}))
+	defer Server.Close()
+
+	Event := WebhookEvent{Type: EventFileSaved, File: &FileHookData{Path: "Files/report.xlsx", FileMetadata: FileMetadata{From: "supplier@example.com"}}}
+	Body, _ := json.Marshal(Event)
+	err := DeliverWebhook(NewWebhookSettings(), Server.URL, Event.Type, Body)
+	if err != nil {
+		t.Fatalf("Error while delivering webhook: %v", err)
+	}
+
+	if Requests != 2 {
+		t.Errorf("Wrong requests count. Expected: %v, Got: %v", 2, Requests)
+	}
+	if Received.File == nil || Received.File.Path != "Files/report.xlsx" || Received.File.From != "supplier@example.com" {
+		t.Errorf("Wrong event received: %+v", Received)
+	}
+}
+
+func TestDeliverWebhookFails(t *testing.T) {
+	myEnv = map[string]string{"WebhookRetries": "1"}
+	WebhookBackoff = time.Millisecond
+
+	Requests := 0
+	Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer Server.Close()
+
+	err := DeliverWebhook(NewWebhookSettings(), Server.URL, EventHeartbeat, []byte("{}"))
+	if err == nil {
+		t.Error("Expected error, got nil")
+	}
+	if Requests != 2 {
+		t.Errorf("Wrong requests count. Expected: %v, Got: %v", 2, Requests)
+	}
+}
+
+func TestDeliverWebhookRejected(t *testing.T) {
+	myEnv = map[string]string{"WebhookRetries": "3"}
+	WebhookBackoff = time.Millisecond
+
+	Requests := 0
+	Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer Server.Close()
+
+	err := DeliverWebhook(NewWebhookSettings(), Server.URL, EventHeartbeat, []byte("{}"))
+	if err == nil {
+		t.Error("Expected error, got nil")
+	}
+	if Requests != 1 {
+		t.Errorf("4xx is retried. Expected: %v, Got: %v", 1, Requests)
+	}
+}
+
+func TestNewWebhookSettings(t *testing.T) {
+	myEnv = map[string]string{"EMAIL": "buh@example.com", "WebhookURLs": " http://a/hook, ,http://b/hook", "WebhookTimeoutSeconds": "5"}
+	Settings := NewWebhookSettings()
+
+	//settings are copied, later changes are not seen by sender
+	myEnv["WebhookURLs"] = "http://c/hook"
+	if len(Settings.URLs) != 2 || Settings.URLs[0] != "http://a/hook" || Settings.URLs[1] != "http://b/hook" {
+		t.Errorf("Wrong URLs: %v", Settings.URLs)
+	}
+	if Settings.Retries != 3 || Settings.Timeout != 5*time.Second || Settings.HeartbeatSeconds != 60 || Settings.Account != "buh@example.com" {
+		t.Errorf("Wrong settings: %+v", Settings)
+	}
+}